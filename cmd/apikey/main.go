@@ -0,0 +1,67 @@
+// Command apikey generates an API key and the entry to add to the keys file.
+// The key itself is printed once and is not stored anywhere.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nodelike/chronos-gateway/internal/auth"
+)
+
+func main() {
+	name := flag.String("name", "", "client name used in metrics and logs")
+	tenant := flag.String("tenant", "", "tenant of the client")
+	scopes := flag.String("scopes", "", "comma-separated endpoints the key may call, empty for all")
+	notBefore := flag.String("not-before", "", "RFC 3339 time the key becomes valid")
+	userID := flag.String("user-id", "", "user the key is bound to, empty for any")
+	deviceID := flag.String("device-id", "", "device the key is bound to, empty for any")
+	validFor := flag.Duration("valid-for", 0, "how long the key stays valid, 0 for no expiry")
+	flag.Parse()
+
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+
+	key, id, hash, err := auth.GenerateKey()
+	if err != nil {
+		log.Fatalf("Error generating key: %v", err)
+	}
+
+	entry := map[string]interface{}{
+		"id":   id,
+		"name": *name,
+		"hash": hash,
+	}
+	if *tenant != "" {
+		entry["tenant"] = *tenant
+	}
+	if *scopes != "" {
+		entry["scopes"] = strings.Split(*scopes, ",")
+	}
+	if *userID != "" {
+		entry["user_id"] = *userID
+	}
+	if *deviceID != "" {
+		entry["device_id"] = *deviceID
+	}
+	start := time.Now().UTC()
+	if *notBefore != "" {
+		if start, err = time.Parse(time.RFC3339, *notBefore); err != nil {
+			log.Fatalf("Invalid -not-before: %v", err)
+		}
+		entry["not_before"] = start
+	}
+	if *validFor > 0 {
+		entry["expires_at"] = start.Add(*validFor).Truncate(time.Second)
+	}
+
+	data, _ := json.MarshalIndent(entry, "", "  ")
+	fmt.Fprintf(os.Stderr, "API key (shown once): %s\n\nAdd this entry to the keys file:\n", key)
+	fmt.Println(string(data))
+}
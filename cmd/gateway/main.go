@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
 	"github.com/nodelike/chronos-gateway/internal/config"
 	"github.com/nodelike/chronos-gateway/internal/handlers"
 	"github.com/nodelike/chronos-gateway/internal/middleware"
@@ -14,6 +18,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	log.Println("Starting Chronos Gateway...")
 
@@ -23,53 +30,326 @@ func main() {
 	// Initialize services
 	log.Println("Initializing services...")
 	kafkaProducer := services.NewKafkaProducer(cfg.Kafka.Brokers, cfg.Kafka.DevelopmentMode)
-	minioClient := services.NewMinIOClient(services.MinIOConfig{
-		Endpoint:         cfg.MinIO.Endpoint,
-		AccessKey:        cfg.MinIO.AccessKey,
-		SecretKey:        cfg.MinIO.SecretKey,
-		Bucket:           cfg.MinIO.Bucket,
-		DevelopmentMode:  cfg.MinIO.DevelopmentMode,
-		LocalStoragePath: cfg.MinIO.LocalStoragePath,
+	var auditLog *services.AuditLog
+	if cfg.Audit.Enable {
+		var err error
+		auditLog, err = services.NewAuditLog(services.AuditConfig{
+			File:       cfg.Audit.File,
+			MaxSize:    cfg.Audit.MaxSize,
+			MaxBackups: cfg.Audit.MaxBackups,
+			Topic:      cfg.Audit.Topic,
+			Successes:  cfg.Audit.Successes,
+		}, kafkaProducer)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer auditLog.Close()
+	}
+	var failureLimiter *services.FailureLimiter
+	if cfg.AuthFailures.MaxFailures > 0 {
+		failureLimiter = services.NewFailureLimiter(cfg.AuthFailures.MaxFailures, cfg.AuthFailures.Window, cfg.AuthFailures.Block)
+	}
+	imageProcessing := make(map[string]services.ImageProcessingConfig, len(cfg.ImageProcessing))
+	for source, images := range cfg.ImageProcessing {
+		imageProcessing[source] = services.ImageProcessingConfig{
+			StripMetadata: images.StripMetadata,
+			ExtractEXIF:   images.ExtractEXIF,
+			Thumbnail:     images.Thumbnail,
+			ThumbnailSize: images.ThumbnailSize,
+			MaxPixels:     images.MaxPixels,
+		}
+	}
+	signer := services.NewURLSigner(cfg.Storage.SigningSecret, cfg.Storage.PublicURL)
+	var keyring *services.Keyring
+	if cfg.Encryption.KeyringFile != "" {
+		var err error
+		if keyring, err = services.LoadKeyring(cfg.Encryption.KeyringFile); err != nil {
+			log.Fatalf("Error loading keyring: %v", err)
+		}
+	}
+	storageConfig := services.StorageConfig{
+		Backend: cfg.Storage.Backend,
+		S3: services.MinIOConfig{
+			Endpoint:      cfg.MinIO.Endpoint,
+			AccessKey:     cfg.MinIO.AccessKey,
+			SecretKey:     cfg.MinIO.SecretKey,
+			AccessKeyFile: cfg.MinIO.AccessKeyFile,
+			SecretKeyFile: cfg.MinIO.SecretKeyFile,
+			Bucket:        cfg.MinIO.Bucket,
+			Region:        cfg.MinIO.Region,
+			Secure:        cfg.MinIO.Secure,
+			CABundle:      cfg.MinIO.CABundle,
+			BucketLookup:  cfg.MinIO.BucketLookup,
+			Bootstrap: services.BucketBootstrap{
+				CreateBucket:         cfg.MinIO.Bootstrap.CreateBucket,
+				Versioning:           cfg.MinIO.Bootstrap.Versioning,
+				ObjectLock:           cfg.MinIO.Bootstrap.ObjectLock,
+				RetentionMode:        cfg.MinIO.Bootstrap.RetentionMode,
+				RetentionDays:        cfg.MinIO.Bootstrap.RetentionDays,
+				ExpireDays:           cfg.MinIO.Bootstrap.ExpireDays,
+				NoncurrentExpireDays: cfg.MinIO.Bootstrap.NoncurrentExpireDays,
+			},
+			Encryption: cfg.Encryption.S3,
+			Keyring:    keyring,
+		},
+		Filesystem: services.FilesystemConfig{
+			Path:          cfg.Storage.Filesystem.Path,
+			PrefixQuota:   cfg.Storage.Filesystem.PrefixQuota,
+			Quotas:        cfg.Storage.Filesystem.Quotas,
+			MaxAge:        cfg.Storage.Filesystem.MaxAge,
+			SweepInterval: cfg.Storage.Filesystem.SweepInterval,
+		},
+		FallbackToFilesystem: cfg.Storage.FallbackToFilesystem,
+		EncryptFiles:         cfg.Encryption.Filesystem,
+		Keyring:              keyring,
+	}
+	storage, err := services.NewStorage(storageConfig, signer)
+	if err != nil {
+		log.Fatalf("Error creating storage: %v", err)
+	}
+	var staging services.Storage
+	if cfg.Storage.Staging.Enable {
+		staging, err = services.NewStagingStorage(cfg.Storage.Staging.Path, storageConfig, signer)
+		if err != nil {
+			log.Fatalf("Error creating storage: %v", err)
+		}
+	}
+	storage = services.NewResilientStorage(storage, staging, services.ResilienceConfig{
+		MaxAttempts:      cfg.Storage.Retry.MaxAttempts,
+		BaseDelay:        cfg.Storage.Retry.BaseDelay,
+		MaxDelay:         cfg.Storage.Retry.MaxDelay,
+		FailureThreshold: cfg.Storage.CircuitBreaker.FailureThreshold,
+		OpenTimeout:      cfg.Storage.CircuitBreaker.OpenTimeout,
+		ForwardInterval:  cfg.Storage.Staging.ForwardInterval,
+	})
+	mediaStore := services.NewMediaStore(storage, signer, imageProcessing, cfg.Storage.UploadTimeout)
+	uploadPolicies := make(map[string]services.UploadPolicy, len(cfg.Uploads))
+	for source, policy := range cfg.Uploads {
+		uploadPolicies[source] = services.UploadPolicy{
+			AllowedTypes:    policy.AllowedTypes,
+			MaxSize:         policy.MaxSize,
+			MaxFilesPerHour: policy.MaxFilesPerHour,
+		}
+	}
+	uploadValidator := services.NewUploadValidator(uploadPolicies)
+	if err := services.CheckUpgrades(); err != nil {
+		log.Fatalf("Error in event schema upgrades: %v", err)
+	}
+	var schemas *services.SchemaRegistry
+	if cfg.Schemas.Enable {
+		var err error
+		schemas, err = services.LoadSchemas(cfg.Schemas.Dir, cfg.Schemas.Unvalidated)
+		if err != nil {
+			log.Fatalf("Error loading event schemas: %v", err)
+		}
+	}
+	var locationValidator *services.LocationValidator
+	if cfg.LocationValidation.Enable {
+		var err error
+		locationValidator, err = services.NewLocationValidator(cfg.LocationValidation.Rules, cfg.LocationValidation.MaxAccuracy)
+		if err != nil {
+			log.Fatalf("Error in location validation rules: %v", err)
+		}
+	}
+	uploadSessions := services.NewUploadSessions(mediaStore, uploadValidator, services.UploadSessionConfig{
+		TTL:          cfg.UploadSessions.TTL,
+		MaxChunks:    cfg.UploadSessions.MaxChunks,
+		MaxChunkSize: cfg.UploadSessions.MaxChunkSize,
 	})
 	metrics := services.NewMetricsCollector()
 
+	// Credentials accepted on the HTTP, WebSocket and gRPC entry points
+	var verifier *auth.JWTVerifier
+	if cfg.JWT.Enable {
+		var err error
+		verifier, err = auth.NewJWTVerifier(auth.JWTConfig{
+			Algorithms:  cfg.JWT.Algorithms,
+			HMACSecret:  cfg.JWT.HMACSecret,
+			JWKSFile:    cfg.JWT.JWKSFile,
+			JWKSURL:     cfg.JWT.JWKSURL,
+			JWKSRefresh: cfg.JWT.JWKSRefresh,
+			Issuer:      cfg.JWT.Issuer,
+			Audience:    cfg.JWT.Audience,
+			ClockSkew:   cfg.JWT.ClockSkew,
+			UserClaim:   cfg.JWT.UserClaim,
+			DeviceClaim: cfg.JWT.DeviceClaim,
+		})
+		if err != nil {
+			log.Fatalf("Error configuring JWT authentication: %v", err)
+		}
+	}
+	apiKeys := make(map[string]auth.APIKey, len(cfg.APIKeys))
+	for key, apiKey := range cfg.APIKeys {
+		apiKeys[key] = auth.APIKey{
+			Name:      apiKey.Name,
+			Tenant:    apiKey.Tenant,
+			Scopes:    apiKey.Scopes,
+			Enabled:   apiKey.Enabled,
+			ExpiresAt: apiKey.ExpiresAt,
+			UserID:    apiKey.UserID,
+			DeviceID:  apiKey.DeviceID,
+		}
+	}
+	keySources := []auth.KeySource{auth.NewStaticKeys(apiKeys)}
+	if cfg.APIKeysFile != "" {
+		keyStore, err := auth.LoadKeyStore(cfg.APIKeysFile)
+		if err != nil {
+			log.Fatalf("Error loading API keys: %v", err)
+		}
+		keySources = append([]auth.KeySource{keyStore}, keySources...)
+	}
+	var managedKeys *auth.ManagedKeys
+	if cfg.Admin.Enable {
+		if cfg.Admin.Token == "" {
+			log.Fatal("Admin API enabled without an admin token")
+		}
+		var err error
+		managedKeys, err = auth.OpenManagedKeys(cfg.Admin.KeysDB)
+		if err != nil {
+			log.Fatalf("Error opening managed API keys: %v", err)
+		}
+		defer managedKeys.Close()
+		keySources = append([]auth.KeySource{managedKeys}, keySources...)
+	}
+	if len(apiKeys) > 0 && !cfg.DisableAuth {
+		log.Printf("[AUTH] %d plaintext API keys in the config file; move them to a hashed APIKeysFile", len(apiKeys))
+	}
+	authenticator := auth.NewAuthenticator(verifier, keySources...)
+	connectionTokens := auth.NewConnectionTokens(cfg.WebSocket.TokenTTL)
+	authenticator.AcceptConnectionTokens(connectionTokens)
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enable {
+		tlsReloader, err := auth.NewTLSReloader(auth.TLSConfig{
+			CertFile:     cfg.TLS.CertFile,
+			KeyFile:      cfg.TLS.KeyFile,
+			ClientCAFile: cfg.TLS.ClientCAFile,
+			ClientAuth:   cfg.TLS.ClientAuth,
+			IdentityFrom: cfg.TLS.IdentityFrom,
+			MinVersion:   cfg.TLS.MinVersion,
+			CipherSuites: cfg.TLS.CipherSuites,
+		})
+		if err != nil {
+			log.Fatalf("Error loading TLS certificates: %v", err)
+		}
+		tlsConfig = tlsReloader.ServerConfig()
+		if cfg.TLS.ClientCAFile != "" {
+			authenticator.AcceptCertificates(tlsReloader)
+		}
+	}
+
+	// Client address filters per route group
+	ipFilters := make(map[string]*services.IPFilter, len(cfg.IPFilters))
+	for group, filter := range cfg.IPFilters {
+		switch group {
+		case "api", "admin", "ops", "grpc":
+		default:
+			log.Fatalf("Unknown IP filter group %q; use api, admin, ops or grpc", group)
+		}
+		ipFilter, err := services.NewIPFilter(filter.Allow, filter.Deny)
+		if err != nil {
+			log.Fatalf("Error in IP filter %s: %v", group, err)
+		}
+		ipFilters[group] = ipFilter
+	}
+
 	// Create Gin engine
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.New()
-	router.Use(gin.Recovery())
+	router := newEngine(cfg.TrustedProxies)
 
-	// Public endpoints that don't require authentication
-	router.GET("/health", func(c *gin.Context) {
+	// Public endpoints that don't require authentication. They are still
+	// only open to the addresses the API is.
+	public := router.Group("")
+	public.Use(middleware.Audit(auditLog), middleware.IPFiltering("api", ipFilters["api"], metrics))
+	public.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
-	// Metrics endpoint (consider adding authentication for production)
-	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// Signed media links carry their own credential in the query string
+	public.GET("/media/signed/*key", handlers.SignedMediaHandler(mediaStore))
+	public.HEAD("/media/signed/*key", handlers.SignedMediaHandler(mediaStore))
+
+	// Metrics belong on the ops listener; without it they stay public
+	metricsPath := cfg.Metrics.Endpoint
+	if metricsPath == "" {
+		metricsPath = "/metrics"
+	}
+	if cfg.Metrics.Enable && !cfg.Ops.Enable {
+		log.Printf("Serving metrics on the public listener at %s; enable Ops to protect them", metricsPath)
+		public.GET(metricsPath, gin.WrapH(promhttp.Handler()))
+	}
+
+	// Runtime switches, flipped through the ops listener
+	toggles := services.NewToggles()
+	maintenance := toggles.Register("maintenance", "Reject API requests with 503 while the gateway is drained", false)
+	requestLogging := toggles.Register("request_logging", "Log every API request", false)
 
 	// API routes with authentication
 	api := router.Group("")
 	{
 		// Apply authentication and metrics middleware to API routes
 		api.Use(middleware.Metrics(metrics))
-		api.Use(middleware.Authentication(cfg.APIKeys, cfg.DisableAuth))
+		api.Use(middleware.Audit(auditLog))
+		api.Use(middleware.IPFiltering("api", ipFilters["api"], metrics))
+		api.Use(middleware.When(requestLogging, middleware.Logger()))
+		api.Use(middleware.When(maintenance, middleware.Maintenance()))
+		api.Use(middleware.AuthFailureLimit(failureLimiter))
+		api.Use(middleware.Authentication(authenticator, cfg.DisableAuth))
+		if cfg.RateLimits.Enable {
+			routes := make(map[string]services.RouteLimits, len(cfg.RateLimits.Routes))
+			for route, limit := range cfg.RateLimits.Routes {
+				routes[route] = services.RouteLimits{
+					Requests: services.RateLimit{Rate: limit.Requests, Burst: limit.RequestBurst},
+					Events:   services.RateLimit{Rate: limit.Events, Burst: limit.EventBurst},
+				}
+			}
+			rateLimits := toggles.Register("rate_limits", "Enforce rate limits", true)
+			api.Use(middleware.When(rateLimits, middleware.RateLimiting(services.NewRateLimiter(routes), cfg.RateLimits.KeyBy)))
+		}
+		if cfg.RequestSigning.Enable {
+			requestVerifier, err := auth.LoadRequestVerifier(cfg.RequestSigning.SecretsFile, cfg.RequestSigning.Window, cfg.RequestSigning.NonceCapacity)
+			if err != nil {
+				log.Fatalf("Error loading request signing secrets: %v", err)
+			}
+			api.Use(middleware.RequestSigning(requestVerifier, cfg.RequestSigning.Endpoints, cfg.RequestSigning.MaxBodySize))
+		}
 
 		// API v1 routes
 		v1 := api.Group("/v1")
 		{
 			// HTTP endpoints
-			v1.POST("/android", handlers.HandleAndroidEvent(kafkaProducer))
-			v1.POST("/macos", handlers.HandleMacOSEvent(kafkaProducer))
-			v1.POST("/browser", handlers.HandleBrowserEvent(kafkaProducer, minioClient))
+			v1.POST("/android", handlers.HandleAndroidEvent(kafkaProducer, schemas))
+			v1.POST("/macos", handlers.HandleMacOSEvent(kafkaProducer, schemas))
+			v1.POST("/browser", handlers.HandleBrowserEvent(kafkaProducer, mediaStore, uploadValidator, schemas))
 
 			// Location endpoints
-			v1.POST("/location", handlers.HandleLocationEvent(kafkaProducer))
-			v1.POST("/locations/batch", handlers.HandleBatchLocationEvents(kafkaProducer))
+			v1.POST("/location", handlers.HandleLocationEvent(kafkaProducer, locationValidator, schemas))
+			v1.POST("/locations/batch", handlers.HandleBatchLocationEvents(kafkaProducer, locationValidator, schemas))
+
+			// Event schemas the endpoints validate against
+			v1.GET("/schemas", handlers.SchemaListHandler(schemas))
+			v1.GET("/schemas/:source/:version", handlers.SchemaHandler(schemas))
 
 			// WebSocket endpoint
-			v1.GET("/ws", handlers.WebSocketHandler(kafkaProducer))
+			v1.GET("/ws", handlers.WebSocketHandler(kafkaProducer, cfg.WebSocket.AllowedOrigins, schemas, locationValidator))
+			v1.POST("/ws-tokens", handlers.WebSocketTokenHandler(connectionTokens))
 
 			// Media upload endpoint
-			v1.POST("/upload", handlers.MediaUploadHandler(minioClient))
+			v1.POST("/upload", handlers.MediaUploadHandler(kafkaProducer, mediaStore, uploadValidator))
+			v1.POST("/upload/:source", handlers.MediaUploadHandler(kafkaProducer, mediaStore, uploadValidator))
+
+			// Chunked uploads assembled into one object
+			v1.POST("/upload-sessions", handlers.UploadSessionOpenHandler(uploadSessions, uploadValidator))
+			v1.GET("/upload-sessions/:id", handlers.UploadSessionStatusHandler(uploadSessions))
+			v1.PUT("/upload-sessions/:id/chunks/:index", handlers.UploadSessionChunkHandler(uploadSessions, uploadValidator, cfg.UploadSessions.MaxChunkSize))
+			v1.POST("/upload-sessions/:id/complete", handlers.UploadSessionCompleteHandler(kafkaProducer, uploadSessions, uploadValidator))
+			v1.DELETE("/upload-sessions/:id", handlers.UploadSessionAbortHandler(uploadSessions))
+
+			// Media retrieval, deletion and signed links for the caller's own objects
+			v1.GET("/media/*key", handlers.MediaGetHandler(mediaStore))
+			v1.HEAD("/media/*key", handlers.MediaGetHandler(mediaStore))
+			v1.DELETE("/media/*key", handlers.MediaDeleteHandler(kafkaProducer, mediaStore))
+			v1.POST("/media-links/*key", handlers.MediaLinkHandler(mediaStore))
 		}
 	}
 
@@ -79,23 +359,155 @@ func main() {
 
 	// Start gRPC server in goroutine
 	log.Println("Starting gRPC server on", cfg.GRPC.Port)
-	go handlers.StartGRPCServer(cfg.GRPC.Port, kafkaProducer)
+	grpcAuthenticator := authenticator
+	if cfg.DisableAuth {
+		grpcAuthenticator = nil
+	}
+	go handlers.StartGRPCServer(cfg.GRPC.Port, kafkaProducer, grpcAuthenticator, tlsConfig, auditLog, ipFilters["grpc"], metrics, schemas, locationValidator)
 
 	// Start HTTP server in a goroutine
 	log.Println("Starting HTTP server on", cfg.HTTP.Port)
 	go func() {
-		if err := router.Run(cfg.HTTP.Port); err != nil {
+		server := &http.Server{
+			Addr:              cfg.HTTP.Port,
+			Handler:           router,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+			ReadTimeout:       cfg.HTTP.ReadTimeout,
+			WriteTimeout:      cfg.HTTP.WriteTimeout,
+			IdleTimeout:       cfg.HTTP.IdleTimeout,
+			MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+		}
+		if err := listenAndServe(server); err != nil {
 			log.Fatalf("Error starting server: %v", err)
 		}
 	}()
 
+	// Plain HTTP clients are sent to the TLS listener
+	if tlsConfig != nil && cfg.TLS.RedirectPort != "" {
+		log.Println("Redirecting HTTP to HTTPS on", cfg.TLS.RedirectPort)
+		go func() {
+			server := &http.Server{
+				Addr:              cfg.TLS.RedirectPort,
+				Handler:           redirectToHTTPS(cfg.HTTP.Port),
+				ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+				IdleTimeout:       cfg.HTTP.IdleTimeout,
+			}
+			if err := server.ListenAndServe(); err != nil {
+				log.Fatalf("Error starting redirect server: %v", err)
+			}
+		}()
+	}
+
+	// The admin API has its own listener, so it can stay off public networks
+	if managedKeys != nil {
+		admin := newEngine(cfg.TrustedProxies)
+		admin.Use(middleware.Audit(auditLog), middleware.IPFiltering("admin", ipFilters["admin"], metrics))
+		admin.Use(middleware.AuthFailureLimit(failureLimiter), middleware.AdminAuthentication(cfg.Admin.Token))
+		admin.GET("/admin/keys", handlers.AdminListKeysHandler(managedKeys))
+		admin.POST("/admin/keys", handlers.AdminCreateKeyHandler(managedKeys))
+		admin.GET("/admin/keys/:id", handlers.AdminGetKeyHandler(managedKeys))
+		admin.POST("/admin/keys/:id/disable", handlers.AdminSetKeyEnabledHandler(managedKeys, false))
+		admin.POST("/admin/keys/:id/enable", handlers.AdminSetKeyEnabledHandler(managedKeys, true))
+		admin.POST("/admin/keys/:id/rotate", handlers.AdminRotateKeyHandler(managedKeys))
+		admin.DELETE("/admin/keys/:id", handlers.AdminDeleteKeyHandler(managedKeys))
+
+		log.Println("Starting admin server on", cfg.Admin.Port)
+		go func() {
+			if err := listenAndServe(newServer(cfg, cfg.Admin.Port, admin, tlsConfig)); err != nil {
+				log.Fatalf("Error starting admin server: %v", err)
+			}
+		}()
+	}
+
+	// Operational endpoints get their own listener and credentials
+	if cfg.Ops.Enable {
+		if cfg.Ops.Password == "" && cfg.Ops.Token == "" {
+			log.Fatal("Ops listener enabled without a password or token")
+		}
+		ops := newEngine(cfg.TrustedProxies)
+		ops.Use(middleware.Audit(auditLog), middleware.IPFiltering("ops", ipFilters["ops"], metrics), middleware.AuthFailureLimit(failureLimiter))
+		ops.Use(middleware.OpsAuthentication(cfg.Ops.Username, cfg.Ops.Password, cfg.Ops.Token))
+		if cfg.Metrics.Enable {
+			ops.GET(metricsPath, gin.WrapH(promhttp.Handler()))
+		}
+		if cfg.Ops.Pprof {
+			ops.GET("/debug/pprof/*name", handlers.PprofHandler())
+			ops.POST("/debug/pprof/*name", handlers.PprofHandler())
+		}
+		ops.GET("/buildinfo", handlers.BuildInfoHandler(version))
+		ops.GET("/config", handlers.ConfigHandler(cfg.Redacted()))
+		ops.GET("/toggles", handlers.TogglesHandler(toggles))
+		ops.PUT("/toggles/:name", handlers.SetToggleHandler(toggles))
+
+		log.Println("Starting ops server on", cfg.Ops.Port)
+		go func() {
+			if err := listenAndServe(newServer(cfg, cfg.Ops.Port, ops, tlsConfig)); err != nil {
+				log.Fatalf("Error starting ops server: %v", err)
+			}
+		}()
+	}
+
 	log.Println("Chronos Gateway is ready to receive events")
 	log.Println("API Endpoints:")
 	log.Printf("  - Health Check: http://localhost%s/health", cfg.HTTP.Port)
-	log.Printf("  - Metrics: http://localhost%s/metrics", cfg.HTTP.Port)
 	log.Printf("  - Location Events: http://localhost%s/v1/location", cfg.HTTP.Port)
 
 	// Block until we receive a signal
 	<-quit
 	log.Println("Shutting down servers...")
 }
+
+// newEngine creates a Gin engine that only believes forwarded client
+// addresses from the trusted proxies
+func newEngine(trustedProxies []string) *gin.Engine {
+	engine := gin.New()
+	if err := engine.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Error in trusted proxies: %v", err)
+	}
+	engine.Use(gin.Recovery())
+	return engine
+}
+
+// newServer creates a server for one of the side listeners, with the header
+// and idle timeouts of the main one. Responses such as profiles can take
+// longer, so there is no read or write timeout.
+func newServer(cfg *config.Config, addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+	}
+}
+
+// listenAndServe serves over TLS if the server has a TLS config
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// Certificates come from the TLS config so they can be reloaded
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// redirectToHTTPS sends requests to the same host and path on the TLS port.
+// GET and HEAD get 301; other methods get 308 so the body is sent again.
+func redirectToHTTPS(tlsPort string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsPort)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Authentication errors
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidAPIKey      = errors.New("invalid API key")
+	ErrExpiredAPIKey      = errors.New("API key expired")
+	ErrInvalidToken       = errors.New("invalid bearer token")
+)
+
+// APIKey describes the client an API key belongs to
+type APIKey struct {
+	Name      string
+	Tenant    string
+	Scopes    []string // Endpoints the key may call, see Principal.Allows
+	Enabled   bool
+	NotBefore time.Time // Zero for keys valid from the start
+	ExpiresAt time.Time // Zero for keys that don't expire
+	UserID    string    // Binds the key to one user, if set
+	DeviceID  string    // Binds the key to one device, if set
+}
+
+// KeySource looks up the API key a client presented
+type KeySource interface {
+	Lookup(key string) (*APIKey, bool)
+}
+
+// Authenticator checks the credentials of HTTP, WebSocket and gRPC callers.
+// A bearer token takes precedence over an API key when both are sent.
+type Authenticator struct {
+	keys         []KeySource       // Consulted in order
+	jwt          *JWTVerifier      // nil if bearer tokens are not accepted
+	certificates *TLSReloader      // nil if client certificates are not accepted
+	connections  *ConnectionTokens // nil if WebSocket connection tokens are not accepted
+}
+
+func NewAuthenticator(verifier *JWTVerifier, keys ...KeySource) *Authenticator {
+	return &Authenticator{keys: keys, jwt: verifier}
+}
+
+// AcceptCertificates lets verified client certificates authenticate callers
+// that send no token or API key
+func (a *Authenticator) AcceptCertificates(reloader *TLSReloader) {
+	a.certificates = reloader
+}
+
+// AcceptConnectionTokens lets WebSocket upgrades authenticate with tokens
+// from the given store
+func (a *Authenticator) AcceptConnectionTokens(tokens *ConnectionTokens) {
+	a.connections = tokens
+}
+
+// AuthenticateConnection redeems a WebSocket connection token
+func (a *Authenticator) AuthenticateConnection(token string) (*Principal, error) {
+	if a.connections == nil {
+		return nil, ErrInvalidConnectionToken
+	}
+	return a.connections.Redeem(token)
+}
+
+// Authenticate verifies an Authorization header value, an API key or the
+// client certificate of the connection, in that order. state is nil for
+// plaintext connections.
+func (a *Authenticator) Authenticate(authorization, apiKey string, state *tls.ConnectionState) (*Principal, error) {
+	if token, ok := BearerToken(authorization); ok && a.jwt != nil {
+		principal, err := a.jwt.Verify(token)
+		if err != nil {
+			return nil, errors.Join(ErrInvalidToken, err)
+		}
+		return principal, nil
+	}
+
+	if apiKey == "" {
+		if a.certificates != nil {
+			if principal := a.certificates.CertificatePrincipal(state); principal != nil {
+				return principal, nil
+			}
+		}
+		return nil, ErrMissingCredentials
+	}
+	var key *APIKey
+	for _, source := range a.keys {
+		if found, ok := source.Lookup(apiKey); ok {
+			key = found
+			break
+		}
+	}
+	if key == nil || !key.Enabled {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if !key.NotBefore.IsZero() && now.Before(key.NotBefore) {
+		return nil, ErrInvalidAPIKey
+	}
+	if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+		return nil, ErrExpiredAPIKey
+	}
+	return &Principal{
+		Subject:   key.Name,
+		Name:      key.Name,
+		Tenant:    key.Tenant,
+		Scopes:    key.Scopes,
+		Method:    MethodAPIKey,
+		ExpiresAt: key.ExpiresAt,
+		UserID:    key.UserID,
+		DeviceID:  key.DeviceID,
+	}, nil
+}
+
+// StaticKeys are plaintext keys from the main config file. Lookups compare
+// digests against every key in constant time, so response times don't reveal
+// how much of a key was right.
+type StaticKeys struct {
+	digests [][32]byte
+	keys    []APIKey
+}
+
+func NewStaticKeys(keys map[string]APIKey) *StaticKeys {
+	static := &StaticKeys{}
+	for key, apiKey := range keys {
+		static.digests = append(static.digests, sha256.Sum256([]byte(key)))
+		static.keys = append(static.keys, apiKey)
+	}
+	return static
+}
+
+func (s *StaticKeys) Lookup(key string) (*APIKey, bool) {
+	digest := sha256.Sum256([]byte(key))
+	match := -1
+	for i := range s.digests {
+		if subtle.ConstantTimeCompare(digest[:], s.digests[i][:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, false
+	}
+	return &s.keys[match], true
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer" value
+func BearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
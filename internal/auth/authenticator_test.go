@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	now := time.Now()
+	authenticator := NewAuthenticator(nil, NewStaticKeys(map[string]APIKey{
+		"active-key":   {Name: "desktop-agent", Tenant: "acme", Scopes: []string{"upload"}, Enabled: true, UserID: "user-1"},
+		"disabled-key": {Name: "old-agent", Enabled: false},
+		"future-key":   {Name: "next-agent", Enabled: true, NotBefore: now.Add(time.Hour)},
+		"expired-key":  {Name: "past-agent", Enabled: true, ExpiresAt: now.Add(-time.Hour)},
+	}))
+
+	tests := []struct {
+		name   string
+		apiKey string
+		want   string // Principal name
+		err    error
+	}{
+		{name: "active", apiKey: "active-key", want: "desktop-agent"},
+		{name: "unknown", apiKey: "guessed-key", err: ErrInvalidAPIKey},
+		{name: "prefix of a key", apiKey: "active", err: ErrInvalidAPIKey},
+		{name: "disabled", apiKey: "disabled-key", err: ErrInvalidAPIKey},
+		{name: "not yet valid", apiKey: "future-key", err: ErrInvalidAPIKey},
+		{name: "expired", apiKey: "expired-key", err: ErrExpiredAPIKey},
+		{name: "no credentials", err: ErrMissingCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate("", tt.apiKey, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if principal.Name != tt.want || principal.Method != MethodAPIKey || principal.Tenant != "acme" || principal.UserID != "user-1" {
+				t.Fatalf("Authenticate() = %+v", principal)
+			}
+		})
+	}
+}
+
+func TestAuthenticateKeySourceOrder(t *testing.T) {
+	first := NewStaticKeys(map[string]APIKey{"shared-key": {Name: "from-file", Enabled: true}})
+	second := NewStaticKeys(map[string]APIKey{"shared-key": {Name: "from-config", Enabled: true}, "config-key": {Name: "config-only", Enabled: true}})
+	authenticator := NewAuthenticator(nil, first, second)
+
+	tests := []struct {
+		apiKey string
+		want   string
+	}{
+		{apiKey: "shared-key", want: "from-file"},
+		{apiKey: "config-key", want: "config-only"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.apiKey, func(t *testing.T) {
+			principal, err := authenticator.Authenticate("", tt.apiKey, nil)
+			if err != nil || principal.Name != tt.want {
+				t.Fatalf("Authenticate() = %+v, %v, want %s", principal, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrincipalAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		endpoint string
+		want     bool
+	}{
+		{name: "no scopes allow everything", endpoint: "upload", want: true},
+		{name: "exact scope", scopes: []string{"upload"}, endpoint: "upload", want: true},
+		{name: "parent scope", scopes: []string{"upload-sessions"}, endpoint: "upload-sessions/chunks", want: true},
+		{name: "wildcard", scopes: []string{"*"}, endpoint: "media", want: true},
+		{name: "slashes are trimmed", scopes: []string{"/upload/"}, endpoint: "upload", want: true},
+		{name: "other endpoint", scopes: []string{"upload"}, endpoint: "media", want: false},
+		{name: "shared prefix is not a parent", scopes: []string{"upload"}, endpoint: "upload-sessions", want: false},
+		{name: "child scope does not allow parent", scopes: []string{"upload-sessions/chunks"}, endpoint: "upload-sessions", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal := &Principal{Scopes: tt.scopes}
+			if got := principal.Allows(tt.endpoint); got != tt.want {
+				t.Fatalf("Allows(%q) = %v, want %v", tt.endpoint, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		route string
+		want  string
+	}{
+		{route: "/v1/upload", want: "upload"},
+		{route: "/v1/upload/:source", want: "upload"},
+		{route: "/v1/upload-sessions/:id/chunks/:index", want: "upload-sessions/chunks"},
+		{route: "/v1/media/*key", want: "media"},
+		{route: "/ws", want: "ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			if got := Endpoint(tt.route); got != tt.want {
+				t.Fatalf("Endpoint(%q) = %q, want %q", tt.route, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		principal  Principal
+		userID     string
+		deviceID   string
+		wantUser   string
+		wantDevice string
+		mismatch   string
+	}{
+		{name: "unbound", userID: "user-1", deviceID: "device-1", wantUser: "user-1", wantDevice: "device-1"},
+		{name: "filled in", principal: Principal{UserID: "user-1", DeviceID: "device-1"}, wantUser: "user-1", wantDevice: "device-1"},
+		{name: "matching", principal: Principal{UserID: "user-1"}, userID: "user-1", deviceID: "device-2", wantUser: "user-1", wantDevice: "device-2"},
+		{name: "other user", principal: Principal{UserID: "user-1"}, userID: "user-2", mismatch: "user_id"},
+		{name: "other device", principal: Principal{UserID: "user-1", DeviceID: "device-1"}, deviceID: "device-2", mismatch: "device_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, deviceID := tt.userID, tt.deviceID
+			mismatch := tt.principal.BindIdentity(&userID, &deviceID)
+			if mismatch != tt.mismatch {
+				t.Fatalf("BindIdentity() = %q, want %q", mismatch, tt.mismatch)
+			}
+			if mismatch == "" && (userID != tt.wantUser || deviceID != tt.wantDevice) {
+				t.Fatalf("BindIdentity() bound %q/%q, want %q/%q", userID, deviceID, tt.wantUser, tt.wantDevice)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidConnectionToken is returned for unknown, used or expired
+// connection tokens
+var ErrInvalidConnectionToken = errors.New("invalid connection token")
+
+// ConnectionTokenProtocol prefixes a connection token sent as a
+// Sec-WebSocket-Protocol value, e.g. "chronos-token.<token>"
+const ConnectionTokenProtocol = "chronos-token."
+
+// ConnectionTokens issues short-lived, single-use tokens that let browsers
+// open a WebSocket as an already authenticated principal. Tokens are kept in
+// memory, so they must be redeemed at the gateway instance that issued them.
+type ConnectionTokens struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	tokens    map[[32]byte]connectionToken // Keyed by the token's digest
+	lastSweep time.Time
+}
+
+type connectionToken struct {
+	principal *Principal
+	expires   time.Time
+}
+
+func NewConnectionTokens(ttl time.Duration) *ConnectionTokens {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &ConnectionTokens{ttl: ttl, tokens: make(map[[32]byte]connectionToken)}
+}
+
+// Issue creates a token for the principal. It expires after the configured
+// TTL, or with the principal's credential if that is sooner.
+func (t *ConnectionTokens) Issue(principal *Principal) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	expires := now.Add(t.ttl)
+	if !principal.ExpiresAt.IsZero() && principal.ExpiresAt.Before(expires) {
+		expires = principal.ExpiresAt
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	t.tokens[sha256.Sum256([]byte(token))] = connectionToken{principal: principal, expires: expires}
+	return token, expires, nil
+}
+
+// Redeem returns the principal a token was issued for and invalidates it
+func (t *ConnectionTokens) Redeem(token string) (*Principal, error) {
+	digest := sha256.Sum256([]byte(token))
+
+	t.mu.Lock()
+	entry, ok := t.tokens[digest]
+	delete(t.tokens, digest)
+	t.mu.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		return nil, ErrInvalidConnectionToken
+	}
+	return entry.principal, nil
+}
+
+// sweep drops expired tokens, at most once a TTL
+func (t *ConnectionTokens) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.ttl {
+		return
+	}
+	t.lastSweep = now
+	for digest, entry := range t.tokens {
+		if now.After(entry.expires) {
+			delete(t.tokens, digest)
+		}
+	}
+}
+
+// ConnectionToken finds a connection token in the ws_token query parameter
+// or among the offered WebSocket subprotocols
+func ConnectionToken(query string, protocols []string) string {
+	if query != "" {
+		return query
+	}
+	for _, protocol := range protocols {
+		if token, ok := strings.CutPrefix(protocol, ConnectionTokenProtocol); ok && token != "" {
+			return token
+		}
+	}
+	return ""
+}
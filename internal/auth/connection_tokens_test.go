@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnectionTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		redeem    func(tokens *ConnectionTokens, token string) string // Token to redeem last
+		err       error
+	}{
+		{
+			name:      "redeemed once",
+			principal: &Principal{Name: "browser"},
+			redeem:    func(tokens *ConnectionTokens, token string) string { return token },
+		},
+		{
+			name:      "redeemed twice",
+			principal: &Principal{Name: "browser"},
+			redeem: func(tokens *ConnectionTokens, token string) string {
+				tokens.Redeem(token)
+				return token
+			},
+			err: ErrInvalidConnectionToken,
+		},
+		{
+			name:      "unknown token",
+			principal: &Principal{Name: "browser"},
+			redeem:    func(tokens *ConnectionTokens, token string) string { return token + "x" },
+			err:       ErrInvalidConnectionToken,
+		},
+		{
+			name:      "expired",
+			principal: &Principal{Name: "browser"},
+			redeem: func(tokens *ConnectionTokens, token string) string {
+				for digest, entry := range tokens.tokens {
+					entry.expires = time.Now().Add(-time.Second)
+					tokens.tokens[digest] = entry
+				}
+				return token
+			},
+			err: ErrInvalidConnectionToken,
+		},
+		{
+			name:      "credential expired since issue",
+			principal: &Principal{Name: "browser", ExpiresAt: time.Now().Add(10 * time.Millisecond)},
+			redeem: func(tokens *ConnectionTokens, token string) string {
+				time.Sleep(20 * time.Millisecond)
+				return token
+			},
+			err: ErrInvalidConnectionToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := NewConnectionTokens(time.Minute)
+			token, expires, err := tokens.Issue(tt.principal)
+			if err != nil {
+				t.Fatalf("Issue() = %v", err)
+			}
+			if limit := time.Now().Add(time.Minute); expires.After(limit) || (!tt.principal.ExpiresAt.IsZero() && expires.After(tt.principal.ExpiresAt)) {
+				t.Fatalf("Issue() expires at %v, after the TTL or the credential", expires)
+			}
+
+			principal, err := tokens.Redeem(tt.redeem(tokens, token))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Redeem() = %v, want %v", err, tt.err)
+			}
+			if err == nil && principal != tt.principal {
+				t.Fatalf("Redeem() = %+v, want %+v", principal, tt.principal)
+			}
+		})
+	}
+}
+
+func TestConnectionTokensSweep(t *testing.T) {
+	tokens := NewConnectionTokens(time.Minute)
+	tokens.Issue(&Principal{Name: "browser"})
+	for digest, entry := range tokens.tokens {
+		entry.expires = time.Now().Add(-time.Second)
+		tokens.tokens[digest] = entry
+	}
+	tokens.lastSweep = time.Time{}
+
+	tokens.Issue(&Principal{Name: "browser"})
+	if len(tokens.tokens) != 1 {
+		t.Fatalf("%d tokens after sweep, want 1", len(tokens.tokens))
+	}
+}
+
+func TestConnectionToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		protocols []string
+		want      string
+	}{
+		{name: "query", query: "abc", protocols: []string{"chronos-token.def"}, want: "abc"},
+		{name: "subprotocol", protocols: []string{"json", "chronos-token.def"}, want: "def"},
+		{name: "empty subprotocol token", protocols: []string{"chronos-token."}},
+		{name: "none", protocols: []string{"json"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ConnectionToken(tt.query, tt.protocols); got != tt.want {
+				t.Fatalf("ConnectionToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
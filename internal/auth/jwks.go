@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwk is a single JSON Web Key (RFC 7517). Only the fields needed for
+// RSA, EC and symmetric verification keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// verificationKey is a parsed JWK
+type verificationKey struct {
+	id  string
+	alg string // Restricts the key to one algorithm if set
+	key interface{}
+}
+
+// KeySet holds JWKS verification keys loaded from a file or URL. Keys from a
+// URL are cached and refreshed in the background; an unknown key id triggers
+// an early refresh, at most once per minRefetch, so rotated keys are picked up.
+// Failed fetches count as well, and lookups that miss while a refresh is in
+// flight wait for it rather than starting their own.
+type KeySet struct {
+	file       string
+	url        string
+	refresh    time.Duration
+	minRefetch time.Duration
+	client     *http.Client
+
+	mu          sync.RWMutex
+	keys        []verificationKey
+	lastAttempt time.Time     // Of the last fetch, successful or not
+	fetching    chan struct{} // Closed when the refetch in flight is done
+}
+
+// NewKeySet loads the key set once and, for URLs, starts the refresh loop
+func NewKeySet(file, url string, refresh time.Duration) (*KeySet, error) {
+	if refresh <= 0 {
+		refresh = 10 * time.Minute
+	}
+	set := &KeySet{
+		file:       file,
+		url:        url,
+		refresh:    refresh,
+		minRefetch: 30 * time.Second,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := set.load(context.Background()); err != nil {
+		return nil, err
+	}
+	if url != "" {
+		go set.refreshLoop()
+	}
+	return set, nil
+}
+
+func (s *KeySet) load(ctx context.Context) error {
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	s.mu.Unlock()
+
+	var (
+		data []byte
+		err  error
+	)
+	if s.url != "" {
+		data, err = s.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(s.file)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading JWKS: %w", err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *KeySet) fetch(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+func (s *KeySet) refreshLoop() {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.load(context.Background()); err != nil {
+			// Keep verifying with the cached keys
+			log.Printf("[AUTH] JWKS refresh failed: %v", err)
+		}
+	}
+}
+
+// lookup finds the key for a token's kid and alg. Tokens without a kid match
+// the only key usable for their algorithm.
+func (s *KeySet) lookup(kid, alg string) (interface{}, error) {
+	if key, ok := s.find(kid, alg); ok {
+		return key, nil
+	}
+
+	// The issuer may have rotated keys since the last fetch
+	if s.url != "" && s.refetch() {
+		if key, ok := s.find(kid, alg); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no verification key for kid %q and alg %s", kid, alg)
+}
+
+// refetch loads the keys again unless that was tried within minRefetch. If a
+// refetch is already in flight it waits for that one instead. It reports
+// whether the keys may have changed.
+func (s *KeySet) refetch() bool {
+	s.mu.Lock()
+	if done := s.fetching; done != nil {
+		s.mu.Unlock()
+		<-done
+		return true
+	}
+	if time.Since(s.lastAttempt) < s.minRefetch {
+		s.mu.Unlock()
+		return false
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.mu.Unlock()
+
+	err := s.load(context.Background())
+	if err != nil {
+		log.Printf("[AUTH] JWKS refresh failed: %v", err)
+	}
+
+	s.mu.Lock()
+	s.fetching = nil
+	s.mu.Unlock()
+	close(done)
+	return err == nil
+}
+
+func (s *KeySet) find(kid, alg string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match interface{}
+	matches := 0
+	for _, key := range s.keys {
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if !keyFitsAlgorithm(key.key, alg) {
+			continue
+		}
+		if kid != "" {
+			if key.id == kid {
+				return key.key, true
+			}
+			continue
+		}
+		match = key.key
+		matches++
+	}
+	return match, matches == 1
+}
+
+func keyFitsAlgorithm(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" || alg == "RS384" || alg == "RS512"
+	case *ecdsa.PublicKey:
+		return alg == "ES256" || alg == "ES384" || alg == "ES512"
+	case []byte:
+		return alg == "HS256" || alg == "HS384" || alg == "HS512"
+	}
+	return false
+}
+
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var document struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+
+	var keys []verificationKey
+	for _, key := range document.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		parsed, err := parseJWK(key)
+		if err != nil {
+			// One bad key shouldn't take down the others
+			log.Printf("[AUTH] Skipping JWKS key %q: %v", key.Kid, err)
+			continue
+		}
+		keys = append(keys, verificationKey{id: key.Kid, alg: key.Alg, key: parsed})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func parseJWK(key jwk) (interface{}, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(key.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid symmetric key")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
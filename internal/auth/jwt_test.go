@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	rsaKey, _      = rsa.GenerateKey(rand.Reader, 2048)
+	otherRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _       = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func encodeInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encodeInt(key.N), E: encodeInt(big.NewInt(int64(key.E)))}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jwk {
+	return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: encodeInt(key.X), Y: encodeInt(key.Y)}
+}
+
+func writeJWKS(t *testing.T, keys ...jwk) string {
+	t.Helper()
+	data, _ := json.Marshal(map[string][]jwk{"keys": keys})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims(extra jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub": "user-1",
+		"iss": "https://issuer.example",
+		"aud": "chronos",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestJWTVerifier(t *testing.T) {
+	verifier, err := NewJWTVerifier(JWTConfig{
+		Algorithms:  []string{"RS256", "ES256", "HS256"},
+		HMACSecret:  "shared-secret",
+		JWKSFile:    writeJWKS(t, rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey)),
+		Issuer:      "https://issuer.example",
+		Audience:    []string{"chronos"},
+		UserClaim:   "sub",
+		DeviceClaim: "device_id",
+	})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() = %v", err)
+	}
+	publicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "rs256", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(nil))},
+		{name: "es256 without kid", token: signToken(t, jwt.SigningMethodES256, "", ecKey, validClaims(nil))},
+		{name: "hs256 with the shared secret", token: signToken(t, jwt.SigningMethodHS256, "", []byte("shared-secret"), validClaims(nil))},
+		{name: "signed with another rsa key", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", otherRSAKey, validClaims(nil)), wantErr: true},
+		{name: "unknown kid", token: signToken(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, validClaims(nil)), wantErr: true},
+		{name: "kid of a key for another algorithm", token: signToken(t, jwt.SigningMethodES256, "rsa-1", ecKey, validClaims(nil)), wantErr: true},
+		{name: "hs256 with the wrong secret", token: signToken(t, jwt.SigningMethodHS256, "", []byte("guessed"), validClaims(nil)), wantErr: true},
+		{name: "hs256 keyed with the rsa public key", token: signToken(t, jwt.SigningMethodHS256, "rsa-1", publicDER, validClaims(nil)), wantErr: true},
+		{name: "algorithm not accepted", token: signToken(t, jwt.SigningMethodRS512, "rsa-1", rsaKey, validClaims(nil)), wantErr: true},
+		{name: "unsigned", token: signToken(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, validClaims(nil)), wantErr: true},
+		{name: "expired", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), wantErr: true},
+		{name: "no expiry", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"exp": nil})), wantErr: true},
+		{name: "wrong issuer", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"iss": "https://evil.example"})), wantErr: true},
+		{name: "wrong audience", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"aud": "other"})), wantErr: true},
+		{name: "no subject", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims(jwt.MapClaims{"sub": nil})), wantErr: true},
+		{name: "malformed", token: "not.a.token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := verifier.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (principal.Subject != "user-1" || principal.Method != MethodJWT) {
+				t.Fatalf("Verify() = %+v", principal)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	verifier, err := NewJWTVerifier(JWTConfig{Algorithms: []string{"HS256"}, HMACSecret: "shared-secret", UserClaim: "uid", DeviceClaim: "device_id"})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() = %v", err)
+	}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := signToken(t, jwt.SigningMethodHS256, "", []byte("shared-secret"), jwt.MapClaims{
+		"sub": "subject-1", "uid": "user-1", "device_id": "device-1", "tenant": "acme", "azp": "desktop-agent", "exp": expiry.Unix(),
+	})
+
+	principal, err := verifier.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	want := Principal{Subject: "subject-1", Name: "desktop-agent", Tenant: "acme", UserID: "user-1", DeviceID: "device-1", Method: MethodJWT}
+	if principal.Subject != want.Subject || principal.Name != want.Name || principal.Tenant != want.Tenant ||
+		principal.UserID != want.UserID || principal.DeviceID != want.DeviceID || !principal.ExpiresAt.Equal(expiry) {
+		t.Fatalf("Verify() = %+v, want %+v", principal, want)
+	}
+}
+
+func TestNewJWTVerifierConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  JWTConfig
+		wantErr bool
+	}{
+		{name: "secret", config: JWTConfig{Algorithms: []string{"HS256"}, HMACSecret: "s"}},
+		{name: "no keys", config: JWTConfig{Algorithms: []string{"RS256"}}, wantErr: true},
+		{name: "unsupported algorithm", config: JWTConfig{Algorithms: []string{"none"}, HMACSecret: "s"}, wantErr: true},
+		{name: "missing jwks file", config: JWTConfig{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}, wantErr: true},
+		{name: "jwks without usable keys", config: JWTConfig{JWKSFile: writeJWKS(t, jwk{Kty: "RSA", Kid: "bad", N: "!", E: "AQAB"}, jwk{Kty: "RSA", Kid: "enc", Use: "enc"})}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewJWTVerifier(tt.config); (err != nil) != tt.wantErr {
+				t.Fatalf("NewJWTVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeySetRefetchesRotatedKeys(t *testing.T) {
+	var current atomic.Value
+	current.Store([]jwk{rsaJWK("rsa-1", &rsaKey.PublicKey)})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": current.Load().([]jwk)})
+	}))
+	defer server.Close()
+
+	verifier, err := NewJWTVerifier(JWTConfig{Algorithms: []string{"RS256"}, JWKSURL: server.URL, JWKSRefresh: time.Hour})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() = %v", err)
+	}
+	rotated := signToken(t, jwt.SigningMethodRS256, "rsa-2", otherRSAKey, validClaims(nil))
+
+	// Within minRefetch an unknown kid doesn't hit the endpoint again
+	current.Store([]jwk{rsaJWK("rsa-1", &rsaKey.PublicKey), rsaJWK("rsa-2", &otherRSAKey.PublicKey)})
+	if _, err := verifier.Verify(rotated); err == nil || fetches.Load() != 1 {
+		t.Fatalf("Verify() = %v after %d fetches, want an error after 1", err, fetches.Load())
+	}
+
+	verifier.keys.minRefetch = 0
+	if _, err := verifier.Verify(rotated); err != nil || fetches.Load() != 2 {
+		t.Fatalf("Verify() = %v after %d fetches, want success after 2", err, fetches.Load())
+	}
+}
+
+func TestKeySetRefetchOnce(t *testing.T) {
+	var (
+		fetches atomic.Int32
+		failing atomic.Bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			// Slow enough for every lookup to arrive while this is in flight
+			time.Sleep(100 * time.Millisecond)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {rsaJWK("rsa-1", &rsaKey.PublicKey)}})
+	}))
+	defer server.Close()
+
+	keys, err := NewKeySet("", server.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKeySet() = %v", err)
+	}
+	failing.Store(true)
+	keys.mu.Lock()
+	keys.lastAttempt = time.Time{}
+	keys.mu.Unlock()
+
+	// Concurrent misses share one fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys.lookup("rsa-2", "RS256")
+		}()
+	}
+	wg.Wait()
+	if fetches.Load() != 2 {
+		t.Fatalf("%d fetches, want 2", fetches.Load())
+	}
+
+	// The failed fetch counts against minRefetch
+	if _, err := keys.lookup("rsa-2", "RS256"); err == nil || fetches.Load() != 2 {
+		t.Fatalf("lookup() = %v after %d fetches, want an error after 2", err, fetches.Load())
+	}
+}
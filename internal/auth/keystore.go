@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new hashes (OWASP minimum recommendation)
+const (
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+)
+
+// KeyStore holds API keys from a keys file, where only salted hashes are
+// stored:
+//
+//	{
+//	  "keys": [
+//	    {"id": "3f9a1c2e", "name": "desktop-agent", "tenant": "acme",
+//	     "scopes": ["upload", "upload-sessions"],
+//	     "hash": "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>",
+//	     "not_before": "2026-01-01T00:00:00Z", "expires_at": "2026-07-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// Clients present "<id>.<secret>", so a lookup verifies one hash. Hashes may
+// be argon2id or "sha256$<salt>$<hash>". The file is watched and reloaded on
+// change, so adding, revoking and rotating keys needs no restart. Several
+// entries may share a name with overlapping validity windows for rotation.
+type KeyStore struct {
+	path string
+
+	mu       sync.RWMutex
+	keys     map[string]storedKey
+	verified map[[32]byte]bool // Digests of presented keys already checked, saves re-hashing
+}
+
+type storedKey struct {
+	hash string
+	key  APIKey
+}
+
+type keysFile struct {
+	Keys []struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		Tenant    string    `json:"tenant"`
+		Scopes    []string  `json:"scopes"`
+		Hash      string    `json:"hash"`
+		Enabled   *bool     `json:"enabled"` // Defaults to true
+		NotBefore time.Time `json:"not_before"`
+		ExpiresAt time.Time `json:"expires_at"`
+		UserID    string    `json:"user_id"`
+		DeviceID  string    `json:"device_id"`
+	} `json:"keys"`
+}
+
+// LoadKeyStore reads the keys file and starts watching it for changes
+func LoadKeyStore(path string) (*KeyStore, error) {
+	store := &KeyStore{path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if err := watchFile(path, "keys file", store.load); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *KeyStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	var file keysFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing keys file: %w", err)
+	}
+
+	keys := make(map[string]storedKey, len(file.Keys))
+	for _, entry := range file.Keys {
+		if entry.ID == "" || strings.Contains(entry.ID, ".") {
+			return fmt.Errorf("key %q: id must be set and must not contain dots", entry.Name)
+		}
+		if _, exists := keys[entry.ID]; exists {
+			return fmt.Errorf("duplicate key id %q", entry.ID)
+		}
+		if !validHash(entry.Hash) {
+			return fmt.Errorf("key %q: unsupported hash format", entry.ID)
+		}
+		name := entry.Name
+		if name == "" {
+			name = "key-" + entry.ID
+		}
+		keys[entry.ID] = storedKey{
+			hash: entry.Hash,
+			key: APIKey{
+				Name:      name,
+				Tenant:    entry.Tenant,
+				Scopes:    entry.Scopes,
+				Enabled:   entry.Enabled == nil || *entry.Enabled,
+				NotBefore: entry.NotBefore,
+				ExpiresAt: entry.ExpiresAt,
+				UserID:    entry.UserID,
+				DeviceID:  entry.DeviceID,
+			},
+		}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.verified = make(map[[32]byte]bool)
+	s.mu.Unlock()
+	log.Printf("[AUTH] Loaded %d API keys from %s", len(keys), s.path)
+	return nil
+}
+
+func (s *KeyStore) Lookup(presented string) (*APIKey, bool) {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok || secret == "" {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(presented))
+
+	s.mu.RLock()
+	stored, exists := s.keys[id]
+	cached := s.verified[digest]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+
+	if !cached {
+		if !verifyHash(stored.hash, secret) {
+			return nil, false
+		}
+		s.mu.Lock()
+		if len(s.verified) > 10000 {
+			s.verified = make(map[[32]byte]bool)
+		}
+		s.verified[digest] = true
+		s.mu.Unlock()
+	}
+
+	key := stored.key
+	return &key, true
+}
+
+// GenerateKey creates a new key and the hash to store for it
+func GenerateKey() (key, id, hash string, err error) {
+	idBytes := make([]byte, 4)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", "", err
+	}
+	id = hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash, err = HashSecret(secret)
+	if err != nil {
+		return "", "", "", err
+	}
+	return id + "." + secret, id, hash, nil
+}
+
+// HashSecret hashes the secret part of a key with argon2id
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum)), nil
+}
+
+func validHash(encoded string) bool {
+	_, _, _, err := parseHash(encoded)
+	return err == nil
+}
+
+// verifyHash checks a secret against an argon2id or salted SHA-256 hash
+func verifyHash(encoded, secret string) bool {
+	scheme, salt, expected, err := parseHash(encoded)
+	if err != nil {
+		return false
+	}
+
+	var sum []byte
+	switch scheme {
+	case "sha256":
+		digest := sha256.Sum256(append(salt, secret...))
+		sum = digest[:]
+	default:
+		var memory, iterations uint32
+		var threads uint8
+		fmt.Sscanf(scheme, "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+		sum = argon2.IDKey([]byte(secret), salt, iterations, memory, threads, uint32(len(expected)))
+	}
+	return subtle.ConstantTimeCompare(sum, expected) == 1
+}
+
+// parseHash splits a stored hash into its scheme (or argon2 parameters),
+// salt and digest
+func parseHash(encoded string) (string, []byte, []byte, error) {
+	if rest, ok := strings.CutPrefix(encoded, "sha256$"); ok {
+		parts := strings.Split(rest, "$")
+		if len(parts) != 2 {
+			return "", nil, nil, errors.New("malformed sha256 hash")
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+		if err != nil {
+			return "", nil, nil, err
+		}
+		sum, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil || len(sum) != sha256.Size {
+			return "", nil, nil, errors.New("malformed sha256 hash")
+		}
+		return "sha256", salt, sum, nil
+	}
+
+	// $argon2id$v=19$m=...,t=...,p=...$salt$hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return "", nil, nil, errors.New("unsupported hash")
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if n, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); n != 3 || err != nil || memory == 0 || iterations == 0 || threads == 0 {
+		return "", nil, nil, errors.New("malformed argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(sum) == 0 {
+		return "", nil, nil, errors.New("malformed argon2id hash")
+	}
+	return parts[3], salt, sum, nil
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hash(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return "sha256$" + base64.RawStdEncoding.EncodeToString([]byte(salt)) + "$" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifyHash(t *testing.T) {
+	argon, err := HashSecret("correct-secret")
+	if err != nil {
+		t.Fatalf("HashSecret() = %v", err)
+	}
+	parts := strings.Split(argon, "$")
+
+	tests := []struct {
+		name   string
+		hash   string
+		secret string
+		want   bool
+	}{
+		{name: "argon2id", hash: argon, secret: "correct-secret", want: true},
+		{name: "argon2id wrong secret", hash: argon, secret: "wrong-secret"},
+		{name: "argon2id empty secret", hash: argon, secret: ""},
+		{name: "argon2id other parameters", hash: strings.Replace(argon, "t=2", "t=3", 1), secret: "correct-secret"},
+		{name: "argon2id other salt", hash: strings.Replace(argon, parts[4], base64.RawStdEncoding.EncodeToString([]byte("another-salt-16b")), 1), secret: "correct-secret"},
+		{name: "argon2 other variant", hash: strings.Replace(argon, "argon2id", "argon2i", 1), secret: "correct-secret"},
+		{name: "sha256", hash: sha256Hash("salt", "correct-secret"), secret: "correct-secret", want: true},
+		{name: "sha256 wrong secret", hash: sha256Hash("salt", "correct-secret"), secret: "wrong-secret"},
+		{name: "sha256 truncated digest", hash: sha256Hash("salt", "correct-secret")[:40], secret: "correct-secret"},
+		{name: "plaintext", hash: "correct-secret", secret: "correct-secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyHash(tt.hash, tt.secret); got != tt.want {
+				t.Fatalf("verifyHash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeKeysFile(t *testing.T, path string, keys ...map[string]interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyStoreLookup(t *testing.T) {
+	key, id, hash, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeysFile(t, path,
+		map[string]interface{}{"id": id, "name": "desktop-agent", "tenant": "acme", "scopes": []string{"upload"}, "hash": hash, "user_id": "user-1"},
+		map[string]interface{}{"id": "legacy", "hash": sha256Hash("salt", "legacy-secret"), "enabled": false},
+	)
+	store, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatalf("LoadKeyStore() = %v", err)
+	}
+	_, secret, _ := strings.Cut(key, ".")
+
+	tests := []struct {
+		name      string
+		presented string
+		want      string // Key name, "" if the lookup fails
+		enabled   bool
+	}{
+		{name: "generated key", presented: key, want: "desktop-agent", enabled: true},
+		{name: "cached on second use", presented: key, want: "desktop-agent", enabled: true},
+		{name: "disabled key is found", presented: "legacy.legacy-secret", want: "key-legacy"},
+		{name: "wrong secret", presented: id + ".wrong"},
+		{name: "secret under another id", presented: "legacy." + secret},
+		{name: "unknown id", presented: "ffffffff." + secret},
+		{name: "no separator", presented: id + secret},
+		{name: "empty secret", presented: id + "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, ok := store.Lookup(tt.presented)
+			if ok != (tt.want != "") {
+				t.Fatalf("Lookup() ok = %v, want %v", ok, tt.want != "")
+			}
+			if ok && (found.Name != tt.want || found.Enabled != tt.enabled) {
+				t.Fatalf("Lookup() = %+v, want %s enabled=%v", found, tt.want, tt.enabled)
+			}
+		})
+	}
+	if found, _ := store.Lookup(key); found.Tenant != "acme" || found.UserID != "user-1" || found.Scopes[0] != "upload" {
+		t.Fatalf("Lookup() = %+v", found)
+	}
+
+	// A reload drops revoked keys and the verification cache with them
+	writeKeysFile(t, path, map[string]interface{}{"id": "legacy", "hash": sha256Hash("salt", "legacy-secret")})
+	if err := store.load(); err != nil {
+		t.Fatalf("load() = %v", err)
+	}
+	if _, ok := store.Lookup(key); ok {
+		t.Fatal("Lookup() found a revoked key")
+	}
+}
+
+func TestKeyStoreLoadErrors(t *testing.T) {
+	hash := sha256Hash("salt", "secret")
+
+	tests := []struct {
+		name string
+		keys []map[string]interface{}
+		want string
+	}{
+		{name: "missing id", keys: []map[string]interface{}{{"name": "agent", "hash": hash}}, want: "id must be set"},
+		{name: "dotted id", keys: []map[string]interface{}{{"id": "a.b", "hash": hash}}, want: "must not contain dots"},
+		{name: "duplicate id", keys: []map[string]interface{}{{"id": "a", "hash": hash}, {"id": "a", "hash": hash}}, want: "duplicate key id"},
+		{name: "plaintext secret", keys: []map[string]interface{}{{"id": "a", "hash": "secret"}}, want: "unsupported hash format"},
+		{name: "zero argon2 cost", keys: []map[string]interface{}{{"id": "a", "hash": "$argon2id$v=19$m=0,t=2,p=1$c2FsdA$aGFzaA"}}, want: "unsupported hash format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			writeKeysFile(t, path, tt.keys...)
+			if _, err := LoadKeyStore(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("LoadKeyStore() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrKeyNotFound is returned for unknown managed key IDs
+var ErrKeyNotFound = errors.New("API key not found")
+
+var managedKeysBucket = []byte("keys")
+
+// ManagedKey is an API key created through the admin API. Like keys from the
+// keys file, clients present "<id>.<secret>" and only the hash is stored.
+type ManagedKey struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	DeviceID    string    `json:"device_id,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	NotBefore   time.Time `json:"not_before"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	RotatedFrom string    `json:"rotated_from,omitempty"` // ID of the key this one replaced
+	Hash        string    `json:"hash,omitempty"`
+}
+
+// ManagedKeys stores API keys in a bbolt database. All keys are cached in
+// memory, so lookups never touch the disk. Lookups only share the cache lock;
+// they note last-used times apart from the keys, and those are written back
+// once a minute.
+type ManagedKeys struct {
+	db *bolt.DB
+
+	mu       sync.RWMutex
+	keys     map[string]*ManagedKey
+	verified map[[32]byte]bool // Digests of presented keys already checked, saves re-hashing
+	done     chan struct{}
+
+	usedMu sync.Mutex
+	used   map[string]time.Time // Last-used times not persisted yet
+}
+
+// OpenManagedKeys opens or creates the key database at path
+func OpenManagedKeys(path string) (*ManagedKeys, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening key database: %w", err)
+	}
+
+	store := &ManagedKeys{
+		db:       db,
+		keys:     make(map[string]*ManagedKey),
+		verified: make(map[[32]byte]bool),
+		used:     make(map[string]time.Time),
+		done:     make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(managedKeysBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(id, data []byte) error {
+			var key ManagedKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return fmt.Errorf("key %s: %w", id, err)
+			}
+			store.keys[key.ID] = &key
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error loading key database: %w", err)
+	}
+
+	go store.flushLoop()
+	log.Printf("[AUTH] Loaded %d managed API keys from %s", len(store.keys), path)
+	return store, nil
+}
+
+func (s *ManagedKeys) Lookup(presented string) (*APIKey, bool) {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok || secret == "" {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(presented))
+
+	s.mu.RLock()
+	stored, exists := s.keys[id]
+	var hash string
+	if exists {
+		hash = stored.Hash
+	}
+	cached := s.verified[digest]
+	s.mu.RUnlock()
+	if !exists || (!cached && !verifyHash(hash, secret)) {
+		return nil, false
+	}
+
+	// Only a newly verified key changes the cache
+	if cached {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	} else {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	// The key may have been deleted while the lock was released
+	stored, exists = s.keys[id]
+	if !exists {
+		return nil, false
+	}
+	if !cached {
+		if len(s.verified) > 10000 {
+			s.verified = make(map[[32]byte]bool)
+		}
+		s.verified[digest] = true
+	}
+	s.usedMu.Lock()
+	s.used[id] = time.Now().UTC()
+	s.usedMu.Unlock()
+
+	return &APIKey{
+		Name:      stored.Name,
+		Tenant:    stored.Tenant,
+		Scopes:    stored.Scopes,
+		Enabled:   stored.Enabled,
+		NotBefore: stored.NotBefore,
+		ExpiresAt: stored.ExpiresAt,
+		UserID:    stored.UserID,
+		DeviceID:  stored.DeviceID,
+	}, true
+}
+
+// List returns all keys ordered by creation time, without their hashes
+func (s *ManagedKeys) List() []ManagedKey {
+	s.mu.RLock()
+	keys := make([]ManagedKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, s.redacted(key))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Get returns a key without its hash
+func (s *ManagedKeys) Get(id string) (ManagedKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ManagedKey{}, ErrKeyNotFound
+	}
+	return s.redacted(key), nil
+}
+
+// Create stores a new key with the given metadata and returns it along with
+// the key to hand to the client, which is not stored anywhere
+func (s *ManagedKeys) Create(key ManagedKey) (ManagedKey, string, error) {
+	if key.Name == "" {
+		return ManagedKey{}, "", errors.New("name is required")
+	}
+	presented, id, hash, err := GenerateKey()
+	if err != nil {
+		return ManagedKey{}, "", err
+	}
+	key.ID, key.Hash = id, hash
+	key.CreatedAt = time.Now().UTC()
+	key.LastUsedAt = time.Time{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.keys[id]; exists {
+		return ManagedKey{}, "", errors.New("key ID collision, try again")
+	}
+	if err := s.put(&key); err != nil {
+		return ManagedKey{}, "", err
+	}
+	s.keys[id] = &key
+	return s.redacted(&key), presented, nil
+}
+
+// SetEnabled enables or disables a key
+func (s *ManagedKeys) SetEnabled(id string, enabled bool) (ManagedKey, error) {
+	return s.update(id, func(key *ManagedKey) {
+		key.Enabled = enabled
+	})
+}
+
+// Rotate creates a replacement key with the same metadata, expiring at
+// expiresAt (zero for never). The old key stays valid for grace, so clients
+// can switch over without downtime.
+func (s *ManagedKeys) Rotate(id string, grace time.Duration, expiresAt time.Time) (ManagedKey, string, error) {
+	old, err := s.Get(id)
+	if err != nil {
+		return ManagedKey{}, "", err
+	}
+
+	replacement := old
+	replacement.RotatedFrom = id
+	replacement.NotBefore = time.Time{}
+	replacement.ExpiresAt = expiresAt
+	created, presented, err := s.Create(replacement)
+	if err != nil {
+		return ManagedKey{}, "", err
+	}
+
+	expires := time.Now().UTC().Add(grace)
+	if _, err := s.update(id, func(key *ManagedKey) {
+		if key.ExpiresAt.IsZero() || expires.Before(key.ExpiresAt) {
+			key.ExpiresAt = expires
+		}
+	}); err != nil {
+		return ManagedKey{}, "", err
+	}
+	return created, presented, nil
+}
+
+// Delete removes a key, revoking it immediately
+func (s *ManagedKeys) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(managedKeysBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+	delete(s.keys, id)
+	s.usedMu.Lock()
+	delete(s.used, id)
+	s.usedMu.Unlock()
+	return nil
+}
+
+// Close writes pending last-used times and closes the database
+func (s *ManagedKeys) Close() error {
+	close(s.done)
+	s.flush()
+	return s.db.Close()
+}
+
+// update changes a key in the database and the cache
+func (s *ManagedKeys) update(id string, change func(*ManagedKey)) (ManagedKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.keys[id]
+	if !ok {
+		return ManagedKey{}, ErrKeyNotFound
+	}
+	key := *stored
+	change(&key)
+	if err := s.put(&key); err != nil {
+		return ManagedKey{}, err
+	}
+	s.keys[id] = &key
+	return s.redacted(&key), nil
+}
+
+// put writes a key to the database; the caller holds the lock
+func (s *ManagedKeys) put(key *ManagedKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(managedKeysBucket).Put([]byte(key.ID), data)
+	})
+}
+
+func (s *ManagedKeys) flushLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush persists the last-used times of keys used since the last flush
+func (s *ManagedKeys) flush() {
+	s.usedMu.Lock()
+	used := s.used
+	s.used = make(map[string]time.Time)
+	s.usedMu.Unlock()
+	if len(used) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated := make(map[string]*ManagedKey, len(used))
+	for id, lastUsed := range used {
+		// Skip keys deleted since they were used
+		stored, ok := s.keys[id]
+		if !ok {
+			continue
+		}
+		key := *stored
+		key.LastUsedAt = lastUsed
+		updated[id] = &key
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(managedKeysBucket)
+		for id, key := range updated {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[AUTH] Error saving key last-used times: %v", err)
+		// Try again on the next flush, unless the keys were used since
+		s.usedMu.Lock()
+		for id, lastUsed := range used {
+			if _, ok := s.used[id]; !ok {
+				s.used[id] = lastUsed
+			}
+		}
+		s.usedMu.Unlock()
+		return
+	}
+	for id, key := range updated {
+		s.keys[id] = key
+	}
+}
+
+// redacted copies a key without its hash, with its last use included even if
+// that isn't persisted yet
+func (s *ManagedKeys) redacted(key *ManagedKey) ManagedKey {
+	copied := *key
+	copied.Hash = ""
+	s.usedMu.Lock()
+	if lastUsed, ok := s.used[key.ID]; ok {
+		copied.LastUsedAt = lastUsed
+	}
+	s.usedMu.Unlock()
+	return copied
+}
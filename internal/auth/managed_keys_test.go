@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestKeys(t *testing.T, path string) *ManagedKeys {
+	t.Helper()
+	keys, err := OpenManagedKeys(path)
+	if err != nil {
+		t.Fatalf("OpenManagedKeys() = %v", err)
+	}
+	return keys
+}
+
+func TestManagedKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(keys *ManagedKeys, id string) error
+		lookup  func(presented string) string // Key presented after the change
+		found   bool
+		enabled bool
+	}{
+		{name: "created", found: true, enabled: true},
+		{name: "wrong secret", lookup: func(presented string) string { return presented + "x" }},
+		{name: "secret under another id", lookup: func(presented string) string {
+			_, secret, _ := strings.Cut(presented, ".")
+			return "00000000." + secret
+		}},
+		{name: "disabled", change: func(keys *ManagedKeys, id string) error {
+			_, err := keys.SetEnabled(id, false)
+			return err
+		}, found: true},
+		{name: "deleted", change: func(keys *ManagedKeys, id string) error { return keys.Delete(id) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := openTestKeys(t, filepath.Join(t.TempDir(), "keys.db"))
+			defer keys.Close()
+			created, presented, err := keys.Create(ManagedKey{Name: "desktop-agent", Tenant: "acme", Scopes: []string{"upload"}, UserID: "user-1", Enabled: true})
+			if err != nil {
+				t.Fatalf("Create() = %v", err)
+			}
+			if created.Hash != "" || !strings.HasPrefix(presented, created.ID+".") {
+				t.Fatalf("Create() = %+v, %q", created, presented)
+			}
+			// The first lookup caches the verified key
+			keys.Lookup(presented)
+
+			if tt.change != nil {
+				if err := tt.change(keys, created.ID); err != nil {
+					t.Fatalf("change = %v", err)
+				}
+			}
+			if tt.lookup != nil {
+				presented = tt.lookup(presented)
+			}
+			key, ok := keys.Lookup(presented)
+			if ok != tt.found {
+				t.Fatalf("Lookup() ok = %v, want %v", ok, tt.found)
+			}
+			if ok && (key.Enabled != tt.enabled || key.Name != "desktop-agent" || key.Tenant != "acme" || key.UserID != "user-1") {
+				t.Fatalf("Lookup() = %+v", key)
+			}
+		})
+	}
+}
+
+func TestManagedKeysRotate(t *testing.T) {
+	keys := openTestKeys(t, filepath.Join(t.TempDir(), "keys.db"))
+	defer keys.Close()
+	old, oldPresented, _ := keys.Create(ManagedKey{Name: "desktop-agent", Scopes: []string{"upload"}, Enabled: true})
+
+	expiresAt := time.Now().Add(24 * time.Hour).UTC()
+	replacement, presented, err := keys.Rotate(old.ID, time.Hour, expiresAt)
+	if err != nil {
+		t.Fatalf("Rotate() = %v", err)
+	}
+	if replacement.ID == old.ID || replacement.RotatedFrom != old.ID || replacement.Name != old.Name || !replacement.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Rotate() = %+v", replacement)
+	}
+
+	tests := []struct {
+		name      string
+		presented string
+		expiresBy time.Time
+	}{
+		{name: "replacement", presented: presented, expiresBy: expiresAt},
+		{name: "old key within the grace period", presented: oldPresented, expiresBy: time.Now().Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := keys.Lookup(tt.presented)
+			if !ok || key.ExpiresAt.IsZero() || key.ExpiresAt.After(tt.expiresBy) {
+				t.Fatalf("Lookup() = %+v, %v, want a key expiring by %v", key, ok, tt.expiresBy)
+			}
+		})
+	}
+
+	if _, _, err := keys.Rotate("missing", time.Hour, time.Time{}); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Rotate() of a missing key = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestManagedKeysPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+	keys := openTestKeys(t, path)
+	kept, presented, _ := keys.Create(ManagedKey{Name: "kept", Enabled: true})
+	deleted, _, _ := keys.Create(ManagedKey{Name: "deleted", Enabled: true})
+	keys.Lookup(presented)
+	keys.Delete(deleted.ID)
+	if _, _, err := keys.Create(ManagedKey{}); err == nil {
+		t.Fatal("Create() without a name succeeded")
+	}
+	keys.Close()
+
+	keys = openTestKeys(t, path)
+	defer keys.Close()
+	list := keys.List()
+	if len(list) != 1 || list[0].ID != kept.ID || list[0].Hash != "" || list[0].LastUsedAt.IsZero() {
+		t.Fatalf("List() after reopening = %+v", list)
+	}
+	if _, ok := keys.Lookup(presented); !ok {
+		t.Fatal("Lookup() after reopening failed")
+	}
+	if _, err := keys.Get(deleted.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get() of a deleted key = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestManagedKeysLastUsed(t *testing.T) {
+	keys := openTestKeys(t, filepath.Join(t.TempDir(), "keys.db"))
+	defer keys.Close()
+	created, presented, _ := keys.Create(ManagedKey{Name: "desktop-agent", Enabled: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, ok := keys.Lookup(presented); !ok {
+					t.Error("Lookup() failed")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Reported before it is written back, and kept once it is
+	if key, _ := keys.Get(created.ID); key.LastUsedAt.IsZero() {
+		t.Fatal("Get() before flushing has no last-used time")
+	}
+	keys.flush()
+	if key, _ := keys.Get(created.ID); key.LastUsedAt.IsZero() || len(keys.used) != 0 {
+		t.Fatalf("Get() after flushing = %+v with %d pending", key, len(keys.used))
+	}
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request signing errors
+var (
+	ErrMissingSignature = errors.New("request signature required")
+	ErrUnknownDevice    = errors.New("no signing secret for device")
+	ErrStaleTimestamp   = errors.New("signature timestamp outside the allowed window")
+	ErrReplayedNonce    = errors.New("signature nonce already used")
+	ErrBadSignature     = errors.New("invalid request signature")
+)
+
+// SignedRequest holds the parts of a request covered by its signature
+type SignedRequest struct {
+	Method     string
+	Path       string // Path and query as sent, e.g. "/v1/location?x=1"
+	DeviceID   string
+	Timestamp  string // Unix seconds
+	Nonce      string
+	BodySHA256 string // Hex SHA-256 of the request body
+	Signature  string // Base64 HMAC-SHA256 of the canonical string
+}
+
+// Canonical is the string signed by the client:
+//
+//	METHOD\nPATH\nDEVICE_ID\nTIMESTAMP\nNONCE\nBODY_SHA256
+func (r SignedRequest) Canonical() string {
+	return strings.Join([]string{strings.ToUpper(r.Method), r.Path, r.DeviceID, r.Timestamp, r.Nonce, r.BodySHA256}, "\n")
+}
+
+// RequestVerifier checks HMAC request signatures made with per-device
+// secrets. Timestamps must be within window of the gateway's clock, and each
+// device nonce is accepted once within the window.
+type RequestVerifier struct {
+	path   string
+	window time.Duration
+	nonces *nonceStore
+
+	mu      sync.RWMutex
+	secrets map[string][]byte
+}
+
+// LoadRequestVerifier reads per-device secrets from a JSON file of the form
+// {"devices": {"<device id>": "<base64 secret>"}} and reloads it on change
+func LoadRequestVerifier(path string, window time.Duration, nonceCapacity int) (*RequestVerifier, error) {
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	if nonceCapacity <= 0 {
+		nonceCapacity = 100000
+	}
+	verifier := &RequestVerifier{
+		path:   path,
+		window: window,
+		nonces: newNonceStore(nonceCapacity),
+	}
+	if err := verifier.load(); err != nil {
+		return nil, err
+	}
+	if err := watchFile(path, "signing secrets", verifier.load); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+func (v *RequestVerifier) load() error {
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return fmt.Errorf("error reading signing secrets: %w", err)
+	}
+	var file struct {
+		Devices map[string]string `json:"devices"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing signing secrets: %w", err)
+	}
+
+	secrets := make(map[string][]byte, len(file.Devices))
+	for device, encoded := range file.Devices {
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) < 16 {
+			return fmt.Errorf("secret of device %s must be at least 16 base64-encoded bytes", device)
+		}
+		secrets[device] = secret
+	}
+
+	v.mu.Lock()
+	v.secrets = secrets
+	v.mu.Unlock()
+	log.Printf("[AUTH] Loaded signing secrets for %d devices", len(secrets))
+	return nil
+}
+
+// Verify checks a signed request. The nonce is only recorded once the
+// signature is valid, so forged requests can't burn a client's nonces.
+func (v *RequestVerifier) Verify(request SignedRequest) error {
+	if request.Signature == "" || request.Timestamp == "" || request.Nonce == "" {
+		return ErrMissingSignature
+	}
+
+	v.mu.RLock()
+	secret, ok := v.secrets[request.DeviceID]
+	v.mu.RUnlock()
+	if !ok {
+		return ErrUnknownDevice
+	}
+
+	seconds, err := strconv.ParseInt(request.Timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > v.window || skew < -v.window {
+		return ErrStaleTimestamp
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(request.Signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(request.Canonical()))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ErrBadSignature
+	}
+
+	// Nonces only need to be remembered while their timestamp is acceptable
+	if !v.nonces.add(request.DeviceID+"\n"+request.Nonce, signedAt.Add(v.window)) {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// BodyDigest returns the hex SHA-256 used in signatures
+func BodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// nonceStore remembers used nonces until they expire. It holds at most
+// capacity entries; when full, the oldest entry is dropped, so capacity
+// should exceed the signed requests expected within one window.
+type nonceStore struct {
+	mu       sync.Mutex
+	capacity int
+	expiries map[string]time.Time
+	order    []string // Insertion order, used as a ring buffer
+	next     int
+}
+
+func newNonceStore(capacity int) *nonceStore {
+	return &nonceStore{
+		capacity: capacity,
+		expiries: make(map[string]time.Time, capacity),
+		order:    make([]string, 0, capacity),
+	}
+}
+
+// add records a nonce and reports false if it was already used
+func (s *nonceStore) add(nonce string, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expiry, ok := s.expiries[nonce]; ok {
+		if time.Now().Before(expiry) {
+			return false
+		}
+		// Expired entries are reused in place
+		s.expiries[nonce] = expires
+		return true
+	}
+
+	if len(s.order) < s.capacity {
+		s.order = append(s.order, nonce)
+	} else {
+		// Replace the oldest entry
+		delete(s.expiries, s.order[s.next])
+		s.order[s.next] = nonce
+		s.next = (s.next + 1) % s.capacity
+	}
+	s.expiries[nonce] = expires
+	return true
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var deviceSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func sign(request SignedRequest, secret []byte) SignedRequest {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(request.Canonical()))
+	request.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return request
+}
+
+func signedRequest(nonce string, at time.Time) SignedRequest {
+	return sign(SignedRequest{
+		Method:     "POST",
+		Path:       "/v1/location?batch=false",
+		DeviceID:   "mac1",
+		Timestamp:  strconv.FormatInt(at.Unix(), 10),
+		Nonce:      nonce,
+		BodySHA256: BodyDigest([]byte(`{"latitude":52.5}`)),
+	}, deviceSecret)
+}
+
+func TestRequestVerifier(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		request func() SignedRequest
+		err     error
+	}{
+		{name: "valid", request: func() SignedRequest { return signedRequest("n1", now) }},
+		{name: "clock skew within window", request: func() SignedRequest { return signedRequest("n2", now.Add(4*time.Minute)) }},
+		{name: "missing signature", request: func() SignedRequest {
+			r := signedRequest("n3", now)
+			r.Signature = ""
+			return r
+		}, err: ErrMissingSignature},
+		{name: "missing nonce", request: func() SignedRequest { return signedRequest("", now) }, err: ErrMissingSignature},
+		{name: "unknown device", request: func() SignedRequest {
+			r := signedRequest("n4", now)
+			r.DeviceID = "mac3"
+			return sign(r, deviceSecret)
+		}, err: ErrUnknownDevice},
+		{name: "stale timestamp", request: func() SignedRequest { return signedRequest("n5", now.Add(-6*time.Minute)) }, err: ErrStaleTimestamp},
+		{name: "future timestamp", request: func() SignedRequest { return signedRequest("n6", now.Add(6*time.Minute)) }, err: ErrStaleTimestamp},
+		{name: "malformed timestamp", request: func() SignedRequest {
+			r := signedRequest("n7", now)
+			r.Timestamp = "yesterday"
+			return sign(r, deviceSecret)
+		}, err: ErrStaleTimestamp},
+		{name: "tampered body", request: func() SignedRequest {
+			r := signedRequest("n8", now)
+			r.BodySHA256 = BodyDigest([]byte(`{"latitude":0}`))
+			return r
+		}, err: ErrBadSignature},
+		{name: "tampered path", request: func() SignedRequest {
+			r := signedRequest("n9", now)
+			r.Path = "/v1/location?batch=true"
+			return r
+		}, err: ErrBadSignature},
+		{name: "tampered method", request: func() SignedRequest {
+			r := signedRequest("n10", now)
+			r.Method = "PUT"
+			return r
+		}, err: ErrBadSignature},
+		{name: "other device's signature", request: func() SignedRequest {
+			r := signedRequest("n11", now)
+			r.DeviceID = "mac2"
+			return r
+		}, err: ErrBadSignature},
+		{name: "wrong secret", request: func() SignedRequest {
+			return sign(signedRequest("n12", now), []byte("fedcba9876543210fedcba9876543210"))
+		}, err: ErrBadSignature},
+		{name: "signature not base64", request: func() SignedRequest {
+			r := signedRequest("n13", now)
+			r.Signature = "!!"
+			return r
+		}, err: ErrBadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := &RequestVerifier{
+				window:  5 * time.Minute,
+				nonces:  newNonceStore(100),
+				secrets: map[string][]byte{"mac1": deviceSecret, "mac2": []byte("another-device-secret")},
+			}
+			if err := verifier.Verify(tt.request()); !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRequestVerifierNonces(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		requests []SignedRequest
+		err      error // Result of the last request
+	}{
+		{name: "replayed nonce", requests: []SignedRequest{signedRequest("n1", now), signedRequest("n1", now)}, err: ErrReplayedNonce},
+		{name: "replayed with a new timestamp", requests: []SignedRequest{signedRequest("n1", now), signedRequest("n1", now.Add(time.Second))}, err: ErrReplayedNonce},
+		{name: "fresh nonce", requests: []SignedRequest{signedRequest("n1", now), signedRequest("n2", now)}},
+		{name: "forgery doesn't use up the nonce", requests: []SignedRequest{
+			sign(signedRequest("n1", now), []byte("fedcba9876543210fedcba9876543210")),
+			signedRequest("n1", now),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := &RequestVerifier{window: 5 * time.Minute, nonces: newNonceStore(100), secrets: map[string][]byte{"mac1": deviceSecret}}
+			var err error
+			for _, request := range tt.requests {
+				err = verifier.Verify(request)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	later := time.Now().Add(time.Minute)
+	earlier := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name     string
+		capacity int
+		adds     []string
+		expires  time.Time
+		nonce    string
+		want     bool
+	}{
+		{name: "unused", capacity: 3, adds: []string{"a"}, expires: later, nonce: "b", want: true},
+		{name: "used", capacity: 3, adds: []string{"a", "b"}, expires: later, nonce: "a", want: false},
+		{name: "expired", capacity: 3, adds: []string{"a"}, expires: earlier, nonce: "a", want: true},
+		{name: "evicted when full", capacity: 2, adds: []string{"a", "b", "c"}, expires: later, nonce: "a", want: true},
+		{name: "newest kept when full", capacity: 2, adds: []string{"a", "b", "c"}, expires: later, nonce: "c", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newNonceStore(tt.capacity)
+			for _, nonce := range tt.adds {
+				store.add(nonce, tt.expires)
+			}
+			if got := store.add(tt.nonce, later); got != tt.want {
+				t.Fatalf("add(%q) = %v, want %v", tt.nonce, got, tt.want)
+			}
+			if len(store.expiries) > tt.capacity {
+				t.Fatalf("store holds %d nonces, capacity %d", len(store.expiries), tt.capacity)
+			}
+		})
+	}
+}
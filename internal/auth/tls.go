@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MethodCertificate marks principals authenticated by a client certificate
+const MethodCertificate = "mtls"
+
+// TLSConfig configures the HTTP and gRPC listeners
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string   // Enables client certificates when set
+	ClientAuth   string   // "optional" (default) or "require"
+	IdentityFrom string   // "cn" (default), "dns", "uri" or "email"; names the device
+	MinVersion   string   // "1.2" (default) or "1.3"
+	CipherSuites []string // TLS 1.2 suite names; empty for Go's defaults
+}
+
+// TLSReloader serves the current server certificate and client CA pool.
+// The files are watched and reloaded when they change, so renewed
+// certificates are used without a restart.
+type TLSReloader struct {
+	config       TLSConfig
+	clientAuth   tls.ClientAuthType
+	minVersion   uint16
+	cipherSuites []uint16
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func NewTLSReloader(config TLSConfig) (*TLSReloader, error) {
+	reloader := &TLSReloader{config: config, clientAuth: tls.NoClientCert}
+	switch config.MinVersion {
+	case "", "1.2":
+		reloader.minVersion = tls.VersionTLS12
+	case "1.3":
+		reloader.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q; use 1.2 or 1.3", config.MinVersion)
+	}
+	for _, name := range config.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		reloader.cipherSuites = append(reloader.cipherSuites, id)
+	}
+	if config.ClientCAFile != "" {
+		switch strings.ToLower(config.ClientAuth) {
+		case "", "optional":
+			reloader.clientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			reloader.clientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("unknown client auth mode %q", config.ClientAuth)
+		}
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	for _, file := range reloader.files() {
+		if err := watchFile(file, "TLS certificates", reloader.reload); err != nil {
+			return nil, err
+		}
+	}
+	return reloader, nil
+}
+
+// cipherSuite looks up a secure cipher suite by its Go name, e.g.
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func (r *TLSReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+func (r *TLSReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading server certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		data, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("client CA file contains no certificates")
+		}
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.clientCAs = pool
+	r.mu.Unlock()
+	return nil
+}
+
+// reload is called by the file watchers. Renewals often write the
+// certificate and key one at a time, so a mismatched pair fails here and
+// loads on the next write.
+func (r *TLSReloader) reload() error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	log.Println("[AUTH] Reloaded TLS certificates")
+	return nil
+}
+
+// ServerConfig returns a TLS config that picks up reloaded certificates
+func (r *TLSReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   r.minVersion,
+		CipherSuites: r.cipherSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   r.minVersion,
+				CipherSuites: r.cipherSuites,
+				Certificates: []tls.Certificate{*r.certificate},
+				ClientAuth:   r.clientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// CertificatePrincipal derives the principal from a verified client
+// certificate state. It returns nil if no certificate was verified.
+func (r *TLSReloader) CertificatePrincipal(state *tls.ConnectionState) *Principal {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	certificate := state.VerifiedChains[0][0]
+
+	var identity string
+	switch strings.ToLower(r.config.IdentityFrom) {
+	case "dns":
+		if len(certificate.DNSNames) > 0 {
+			identity = certificate.DNSNames[0]
+		}
+	case "uri":
+		if len(certificate.URIs) > 0 {
+			identity = certificate.URIs[0].String()
+		}
+	case "email":
+		if len(certificate.EmailAddresses) > 0 {
+			identity = certificate.EmailAddresses[0]
+		}
+	default:
+		identity = certificate.Subject.CommonName
+	}
+	if identity == "" {
+		return nil
+	}
+
+	principal := &Principal{
+		Subject:   identity,
+		Name:      MethodCertificate,
+		Method:    MethodCertificate,
+		ExpiresAt: certificate.NotAfter,
+		DeviceID:  identity,
+	}
+	if len(certificate.Subject.Organization) > 0 {
+		principal.Tenant = certificate.Subject.Organization[0]
+	}
+	return principal
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate issues a certificate for template, signed by parent and
+// parentKey or self-signed when parent is nil
+func testCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() = %v", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+func writeCertificate(t *testing.T, dir, name string, certificate *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	der, _ := x509.MarshalECPrivateKey(key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testPKI writes a CA and a server certificate signed by it
+type testPKI struct {
+	dir      string
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	pki := &testPKI{dir: t.TempDir()}
+	pki.ca, pki.caKey = testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	pki.caFile, _ = writeCertificate(t, pki.dir, "ca", pki.ca, pki.caKey)
+	server, serverKey := pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}, DNSNames: []string{"localhost"}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	pki.certFile, pki.keyFile = writeCertificate(t, pki.dir, "server", server, serverKey)
+	return pki
+}
+
+func (p *testPKI) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return testCertificate(t, template, p.ca, p.caKey)
+}
+
+func TestNewTLSReloaderConfig(t *testing.T) {
+	pki := newTestPKI(t)
+
+	tests := []struct {
+		name       string
+		change     func(config *TLSConfig)
+		wantErr    bool
+		clientAuth tls.ClientAuthType
+		minVersion uint16
+	}{
+		{name: "defaults", clientAuth: tls.NoClientCert, minVersion: tls.VersionTLS12},
+		{name: "TLS 1.3", change: func(config *TLSConfig) { config.MinVersion = "1.3" }, clientAuth: tls.NoClientCert, minVersion: tls.VersionTLS13},
+		{name: "TLS 1.1", change: func(config *TLSConfig) { config.MinVersion = "1.1" }, wantErr: true},
+		{name: "cipher suite", change: func(config *TLSConfig) {
+			config.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+		}, clientAuth: tls.NoClientCert, minVersion: tls.VersionTLS12},
+		{name: "insecure cipher suite", change: func(config *TLSConfig) { config.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, wantErr: true},
+		{name: "optional client certificates", change: func(config *TLSConfig) { config.ClientCAFile = pki.caFile }, clientAuth: tls.VerifyClientCertIfGiven, minVersion: tls.VersionTLS12},
+		{name: "required client certificates", change: func(config *TLSConfig) {
+			config.ClientCAFile, config.ClientAuth = pki.caFile, "Require"
+		}, clientAuth: tls.RequireAndVerifyClientCert, minVersion: tls.VersionTLS12},
+		{name: "unknown client auth", change: func(config *TLSConfig) { config.ClientCAFile, config.ClientAuth = pki.caFile, "sometimes" }, wantErr: true},
+		{name: "client auth without a CA", change: func(config *TLSConfig) { config.ClientAuth = "require" }, clientAuth: tls.NoClientCert, minVersion: tls.VersionTLS12},
+		{name: "missing certificate", change: func(config *TLSConfig) { config.CertFile = filepath.Join(pki.dir, "missing.crt") }, wantErr: true},
+		{name: "mismatched key", change: func(config *TLSConfig) { config.KeyFile = filepath.Join(pki.dir, "ca.key") }, wantErr: true},
+		{name: "CA file without certificates", change: func(config *TLSConfig) { config.ClientCAFile = pki.keyFile }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := TLSConfig{CertFile: pki.certFile, KeyFile: pki.keyFile}
+			if tt.change != nil {
+				tt.change(&config)
+			}
+			reloader, err := NewTLSReloader(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTLSReloader() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			server, _ := reloader.ServerConfig().GetConfigForClient(nil)
+			if server.ClientAuth != tt.clientAuth || server.MinVersion != tt.minVersion || len(server.CipherSuites) != len(config.CipherSuites) {
+				t.Fatalf("server config = client auth %v, min version %x, suites %v", server.ClientAuth, server.MinVersion, server.CipherSuites)
+			}
+		})
+	}
+}
+
+// servedCertificate returns the common name of the certificate the
+// reloader currently serves
+func servedCertificate(t *testing.T, reloader *TLSReloader) string {
+	t.Helper()
+	server, err := reloader.ServerConfig().GetConfigForClient(nil)
+	if err != nil {
+		t.Fatalf("GetConfigForClient() = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(server.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() = %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSReloaderReloads(t *testing.T) {
+	pki := newTestPKI(t)
+	reloader, err := NewTLSReloader(TLSConfig{CertFile: pki.certFile, KeyFile: pki.keyFile})
+	if err != nil {
+		t.Fatalf("NewTLSReloader() = %v", err)
+	}
+	if name := servedCertificate(t, reloader); name != "gateway" {
+		t.Fatalf("served %q, want gateway", name)
+	}
+
+	// A certificate whose key hasn't been written yet is not loaded
+	renewed, renewedKey := pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "renewed"}})
+	os.WriteFile(pki.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.Raw}), 0o600)
+	if err := reloader.reload(); err == nil {
+		t.Fatal("reload() of a mismatched pair succeeded")
+	}
+	if name := servedCertificate(t, reloader); name != "gateway" {
+		t.Fatalf("served %q after a failed reload, want gateway", name)
+	}
+
+	// Writing the key completes the pair and the watcher picks it up
+	der, _ := x509.MarshalECPrivateKey(renewedKey)
+	os.WriteFile(pki.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCertificate(t, reloader) != "renewed" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not served")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTLSReloaderHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	client, clientKey := pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1", Organization: []string{"acme"}}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	other, otherKey := testCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device-1"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca)
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		client     *x509.Certificate
+		clientKey  *ecdsa.PrivateKey
+		wantErr    bool
+		principal  string
+	}{
+		{name: "optional without certificate"},
+		{name: "optional with certificate", client: client, clientKey: clientKey, principal: "device-1"},
+		{name: "required without certificate", clientAuth: "require", wantErr: true},
+		{name: "required with certificate", clientAuth: "require", client: client, clientKey: clientKey, principal: "device-1"},
+		{name: "optional with a certificate from another CA", client: other, clientKey: otherKey},
+		{name: "required with a certificate from another CA", clientAuth: "require", client: other, clientKey: otherKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloader, err := NewTLSReloader(TLSConfig{CertFile: pki.certFile, KeyFile: pki.keyFile, ClientCAFile: pki.caFile, ClientAuth: tt.clientAuth})
+			if err != nil {
+				t.Fatalf("NewTLSReloader() = %v", err)
+			}
+			listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.ServerConfig())
+			if err != nil {
+				t.Fatalf("Listen() = %v", err)
+			}
+			defer listener.Close()
+
+			states := make(chan *tls.ConnectionState, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					states <- nil
+					return
+				}
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					states <- nil
+					return
+				}
+				state := tlsConn.ConnectionState()
+				states <- &state
+			}()
+
+			config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.client != nil {
+				config.Certificates = []tls.Certificate{{Certificate: [][]byte{tt.client.Raw}, PrivateKey: tt.clientKey}}
+			}
+			conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+			if err == nil {
+				// TLS 1.3 reports client certificate failures on the first read
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				_, err = conn.Read(make([]byte, 1))
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					err = nil
+				}
+				conn.Close()
+			}
+			state := <-states
+			if (state == nil) != tt.wantErr {
+				t.Fatalf("server handshake ok = %v, client error %v, wantErr %v", state != nil, err, tt.wantErr)
+			}
+			if state == nil {
+				return
+			}
+			principal := reloader.CertificatePrincipal(state)
+			if tt.principal == "" {
+				if principal != nil {
+					t.Fatalf("CertificatePrincipal() = %+v, want nil", principal)
+				}
+				return
+			}
+			if principal == nil || principal.Subject != tt.principal || principal.DeviceID != tt.principal || principal.Tenant != "acme" || principal.Method != MethodCertificate {
+				t.Fatalf("CertificatePrincipal() = %+v", principal)
+			}
+		})
+	}
+}
+
+func TestCertificatePrincipalIdentity(t *testing.T) {
+	certificate := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "cn-device"},
+		DNSNames:       []string{"dns-device.example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/device"}},
+		EmailAddresses: []string{"device@example.com"},
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+
+	tests := []struct {
+		identityFrom string
+		certificate  *x509.Certificate
+		want         string // "" for no principal
+	}{
+		{identityFrom: "", certificate: certificate, want: "cn-device"},
+		{identityFrom: "DNS", certificate: certificate, want: "dns-device.example.com"},
+		{identityFrom: "uri", certificate: certificate, want: "spiffe://example.com/device"},
+		{identityFrom: "email", certificate: certificate, want: "device@example.com"},
+		{identityFrom: "dns", certificate: &x509.Certificate{Subject: pkix.Name{CommonName: "cn-device"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.identityFrom, func(t *testing.T) {
+			reloader := &TLSReloader{config: TLSConfig{IdentityFrom: tt.identityFrom}}
+			principal := reloader.CertificatePrincipal(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.certificate}}})
+			if tt.want == "" {
+				if principal != nil {
+					t.Fatalf("CertificatePrincipal() = %+v, want nil", principal)
+				}
+				return
+			}
+			if principal == nil || principal.Subject != tt.want || principal.DeviceID != tt.want || !principal.ExpiresAt.Equal(tt.certificate.NotAfter) {
+				t.Fatalf("CertificatePrincipal() = %+v, want %q", principal, tt.want)
+			}
+		})
+	}
+
+	reloader := &TLSReloader{}
+	if principal := reloader.CertificatePrincipal(&tls.ConnectionState{}); principal != nil {
+		t.Fatalf("CertificatePrincipal() without verified chains = %+v", principal)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFile calls reload when the file changes. The directory is watched
+// because editors and config management usually replace the file rather than
+// write it. A failed reload is logged and the previous state stays in use.
+func watchFile(path, what string, reload func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(path) {
+					// Wait for the write to settle before reading
+					settle = time.After(200 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[AUTH] Watching %s failed: %v", what, err)
+			case <-settle:
+				settle = nil
+				if err := reload(); err != nil {
+					log.Printf("[AUTH] Reloading %s failed, keeping the previous one: %v", what, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
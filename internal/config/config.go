@@ -1,14 +1,26 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
 	HTTP struct {
-		Port string `mapstructure:"Port"`
+		Port              string        `mapstructure:"Port"`
+		ReadHeaderTimeout time.Duration `mapstructure:"ReadHeaderTimeout"`
+		ReadTimeout       time.Duration `mapstructure:"ReadTimeout"`
+		WriteTimeout      time.Duration `mapstructure:"WriteTimeout"`
+		IdleTimeout       time.Duration `mapstructure:"IdleTimeout"`
+		MaxHeaderBytes    int           `mapstructure:"MaxHeaderBytes"`
 	} `mapstructure:"HTTP"`
 	GRPC struct {
 		Port string `mapstructure:"Port"`
@@ -18,46 +30,343 @@ type Config struct {
 		DevelopmentMode bool     `mapstructure:"DevelopmentMode"`
 	} `mapstructure:"Kafka"`
 	MinIO struct {
-		Endpoint         string `mapstructure:"Endpoint"`
-		AccessKey        string `mapstructure:"AccessKey"`
-		SecretKey        string `mapstructure:"SecretKey"`
-		Bucket           string `mapstructure:"Bucket"`
+		Endpoint      string `mapstructure:"Endpoint"`
+		AccessKey     string `mapstructure:"AccessKey" redact:"true"`
+		SecretKey     string `mapstructure:"SecretKey" redact:"true"`
+		AccessKeyFile string `mapstructure:"AccessKeyFile"`
+		SecretKeyFile string `mapstructure:"SecretKeyFile"`
+		Bucket        string `mapstructure:"Bucket"`
+		Region        string `mapstructure:"Region"`
+		Secure        bool   `mapstructure:"Secure"`
+		CABundle      string `mapstructure:"CABundle"`
+		BucketLookup  string `mapstructure:"BucketLookup"`
+		Bootstrap     struct {
+			CreateBucket         bool   `mapstructure:"CreateBucket"`
+			Versioning           bool   `mapstructure:"Versioning"`
+			ObjectLock           bool   `mapstructure:"ObjectLock"`
+			RetentionMode        string `mapstructure:"RetentionMode"`
+			RetentionDays        uint   `mapstructure:"RetentionDays"`
+			ExpireDays           int    `mapstructure:"ExpireDays"`
+			NoncurrentExpireDays int    `mapstructure:"NoncurrentExpireDays"`
+		} `mapstructure:"Bootstrap"`
+		// Deprecated: use Storage.Backend and Storage.Filesystem.Path
 		DevelopmentMode  bool   `mapstructure:"DevelopmentMode"`
 		LocalStoragePath string `mapstructure:"LocalStoragePath"`
 	} `mapstructure:"MinIO"`
-	APIKeys     map[string]bool `mapstructure:"APIKeys"`
-	DisableAuth bool            `mapstructure:"DisableAuth"`
+	Storage struct {
+		Backend              string        `mapstructure:"Backend"`
+		FallbackToFilesystem bool          `mapstructure:"FallbackToFilesystem"`
+		SigningSecret        string        `mapstructure:"SigningSecret" redact:"true"`
+		PublicURL            string        `mapstructure:"PublicURL"`
+		UploadTimeout        time.Duration `mapstructure:"UploadTimeout"`
+		Retry                struct {
+			MaxAttempts int           `mapstructure:"MaxAttempts"`
+			BaseDelay   time.Duration `mapstructure:"BaseDelay"`
+			MaxDelay    time.Duration `mapstructure:"MaxDelay"`
+		} `mapstructure:"Retry"`
+		CircuitBreaker struct {
+			FailureThreshold int           `mapstructure:"FailureThreshold"`
+			OpenTimeout      time.Duration `mapstructure:"OpenTimeout"`
+		} `mapstructure:"CircuitBreaker"`
+		Staging struct {
+			Enable          bool          `mapstructure:"Enable"`
+			Path            string        `mapstructure:"Path"`
+			ForwardInterval time.Duration `mapstructure:"ForwardInterval"`
+		} `mapstructure:"Staging"`
+		Filesystem struct {
+			Path          string           `mapstructure:"Path"`
+			PrefixQuota   int64            `mapstructure:"PrefixQuota"`
+			Quotas        map[string]int64 `mapstructure:"Quotas"`
+			MaxAge        time.Duration    `mapstructure:"MaxAge"`
+			SweepInterval time.Duration    `mapstructure:"SweepInterval"`
+		} `mapstructure:"Filesystem"`
+	} `mapstructure:"Storage"`
+	Encryption struct {
+		S3          string `mapstructure:"S3"`
+		Filesystem  bool   `mapstructure:"Filesystem"`
+		KeyringFile string `mapstructure:"KeyringFile"`
+	} `mapstructure:"Encryption"`
+	UploadSessions struct {
+		TTL          time.Duration `mapstructure:"TTL"`
+		MaxChunks    int           `mapstructure:"MaxChunks"`
+		MaxChunkSize int64         `mapstructure:"MaxChunkSize"`
+	} `mapstructure:"UploadSessions"`
+	Uploads         map[string]UploadPolicy    `mapstructure:"Uploads"`
+	ImageProcessing map[string]ImageProcessing `mapstructure:"ImageProcessing"`
+	APIKeys         map[string]APIKey          `mapstructure:"APIKeys" redact:"keys"`
+	APIKeysFile     string                     `mapstructure:"APIKeysFile"`
+	JWT             struct {
+		Enable      bool          `mapstructure:"Enable"`
+		Algorithms  []string      `mapstructure:"Algorithms"`
+		HMACSecret  string        `mapstructure:"HMACSecret" redact:"true"`
+		JWKSFile    string        `mapstructure:"JWKSFile"`
+		JWKSURL     string        `mapstructure:"JWKSURL"`
+		JWKSRefresh time.Duration `mapstructure:"JWKSRefresh"`
+		Issuer      string        `mapstructure:"Issuer"`
+		Audience    []string      `mapstructure:"Audience"`
+		ClockSkew   time.Duration `mapstructure:"ClockSkew"`
+		UserClaim   string        `mapstructure:"UserClaim"`
+		DeviceClaim string        `mapstructure:"DeviceClaim"`
+	} `mapstructure:"JWT"`
+	TLS struct {
+		Enable       bool     `mapstructure:"Enable"`
+		CertFile     string   `mapstructure:"CertFile"`
+		KeyFile      string   `mapstructure:"KeyFile"`
+		ClientCAFile string   `mapstructure:"ClientCAFile"`
+		ClientAuth   string   `mapstructure:"ClientAuth"`
+		IdentityFrom string   `mapstructure:"IdentityFrom"`
+		MinVersion   string   `mapstructure:"MinVersion"`
+		CipherSuites []string `mapstructure:"CipherSuites"`
+		RedirectPort string   `mapstructure:"RedirectPort"`
+	} `mapstructure:"TLS"`
+	Audit struct {
+		Enable     bool   `mapstructure:"Enable"`
+		File       string `mapstructure:"File"`
+		MaxSize    int64  `mapstructure:"MaxSize"`
+		MaxBackups int    `mapstructure:"MaxBackups"`
+		Topic      string `mapstructure:"Topic"`
+		Successes  bool   `mapstructure:"Successes"`
+	} `mapstructure:"Audit"`
+	AuthFailures struct {
+		MaxFailures int           `mapstructure:"MaxFailures"`
+		Window      time.Duration `mapstructure:"Window"`
+		Block       time.Duration `mapstructure:"Block"`
+	} `mapstructure:"AuthFailures"`
+	Admin struct {
+		Enable bool   `mapstructure:"Enable"`
+		Port   string `mapstructure:"Port"`
+		Token  string `mapstructure:"Token" redact:"true"`
+		KeysDB string `mapstructure:"KeysDB"`
+	} `mapstructure:"Admin"`
+	Ops struct {
+		Enable   bool   `mapstructure:"Enable"`
+		Port     string `mapstructure:"Port"`
+		Username string `mapstructure:"Username"`
+		Password string `mapstructure:"Password" redact:"true"`
+		Token    string `mapstructure:"Token" redact:"true"`
+		Pprof    bool   `mapstructure:"Pprof"`
+	} `mapstructure:"Ops"`
+	WebSocket struct {
+		AllowedOrigins []string      `mapstructure:"AllowedOrigins"`
+		TokenTTL       time.Duration `mapstructure:"TokenTTL"`
+	} `mapstructure:"WebSocket"`
+	RateLimits struct {
+		Enable bool                 `mapstructure:"Enable"`
+		KeyBy  []string             `mapstructure:"KeyBy"`
+		Routes map[string]RateLimit `mapstructure:"Routes"`
+	} `mapstructure:"RateLimits"`
+	Schemas struct {
+		Enable      bool     `mapstructure:"Enable"`
+		Dir         string   `mapstructure:"Dir"`
+		Unvalidated []string `mapstructure:"Unvalidated"`
+	} `mapstructure:"Schemas"`
+	LocationValidation struct {
+		Enable      bool              `mapstructure:"Enable"`
+		MaxAccuracy float64           `mapstructure:"MaxAccuracy"`
+		Rules       map[string]string `mapstructure:"Rules"`
+	} `mapstructure:"LocationValidation"`
+	TrustedProxies []string            `mapstructure:"TrustedProxies"`
+	IPFilters      map[string]IPFilter `mapstructure:"IPFilters"`
+	RequestSigning struct {
+		Enable        bool          `mapstructure:"Enable"`
+		SecretsFile   string        `mapstructure:"SecretsFile"`
+		Window        time.Duration `mapstructure:"Window"`
+		NonceCapacity int           `mapstructure:"NonceCapacity"`
+		MaxBodySize   int64         `mapstructure:"MaxBodySize"`
+		Endpoints     []string      `mapstructure:"Endpoints"`
+	} `mapstructure:"RequestSigning"`
+	DisableAuth bool `mapstructure:"DisableAuth"`
 	Metrics     struct {
 		Enable   bool   `mapstructure:"Enable"`
 		Endpoint string `mapstructure:"Endpoint"`
 	} `mapstructure:"Metrics"`
 }
 
+// UploadPolicy limits media uploads for a single source
+type UploadPolicy struct {
+	AllowedTypes    []string `mapstructure:"AllowedTypes"`
+	MaxSize         int64    `mapstructure:"MaxSize"`
+	MaxFilesPerHour int      `mapstructure:"MaxFilesPerHour"`
+}
+
+// APIKey describes the client behind an API key. The old `key: true` form is
+// still accepted and becomes an enabled key without restrictions.
+type APIKey struct {
+	Name      string    `mapstructure:"Name"`
+	Tenant    string    `mapstructure:"Tenant"`
+	Scopes    []string  `mapstructure:"Scopes"`
+	Enabled   bool      `mapstructure:"Enabled"`
+	ExpiresAt time.Time `mapstructure:"ExpiresAt"`
+	UserID    string    `mapstructure:"UserID"`
+	DeviceID  string    `mapstructure:"DeviceID"`
+}
+
+// RateLimit configures the request and event budgets of a route, in tokens
+// per second. Zero rates leave a budget unlimited.
+type RateLimit struct {
+	Requests     float64 `mapstructure:"Requests"`
+	RequestBurst int     `mapstructure:"RequestBurst"`
+	Events       float64 `mapstructure:"Events"`
+	EventBurst   int     `mapstructure:"EventBurst"`
+}
+
+// IPFilter lists the client networks allowed on and denied from a route group
+type IPFilter struct {
+	Allow []string `mapstructure:"Allow"`
+	Deny  []string `mapstructure:"Deny"`
+}
+
+// ImageProcessing configures the image privacy pipeline for a single source
+type ImageProcessing struct {
+	StripMetadata bool     `mapstructure:"StripMetadata"`
+	ExtractEXIF   []string `mapstructure:"ExtractEXIF"`
+	Thumbnail     bool     `mapstructure:"Thumbnail"`
+	ThumbnailSize int      `mapstructure:"ThumbnailSize"`
+	MaxPixels     int64    `mapstructure:"MaxPixels"`
+}
+
 func LoadConfig() *Config {
 	viper.SetConfigName("config")
 	viper.AddConfigPath("./configs")
 	viper.AutomaticEnv()
+	// Secrets that shouldn't live in the config file
+	viper.BindEnv("Admin.Token", "ADMIN_TOKEN")
+	viper.BindEnv("Ops.Password", "OPS_PASSWORD")
+	viper.BindEnv("Ops.Token", "OPS_TOKEN")
 
 	var cfg Config
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("Error reading config file: %v", err)
 	}
 
-	if err := viper.Unmarshal(&cfg); err != nil {
+	decodeHooks := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		apiKeyHook,
+	))
+	if err := viper.Unmarshal(&cfg, decodeHooks); err != nil {
 		log.Fatalf("Error unmarshaling config: %v", err)
 	}
 
+	// Keys without a name get one derived from the key, so the key itself
+	// never shows up in metrics or logs
+	for key, apiKey := range cfg.APIKeys {
+		if apiKey.Name == "" {
+			sum := sha256.Sum256([]byte(key))
+			apiKey.Name = "key-" + hex.EncodeToString(sum[:4])
+			cfg.APIKeys[key] = apiKey
+		}
+	}
+
+	// Map the old MinIO development mode settings onto the storage backend
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = "s3"
+		if cfg.MinIO.DevelopmentMode {
+			cfg.Storage.Backend = "filesystem"
+		}
+	}
+	if cfg.Storage.Filesystem.Path == "" {
+		cfg.Storage.Filesystem.Path = cfg.MinIO.LocalStoragePath
+	}
+
 	// Log loaded configuration
 	log.Println("Configuration loaded successfully")
 	if cfg.Kafka.DevelopmentMode {
 		log.Println("Kafka in development mode: messages will be logged")
 	}
-	if cfg.MinIO.DevelopmentMode {
-		log.Println("MinIO in development mode: files will be saved to", cfg.MinIO.LocalStoragePath)
-	}
+	log.Println("Storage backend:", cfg.Storage.Backend)
 	if cfg.DisableAuth {
 		log.Println("API Authentication is disabled")
 	}
 
 	return &cfg
 }
+
+// apiKeyHook decodes the legacy `key: true` form and enables keys that don't
+// set Enabled
+func apiKeyHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(APIKey{}) {
+		return data, nil
+	}
+	switch value := data.(type) {
+	case bool:
+		return map[string]interface{}{"Enabled": value}, nil
+	case map[string]interface{}:
+		for field := range value {
+			if strings.EqualFold(field, "Enabled") {
+				return data, nil
+			}
+		}
+		withDefault := make(map[string]interface{}, len(value)+1)
+		for field, v := range value {
+			withDefault[field] = v
+		}
+		withDefault["Enabled"] = true
+		return withDefault, nil
+	}
+	return data, nil
+}
+
+// Redacted returns the configuration as a map keyed like the config file,
+// with fields tagged `redact:"true"` masked and maps tagged `redact:"keys"`
+// turned into lists, so secrets used as map keys don't show up either
+func (c *Config) Redacted() map[string]interface{} {
+	redacted, _ := redactValue(reflect.ValueOf(*c)).(map[string]interface{})
+	return redacted
+}
+
+func redactValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Struct:
+		if t, ok := value.Interface().(time.Time); ok {
+			return t
+		}
+		fields := make(map[string]interface{}, value.NumField())
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := field.Tag.Get("mapstructure")
+			if name == "" {
+				name = field.Name
+			}
+			switch field.Tag.Get("redact") {
+			case "true":
+				if value.Field(i).IsZero() {
+					fields[name] = ""
+				} else {
+					fields[name] = "[REDACTED]"
+				}
+			case "keys":
+				entries := make([]interface{}, 0, value.Field(i).Len())
+				iter := value.Field(i).MapRange()
+				for iter.Next() {
+					entries = append(entries, redactValue(iter.Value()))
+				}
+				fields[name] = entries
+			default:
+				fields[name] = redactValue(value.Field(i))
+			}
+		}
+		return fields
+	case reflect.Map:
+		entries := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			entries[fmt.Sprint(iter.Key().Interface())] = redactValue(iter.Value())
+		}
+		return entries
+	case reflect.Slice:
+		if value.IsNil() {
+			return []interface{}{}
+		}
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = redactValue(value.Index(i))
+		}
+		return items
+	}
+	if d, ok := value.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return value.Interface()
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedacted(t *testing.T) {
+	var cfg Config
+	cfg.MinIO.AccessKey = "minio-access"
+	cfg.MinIO.SecretKey = "minio-secret"
+	cfg.JWT.HMACSecret = "jwt-secret"
+	cfg.Admin.Token = "admin-token"
+	cfg.Ops.Username = "ops"
+	cfg.APIKeys = map[string]APIKey{"plaintext-api-key": {Name: "desktop-agent", Enabled: true}}
+	cfg.RequestSigning.Window = 5 * time.Minute
+
+	redacted := cfg.Redacted()
+	data, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("json.Marshal() = %v", err)
+	}
+	for _, secret := range []string{"minio-access", "minio-secret", "jwt-secret", "admin-token", "plaintext-api-key"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("redacted config contains %q: %s", secret, data)
+		}
+	}
+
+	tests := []struct {
+		path []string
+		want interface{}
+	}{
+		{path: []string{"MinIO", "SecretKey"}, want: "[REDACTED]"},
+		{path: []string{"Ops", "Password"}, want: ""}, // Unset secrets stay visibly empty
+		{path: []string{"Ops", "Username"}, want: "ops"},
+		{path: []string{"RequestSigning", "Window"}, want: "5m0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.path, "."), func(t *testing.T) {
+			var value interface{} = redacted
+			for _, key := range tt.path {
+				value = value.(map[string]interface{})[key]
+			}
+			if value != tt.want {
+				t.Fatalf("%s = %v, want %v", strings.Join(tt.path, "."), value, tt.want)
+			}
+		})
+	}
+
+	keys, _ := redacted["APIKeys"].([]interface{})
+	if len(keys) != 1 || keys[0].(map[string]interface{})["Name"] != "desktop-agent" {
+		t.Fatalf("APIKeys = %v, want the key's settings without the key", redacted["APIKeys"])
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+type createKeyRequest struct {
+	Name      string    `json:"name" binding:"required"`
+	Owner     string    `json:"owner"`
+	Tenant    string    `json:"tenant"`
+	Scopes    []string  `json:"scopes"`
+	UserID    string    `json:"user_id"`
+	DeviceID  string    `json:"device_id"`
+	Disabled  bool      `json:"disabled"`
+	NotBefore time.Time `json:"not_before"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type rotateKeyRequest struct {
+	Grace     string    `json:"grace"` // How long the old key stays valid, e.g. "24h"
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AdminListKeysHandler lists the managed API keys
+func AdminListKeysHandler(keys *auth.ManagedKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"keys": keys.List()})
+	}
+}
+
+// AdminCreateKeyHandler creates an API key. The key is in the response only;
+// it can't be retrieved later.
+func AdminCreateKeyHandler(keys *auth.ManagedKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request createKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		created, key, err := keys.Create(auth.ManagedKey{
+			Name:      request.Name,
+			Owner:     request.Owner,
+			Tenant:    request.Tenant,
+			Scopes:    request.Scopes,
+			UserID:    request.UserID,
+			DeviceID:  request.DeviceID,
+			Enabled:   !request.Disabled,
+			NotBefore: request.NotBefore,
+			ExpiresAt: request.ExpiresAt,
+		})
+		if err != nil {
+			adminFailed(c, err)
+			return
+		}
+		auditAdminAction(c, "create_key", map[string]string{"key_id": created.ID, "name": created.Name})
+		c.JSON(http.StatusCreated, gin.H{"key": key, "metadata": created})
+	}
+}
+
+// AdminGetKeyHandler returns the metadata of an API key
+func AdminGetKeyHandler(keys *auth.ManagedKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := keys.Get(c.Param("id"))
+		if err != nil {
+			adminFailed(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, key)
+	}
+}
+
+// AdminSetKeyEnabledHandler enables or disables an API key
+func AdminSetKeyEnabledHandler(keys *auth.ManagedKeys, enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := keys.SetEnabled(c.Param("id"), enabled)
+		if err != nil {
+			adminFailed(c, err)
+			return
+		}
+		action := "disable_key"
+		if enabled {
+			action = "enable_key"
+		}
+		auditAdminAction(c, action, map[string]string{"key_id": key.ID, "name": key.Name})
+		c.JSON(http.StatusOK, key)
+	}
+}
+
+// AdminRotateKeyHandler replaces an API key, keeping the old one valid for
+// the requested grace period
+func AdminRotateKeyHandler(keys *auth.ManagedKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request rotateKeyRequest
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		var grace time.Duration
+		if request.Grace != "" {
+			var err error
+			if grace, err = time.ParseDuration(request.Grace); err != nil || grace < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid grace period"})
+				return
+			}
+		}
+
+		created, key, err := keys.Rotate(c.Param("id"), grace, request.ExpiresAt)
+		if err != nil {
+			adminFailed(c, err)
+			return
+		}
+		auditAdminAction(c, "rotate_key", map[string]string{"key_id": created.RotatedFrom, "new_key_id": created.ID, "name": created.Name, "grace": grace.String()})
+		c.JSON(http.StatusCreated, gin.H{"key": key, "metadata": created})
+	}
+}
+
+// AdminDeleteKeyHandler deletes an API key, revoking it immediately
+func AdminDeleteKeyHandler(keys *auth.ManagedKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := keys.Delete(c.Param("id")); err != nil {
+			adminFailed(c, err)
+			return
+		}
+		auditAdminAction(c, "delete_key", map[string]string{"key_id": c.Param("id")})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func adminFailed(c *gin.Context, err error) {
+	if errors.Is(err, auth.ErrKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// auditAdminAction records a change made through the admin or ops listener
+func auditAdminAction(c *gin.Context, action string, details map[string]string) {
+	details["action"] = action
+	middleware.RecordAudit(c, services.AuditEvent{Type: services.AuditAdminAction, Principal: "admin", Details: details})
+}
@@ -2,19 +2,30 @@ package handlers
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 
+	"github.com/nodelike/chronos-gateway/internal/auth"
 	"github.com/nodelike/chronos-gateway/internal/services"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 // Simple placeholder for gRPC service
 // In a real implementation, you would generate code from proto files
 type CollectorServer struct {
 	UnimplementedCollectorServer
-	producer *services.KafkaProducer
+	producer  *services.KafkaProducer
+	schemas   *services.SchemaRegistry
+	metrics   *services.MetricsCollector
+	audit     *services.AuditLog
+	locations *services.LocationValidator
 }
 
 type Event struct {
@@ -25,16 +36,36 @@ type Event struct {
 // Placeholder interface that would normally be generated from proto
 type UnimplementedCollectorServer struct{}
 
-func StartGRPCServer(port string, producer *services.KafkaProducer) {
+// StartGRPCServer serves the collector, over TLS if tlsConfig is set. Calls
+// from addresses blocked by ipFilter are rejected first. Calls are then
+// authenticated with the "authorization" or "x-api-key" metadata or the
+// client certificate, unless authenticator is nil, and the outcome recorded
+// in the audit log. Location events are checked by locations.
+func StartGRPCServer(port string, producer *services.KafkaProducer, authenticator *auth.Authenticator, tlsConfig *tls.Config, audit *services.AuditLog, ipFilter *services.IPFilter, metrics *services.MetricsCollector, schemas *services.SchemaRegistry, locations *services.LocationValidator) {
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	var options []grpc.ServerOption
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	if ipFilter != nil {
+		unary = append(unary, unaryIPInterceptor(ipFilter, audit, metrics))
+		stream = append(stream, streamIPInterceptor(ipFilter, audit, metrics))
+	}
+	if authenticator != nil {
+		unary = append(unary, unaryAuthInterceptor(authenticator, audit))
+		stream = append(stream, streamAuthInterceptor(authenticator, audit))
+	}
+	options = append(options, grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...))
+	grpcServer := grpc.NewServer(options...)
 
 	// In a real implementation, you would register your generated service
-	// collectorpb.RegisterCollectorServer(grpcServer, &CollectorServer{producer: producer})
+	// collectorpb.RegisterCollectorServer(grpcServer, &CollectorServer{producer: producer, schemas: schemas, metrics: metrics, audit: audit, locations: locations})
 
 	fmt.Printf("gRPC server listening on %s\n", port)
 	if err := grpcServer.Serve(lis); err != nil {
@@ -42,15 +73,186 @@ func StartGRPCServer(port string, producer *services.KafkaProducer) {
 	}
 }
 
+// authenticateGRPC verifies the caller's metadata and stores the principal
+// in the returned context
+func authenticateGRPC(ctx context.Context, authenticator *auth.Authenticator, audit *services.AuditLog, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	event := services.AuditEvent{Route: "grpc " + method, UserAgent: first("user-agent"), IP: peerIP(ctx)}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+
+	principal, err := authenticator.Authenticate(first("authorization"), first("x-api-key"), state)
+	if err != nil {
+		event.Type, event.Reason = services.AuditAuthFailure, err.Error()
+		audit.Record(event)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	event.Principal, event.Subject, event.Tenant, event.Method = principal.Name, principal.Subject, principal.Tenant, principal.Method
+	// All gRPC methods share the "grpc" scope
+	if !principal.Allows("grpc") {
+		event.Type, event.Reason = services.AuditScopeDenied, "grpc not in scopes"
+		audit.Record(event)
+		return nil, status.Error(codes.PermissionDenied, "not allowed to call grpc")
+	}
+	event.Type = services.AuditAuthSuccess
+	audit.Record(event)
+	return auth.NewContext(ctx, principal), nil
+}
+
+// peerIP is the address of the connection a call came in on. Forwarded
+// addresses aren't honoured on gRPC.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// filterGRPC rejects calls from addresses blocked by the filter
+func filterGRPC(ctx context.Context, filter *services.IPFilter, audit *services.AuditLog, metrics *services.MetricsCollector, method string) error {
+	ip := peerIP(ctx)
+	reason := filter.Check(ip)
+	if reason == "" {
+		return nil
+	}
+
+	log.Printf("[AUTH] Blocked grpc call from %s: %s", ip, reason)
+	if metrics != nil {
+		metrics.RecordIPBlocked("grpc", reason)
+	}
+	audit.Record(services.AuditEvent{Type: services.AuditIPBlocked, IP: ip, Route: "grpc " + method, Reason: reason, Details: map[string]string{"group": "grpc"}})
+	return status.Error(codes.PermissionDenied, "client address not allowed")
+}
+
+func unaryIPInterceptor(filter *services.IPFilter, audit *services.AuditLog, metrics *services.MetricsCollector) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := filterGRPC(ctx, filter, audit, metrics, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamIPInterceptor(filter *services.IPFilter, audit *services.AuditLog, metrics *services.MetricsCollector) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := filterGRPC(stream.Context(), filter, audit, metrics, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+func unaryAuthInterceptor(authenticator *auth.Authenticator, audit *services.AuditLog) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticateGRPC(ctx, authenticator, audit, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamAuthInterceptor(authenticator *auth.Authenticator, audit *services.AuditLog) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateGRPC(stream.Context(), authenticator, audit, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticatedStream carries the principal in its context
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
 // This is a placeholder for what would be generated from the proto file
 func (s *CollectorServer) SendEvent(ctx context.Context, req *Event) (*EventResponse, error) {
+	// The source picks the topic, so only event sources are accepted
+	if !eventSources[req.Source] {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown source %q", req.Source)
+	}
+
+	// Check the event against the schema of its source and version, and
+	// upgrade it to the current version
+	version, err := payloadSchemaVersion(req.Data)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	version = max(version, 1)
+	if err := s.schemas.Validate(req.Source, version, req.Data); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	upgraded, err := services.UpgradeEvent(req.Source, version, req.Data)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Check the event against the caller's user and device binding
+	principal, _ := auth.FromContext(ctx)
+	data, field, err := bindRawEvent(principal, upgraded)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if field != "" {
+		s.identityMismatch(ctx, req.Source, field, principal)
+		return nil, status.Error(codes.PermissionDenied, field+" does not match the authenticated identity")
+	}
+
+	// Apply the location rules like the HTTP location endpoints; dropped
+	// events are acknowledged but not published
+	if req.Source == "location" {
+		var verdict services.LocationVerdict
+		data, verdict, err = checkRawLocation(s.locations, s.metrics, data)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		switch verdict.Action {
+		case services.LocationReject:
+			return nil, status.Errorf(codes.InvalidArgument, "%s (rule %s)", verdict.Reason, verdict.Rule)
+		case services.LocationDrop:
+			return &EventResponse{Success: true}, nil
+		}
+	}
+
 	// Process the event
-	s.producer.SendEvent(req.Source, req.Data)
+	s.producer.SendEvent(req.Source, data)
+	recordSchemaVersion(s.metrics, req.Source, version)
 
 	// Return success response
 	return &EventResponse{Success: true}, nil
 }
 
+// identityMismatch logs, counts and audits a rejected event like the HTTP
+// handlers do
+func (s *CollectorServer) identityMismatch(ctx context.Context, source, field string, principal *auth.Principal) {
+	event := mismatchEvent(source, field, principal, s.metrics)
+	event.Principal, event.Subject, event.Tenant, event.Method = principal.Name, principal.Subject, principal.Tenant, principal.Method
+	event.IP, event.Route = peerIP(ctx), "grpc SendEvent"
+	s.audit.Record(event)
+}
+
 // Placeholder response type
 type EventResponse struct {
 	Success bool
@@ -1,19 +1,31 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
 	"github.com/nodelike/chronos-gateway/internal/models"
 	"github.com/nodelike/chronos-gateway/internal/services"
 )
 
-func HandleAndroidEvent(producer *services.KafkaProducer) gin.HandlerFunc {
+func HandleAndroidEvent(producer *services.KafkaProducer, schemas *services.SchemaRegistry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var event models.AndroidEvent
-		if err := c.ShouldBindJSON(&event); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := bindEvent(c, schemas, "android", &event); err != nil {
+			eventInvalid(c, err)
+			return
+		}
+		if !bindIdentity(c, "android", &event.UserID, &event.DeviceID) {
+			return
+		}
+		if !middleware.AllowEvents(c, map[string]int{event.DeviceID: 1}) {
 			return
 		}
 
@@ -24,16 +36,23 @@ func HandleAndroidEvent(producer *services.KafkaProducer) gin.HandlerFunc {
 
 		// Send to Kafka
 		producer.SendEvent("android", event.ToJSON())
+		recordSchemaVersion(middleware.GetMetricsFromContext(c), "android", event.OriginalSchemaVersion())
 
 		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
 	}
 }
 
-func HandleMacOSEvent(producer *services.KafkaProducer) gin.HandlerFunc {
+func HandleMacOSEvent(producer *services.KafkaProducer, schemas *services.SchemaRegistry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var event models.MacOSEvent
-		if err := c.ShouldBindJSON(&event); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := bindEvent(c, schemas, "macos", &event); err != nil {
+			eventInvalid(c, err)
+			return
+		}
+		if !bindIdentity(c, "macos", &event.UserID, &event.DeviceID) {
+			return
+		}
+		if !middleware.AllowEvents(c, map[string]int{event.DeviceID: 1}) {
 			return
 		}
 
@@ -44,16 +63,23 @@ func HandleMacOSEvent(producer *services.KafkaProducer) gin.HandlerFunc {
 
 		// Send to Kafka
 		producer.SendEvent("macos", event.ToJSON())
+		recordSchemaVersion(middleware.GetMetricsFromContext(c), "macos", event.OriginalSchemaVersion())
 
 		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
 	}
 }
 
-func HandleBrowserEvent(producer *services.KafkaProducer, minio *services.MinIOClient) gin.HandlerFunc {
+func HandleBrowserEvent(producer *services.KafkaProducer, store *services.MediaStore, validator *services.UploadValidator, schemas *services.SchemaRegistry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var event models.BrowserEvent
-		if err := c.ShouldBindJSON(&event); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := bindBrowserEvent(c, schemas, &event); err != nil {
+			eventInvalid(c, err)
+			return
+		}
+		if !bindIdentity(c, "browser", &event.UserID, &event.DeviceID) {
+			return
+		}
+		if !middleware.AllowEvents(c, map[string]int{event.DeviceID: 1}) {
 			return
 		}
 
@@ -62,19 +88,115 @@ func HandleBrowserEvent(producer *services.KafkaProducer, minio *services.MinIOC
 			event.Timestamp = time.Now()
 		}
 
-		// Process media files if present
-		if event.HasMedia && len(event.Media) > 0 {
-			objectName := event.UserID + "/" + event.DeviceID + "/" + time.Now().Format("20060102-150405") + ".bin"
-			err := minio.UploadFile(objectName, event.Media, event.MediaType)
+		// Validate every attachment before storing any of them
+		for i := range event.Media {
+			media := &event.Media[i]
+			if len(media.Data) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("media %d is empty", i)})
+				return
+			}
+			if media.ContentType == "" {
+				media.ContentType = event.MediaType
+			}
+
+			contentType, err := validator.Validate("browser", event.DeviceID, media.Filename, media.ContentType, media.Data)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload media"})
+				rejectUpload(c, "browser", err)
 				return
 			}
+			media.ContentType = contentType
+		}
+
+		// Upload attachments and replace their content with the object keys.
+		// The quota is taken for all of them up front and given back, with
+		// the attachments already stored, if any upload fails.
+		if len(event.Media) > 0 {
+			if !validKeySegment(event.UserID) || !validKeySegment(event.DeviceID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "user and device IDs may not contain \"/\" or start with \".\""})
+				return
+			}
+			if err := validator.Reserve("browser", event.DeviceID, len(event.Media)); err != nil {
+				rejectUpload(c, "browser", err)
+				return
+			}
+
+			event.HasMedia = true
+			prefix := mediaObjectPrefix(event.UserID, event.DeviceID)
+			for i := range event.Media {
+				media := &event.Media[i]
+				objectName := fmt.Sprintf("%s-%d%s", prefix, i, mediaExtension(media.Filename, media.ContentType))
+				upload, err := store.UploadMedia(c.Request.Context(), "browser", objectName, media.Data, media.ContentType)
+				if err != nil {
+					for _, stored := range event.Media[:i] {
+						store.DeleteMedia(context.Background(), stored.ObjectKey)
+					}
+					validator.Release("browser", event.DeviceID, len(event.Media))
+					uploadFailed(c, "browser", err, "failed to upload media")
+					return
+				}
+
+				media.Size = upload.Size
+				media.ObjectKey = upload.ObjectKey
+				media.ThumbnailKey = upload.ThumbnailKey
+				media.EXIF = upload.EXIF
+				media.Data = nil
+			}
 		}
 
 		// Send to Kafka
 		producer.SendEvent("browser", event.ToJSON())
+		recordSchemaVersion(middleware.GetMetricsFromContext(c), "browser", event.OriginalSchemaVersion())
 
-		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
+		c.JSON(http.StatusAccepted, gin.H{"status": "accepted", "media": event.Media})
+	}
+}
+
+// bindBrowserEvent reads a browser event either from a JSON body, with media
+// as base64 attachments, or from a multipart form carrying the event JSON in
+// the "event" field and one file part per attachment. The event JSON is
+// validated against the browser schema either way.
+func bindBrowserEvent(c *gin.Context, schemas *services.SchemaRegistry, event *models.BrowserEvent) error {
+	if c.ContentType() != "multipart/form-data" {
+		return bindEvent(c, schemas, "browser", event)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return fmt.Errorf("invalid multipart form: %w", err)
+	}
+
+	values := form.Value["event"]
+	if len(values) == 0 {
+		return errors.New("missing event field")
 	}
+	upgraded, _, err := prepareEvent(c, schemas, "browser", []byte(values[0]))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(upgraded, event); err != nil {
+		return fmt.Errorf("invalid event field: %w", err)
+	}
+
+	// Iterate file fields in a stable order so attachment indexes are predictable
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		for _, header := range form.File[field] {
+			data, err := readFormFile(header)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", header.Filename, err)
+			}
+			event.Media = append(event.Media, models.MediaAttachment{
+				Filename:    header.Filename,
+				ContentType: header.Header.Get("Content-Type"),
+				Data:        data,
+			})
+		}
+	}
+
+	return nil
 }
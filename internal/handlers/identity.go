@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// bindIdentity checks a payload's user and device ID against the caller's
+// credential, filling in IDs the payload leaves out. It writes a 403 response
+// and returns false if the payload names another user or device.
+func bindIdentity(c *gin.Context, source string, userID, deviceID *string) bool {
+	principal := middleware.GetPrincipal(c)
+	if principal == nil {
+		return true
+	}
+	field := principal.BindIdentity(userID, deviceID)
+	if field == "" {
+		return true
+	}
+
+	identityMismatch(c, source, field, principal)
+	c.JSON(http.StatusForbidden, gin.H{"error": field + " does not match the authenticated identity"})
+	return false
+}
+
+// identityMismatch logs and counts a rejected payload
+func identityMismatch(c *gin.Context, source, field string, principal *auth.Principal) {
+	event := mismatchEvent(source, field, principal, middleware.GetMetricsFromContext(c))
+	middleware.RecordAudit(c, event)
+}
+
+// mismatchEvent logs and counts a rejected payload and returns the audit
+// event to record for it
+func mismatchEvent(source, field string, principal *auth.Principal, metricsCollector *services.MetricsCollector) services.AuditEvent {
+	log.Printf("[AUTH] Rejected %s event from %s: %s does not match its credential", source, principal.Name, field)
+	if metricsCollector != nil {
+		metricsCollector.RecordIdentityMismatch(source, field, principal.Name)
+	}
+	return services.AuditEvent{Type: services.AuditIdentityMismatch, Reason: field + " does not match the credential", Details: map[string]string{"source": source}}
+}
+
+// bindRawEvent applies bindIdentity to an event given as a JSON object, as
+// sent over WebSocket and gRPC. It returns the event with missing IDs filled
+// in, and the mismatching field if there is one.
+func bindRawEvent(principal *auth.Principal, data []byte) ([]byte, string, error) {
+	if principal == nil || (principal.UserID == "" && principal.DeviceID == "") {
+		return data, "", nil
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil || event == nil {
+		return nil, "", errors.New("event must be a JSON object")
+	}
+	userID, _ := event["user_id"].(string)
+	deviceID, _ := event["device_id"].(string)
+	if field := principal.BindIdentity(&userID, &deviceID); field != "" {
+		return nil, field, nil
+	}
+	if event["user_id"] == userID && event["device_id"] == deviceID {
+		return data, "", nil
+	}
+
+	if userID != "" {
+		event["user_id"] = userID
+	}
+	if deviceID != "" {
+		event["device_id"] = deviceID
+	}
+	bound, err := json.Marshal(event)
+	return bound, "", err
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBindRawEvent(t *testing.T) {
+	bound := &auth.Principal{UserID: "user-1", DeviceID: "device-1"}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		event     string
+		want      map[string]interface{} // nil if the event is passed through unchanged
+		field     string
+		wantErr   bool
+	}{
+		{name: "no principal", event: `{"user_id":"user-2"}`},
+		{name: "unbound principal", principal: &auth.Principal{Name: "agent"}, event: `{"user_id":"user-2"}`},
+		{name: "matching ids", principal: bound, event: `{"user_id":"user-1","device_id":"device-1"}`},
+		{name: "ids filled in", principal: bound, event: `{"value":1}`, want: map[string]interface{}{"user_id": "user-1", "device_id": "device-1", "value": float64(1)}},
+		{name: "other user", principal: bound, event: `{"user_id":"user-2"}`, field: "user_id"},
+		{name: "other device", principal: bound, event: `{"device_id":"device-2"}`, field: "device_id"},
+		{name: "not an object", principal: bound, event: `[1,2]`, wantErr: true},
+		{name: "null", principal: bound, event: `null`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, field, err := bindRawEvent(tt.principal, []byte(tt.event))
+			if (err != nil) != tt.wantErr || field != tt.field {
+				t.Fatalf("bindRawEvent() = %q, %v, want %q, wantErr %v", field, err, tt.field, tt.wantErr)
+			}
+			if err != nil || field != "" {
+				return
+			}
+			if tt.want == nil {
+				if string(data) != tt.event {
+					t.Fatalf("bindRawEvent() = %s, want unchanged", data)
+				}
+				return
+			}
+			var got map[string]interface{}
+			json.Unmarshal(data, &got)
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Fatalf("bindRawEvent() = %s, want %v", data, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCIdentityMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		code  codes.Code
+		field string // Field recorded in the audit log
+	}{
+		{name: "bound", event: `{"device_id":"device-1"}`, code: codes.OK},
+		{name: "other user", event: `{"user_id":"user-2"}`, code: codes.PermissionDenied, field: "user_id"},
+		{name: "other device", event: `{"device_id":"device-2"}`, code: codes.PermissionDenied, field: "device_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			audit, err := services.NewAuditLog(services.AuditConfig{File: path}, nil)
+			if err != nil {
+				t.Fatalf("NewAuditLog() = %v", err)
+			}
+			server := &CollectorServer{producer: services.NewKafkaProducer(nil, true), audit: audit}
+			principal := &auth.Principal{Name: "agent", UserID: "user-1", DeviceID: "device-1"}
+
+			_, err = server.SendEvent(auth.NewContext(context.Background(), principal), &Event{Source: "android", Data: []byte(tt.event)})
+			if status.Code(err) != tt.code {
+				t.Fatalf("SendEvent() = %v, want %v", err, tt.code)
+			}
+
+			data, _ := os.ReadFile(path)
+			if tt.field == "" {
+				if len(data) != 0 {
+					t.Fatalf("audit log = %s, want nothing", data)
+				}
+				return
+			}
+			var event services.AuditEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatalf("audit log = %s: %v", data, err)
+			}
+			if event.Type != services.AuditIdentityMismatch || event.Principal != "agent" || !strings.HasPrefix(event.Reason, tt.field) || event.Details["source"] != "android" {
+				t.Fatalf("audit event = %+v", event)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -12,13 +15,28 @@ import (
 )
 
 // HandleLocationEvent processes location data from React Native Background Geolocation
-func HandleLocationEvent(producer *services.KafkaProducer) gin.HandlerFunc {
+func HandleLocationEvent(producer *services.KafkaProducer, validator *services.LocationValidator, schemas *services.SchemaRegistry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		metricsCollector := middleware.GetMetricsFromContext(c)
 
 		var event models.LocationEvent
-		if err := c.ShouldBindJSON(&event); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := bindEvent(c, schemas, "location", &event); err != nil {
+			eventInvalid(c, err)
+			return
+		}
+		if !bindIdentity(c, "location", &event.UserID, &event.DeviceID) {
+			return
+		}
+		verdict := checkLocation(c, validator, &event)
+		if verdict.Action == services.LocationReject {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": verdict.Reason, "rule": verdict.Rule})
+			return
+		}
+		if !middleware.AllowEvents(c, map[string]int{event.DeviceID: 1}) {
+			return
+		}
+		if verdict.Action == services.LocationDrop {
+			c.JSON(http.StatusAccepted, gin.H{"status": "dropped", "reason": verdict.Reason, "rule": verdict.Rule})
 			return
 		}
 
@@ -40,28 +58,67 @@ func HandleLocationEvent(producer *services.KafkaProducer) gin.HandlerFunc {
 			metricsCollector.RecordLocationEvent(event.EventType, "android", latency)
 		}
 		producer.SendEvent("location", event.ToJSON())
+		recordSchemaVersion(metricsCollector, "location", event.OriginalSchemaVersion())
 
 		c.JSON(http.StatusAccepted, gin.H{"status": "accepted"})
 	}
 }
 
-// HandleBatchLocationEvents processes batched location data
-func HandleBatchLocationEvents(producer *services.KafkaProducer) gin.HandlerFunc {
+// HandleBatchLocationEvents processes batched location data. An event that
+// fails a reject rule fails the whole batch; dropped events are left out.
+// Each event is validated against the location schema.
+func HandleBatchLocationEvents(producer *services.KafkaProducer, validator *services.LocationValidator, schemas *services.SchemaRegistry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get metrics collector from the context
 		metricsCollector := middleware.GetMetricsFromContext(c)
 
-		var events []models.LocationEvent
-		if err := c.ShouldBindJSON(&events); err != nil {
+		var raw []json.RawMessage
+		if err := c.ShouldBindJSON(&raw); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		events := make([]models.LocationEvent, len(raw))
+		for i, data := range raw {
+			upgraded, _, err := prepareEvent(c, schemas, "location", data)
+			if err != nil {
+				eventInvalid(c, atIndex(err, i))
+				return
+			}
+			if err := json.Unmarshal(upgraded, &events[i]); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("event %d: %v", i, err)})
+				return
+			}
+		}
 
 		if len(events) == 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "empty batch"})
 			return
 		}
 
+		// Reject the whole batch if any event names someone else or is
+		// physically impossible
+		devices := make(map[string]int)
+		dropped := make(map[int]bool)
+		for i := range events {
+			if !bindIdentity(c, "location", &events[i].UserID, &events[i].DeviceID) {
+				return
+			}
+			verdict := checkLocation(c, validator, &events[i])
+			switch verdict.Action {
+			case services.LocationReject:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": verdict.Reason, "rule": verdict.Rule, "index": i})
+				return
+			case services.LocationDrop:
+				dropped[i] = true
+			}
+			devices[events[i].DeviceID]++
+		}
+
+		// Every point counts against the event budget, dropped ones included
+		if !middleware.AllowEvents(c, devices) {
+			return
+		}
+
 		// Record batch size
 		if metricsCollector != nil {
 			metricsCollector.RecordBatchSize("android", len(events))
@@ -72,6 +129,10 @@ func HandleBatchLocationEvents(producer *services.KafkaProducer) gin.HandlerFunc
 
 		// Process each event in the batch
 		for i := range events {
+			if dropped[i] {
+				continue
+			}
+
 			// Set timestamp if not provided
 			if events[i].Timestamp.IsZero() {
 				events[i].Timestamp = receivedTime
@@ -96,11 +157,75 @@ func HandleBatchLocationEvents(producer *services.KafkaProducer) gin.HandlerFunc
 
 			// Send to Kafka
 			producer.SendEvent("location", events[i].ToJSON())
+			recordSchemaVersion(metricsCollector, "location", events[i].OriginalSchemaVersion())
 		}
 
-		c.JSON(http.StatusAccepted, gin.H{
+		response := gin.H{
 			"status": "accepted",
-			"count":  len(events),
-		})
+			"count":  len(events) - len(dropped),
+		}
+		if len(dropped) > 0 {
+			response["dropped"] = len(dropped)
+		}
+		c.JSON(http.StatusAccepted, response)
+	}
+}
+
+// checkLocation applies the validation rules to an event, annotates it with
+// the flagged rules and counts every broken rule
+func checkLocation(c *gin.Context, validator *services.LocationValidator, event *models.LocationEvent) services.LocationVerdict {
+	return applyLocationRules(validator, middleware.GetMetricsFromContext(c), event)
+}
+
+// checkRawLocation applies the validation rules to a raw location event
+// from the WebSocket or gRPC path. Fields the model doesn't know are kept,
+// and quality_flags is replaced with the flagged rules.
+func checkRawLocation(validator *services.LocationValidator, metricsCollector *services.MetricsCollector, data []byte) ([]byte, services.LocationVerdict, error) {
+	var event models.LocationEvent
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, services.LocationVerdict{}, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, services.LocationVerdict{}, err
+	}
+	verdict := applyLocationRules(validator, metricsCollector, &event)
+
+	delete(fields, "quality_flags")
+	if len(verdict.Flags) > 0 {
+		fields["quality_flags"] = verdict.Flags
+	}
+	data, err := json.Marshal(fields)
+	return data, verdict, err
+}
+
+func applyLocationRules(validator *services.LocationValidator, metricsCollector *services.MetricsCollector, event *models.LocationEvent) services.LocationVerdict {
+	// Only the gateway sets quality flags
+	event.QualityFlags = nil
+	verdict := validator.Check(event)
+	event.QualityFlags = verdict.Flags
+
+	if metricsCollector != nil {
+		for _, flag := range verdict.Flags {
+			metricsCollector.RecordLocationRejection(flag, services.LocationFlag)
+		}
+		if verdict.Action == services.LocationReject || verdict.Action == services.LocationDrop {
+			metricsCollector.RecordLocationRejection(verdict.Rule, verdict.Action)
+		}
+	}
+	return verdict
+}
+
+// atIndex prefixes the field paths of a schema error with the event's
+// position in a batch
+func atIndex(err error, index int) error {
+	var schemaErr *services.SchemaError
+	if !errors.As(err, &schemaErr) {
+		return fmt.Errorf("event %d: %w", index, err)
+	}
+	fields := make([]services.FieldError, len(schemaErr.Fields))
+	for i, field := range schemaErr.Fields {
+		fields[i] = services.FieldError{Path: fmt.Sprintf("/%d%s", index, field.Path), Message: field.Message}
 	}
+	return &services.SchemaError{Source: schemaErr.Source, Version: schemaErr.Version, Fields: fields}
 }
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nodelike/chronos-gateway/internal/services"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testLocationValidator(t *testing.T) *services.LocationValidator {
+	t.Helper()
+	validator, err := services.NewLocationValidator(map[string]string{services.RuleNullIsland: services.LocationDrop}, 100)
+	if err != nil {
+		t.Fatalf("NewLocationValidator() = %v", err)
+	}
+	return validator
+}
+
+func TestCheckRawLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		action  string
+		flags   []string // quality_flags of the returned event
+		wantErr bool
+	}{
+		{name: "valid", event: `{"latitude":52.5,"longitude":13.4,"accuracy":5,"extra":"kept"}`},
+		{name: "client flags removed", event: `{"latitude":52.5,"longitude":13.4,"quality_flags":["trusted"],"extra":"kept"}`},
+		{name: "flagged", event: `{"latitude":52.5,"longitude":13.4,"heading":-1,"accuracy":500,"extra":"kept"}`, action: services.LocationFlag, flags: []string{services.RuleHeading, services.RuleMaxAccuracy}},
+		{name: "dropped", event: `{"latitude":0,"longitude":0,"extra":"kept"}`, action: services.LocationDrop},
+		{name: "rejected", event: `{"latitude":91,"longitude":13.4,"heading":-1,"extra":"kept"}`, action: services.LocationReject, flags: []string{services.RuleHeading}},
+		{name: "wrong type", event: `{"latitude":"north"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, verdict, err := checkRawLocation(testLocationValidator(t), nil, []byte(tt.event))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRawLocation() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if verdict.Action != tt.action {
+				t.Fatalf("verdict = %+v, want action %q", verdict, tt.action)
+			}
+
+			var event struct {
+				Extra        string   `json:"extra"`
+				QualityFlags []string `json:"quality_flags"`
+			}
+			json.Unmarshal(data, &event)
+			if event.Extra != "kept" || len(event.QualityFlags) != len(tt.flags) {
+				t.Fatalf("checkRawLocation() = %s, want flags %v", data, tt.flags)
+			}
+			for i, flag := range tt.flags {
+				if event.QualityFlags[i] != flag {
+					t.Fatalf("checkRawLocation() = %s, want flags %v", data, tt.flags)
+				}
+			}
+		})
+	}
+}
+
+func TestRawLocationRules(t *testing.T) {
+	validator := testLocationValidator(t)
+	producer := services.NewKafkaProducer(nil, true)
+	conn := dialWebSocket(t, WebSocketHandler(producer, nil, nil, validator))
+	server := &CollectorServer{producer: producer, locations: validator}
+
+	tests := []struct {
+		name   string
+		event  map[string]interface{}
+		status string // WebSocket acknowledgement
+		rule   string
+		code   codes.Code
+	}{
+		{name: "valid", event: map[string]interface{}{"latitude": 52.5, "longitude": 13.4}, status: "received", code: codes.OK},
+		{name: "flagged", event: map[string]interface{}{"latitude": 52.5, "longitude": 13.4, "speed": -1}, status: "received", code: codes.OK},
+		{name: "dropped", event: map[string]interface{}{"latitude": 0, "longitude": 0}, status: "dropped", rule: services.RuleNullIsland, code: codes.OK},
+		{name: "rejected", event: map[string]interface{}{"latitude": 52.5, "longitude": 181}, status: "rejected", rule: services.RuleLongitude, code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event["source"] = "location"
+			if err := conn.WriteJSON(tt.event); err != nil {
+				t.Fatalf("WriteJSON() = %v", err)
+			}
+			var response map[string]interface{}
+			if err := conn.ReadJSON(&response); err != nil {
+				t.Fatalf("ReadJSON() = %v", err)
+			}
+			if response["status"] != tt.status || (tt.rule != "" && response["rule"] != tt.rule) {
+				t.Fatalf("response = %v, want status %q rule %q", response, tt.status, tt.rule)
+			}
+
+			data, _ := json.Marshal(tt.event)
+			if _, err := server.SendEvent(context.Background(), &Event{Source: "location", Data: data}); status.Code(err) != tt.code {
+				t.Fatalf("SendEvent() = %v, want %v", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/models"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+const (
+	defaultLinkExpiry = 15 * time.Minute
+	maxLinkExpiry     = 7 * 24 * time.Hour
+)
+
+// ownedObjectKey extracts the object key from the *key route parameter and
+// checks it lies under the prefix the caller's credential is bound to:
+// userID/deviceID/, or userID/ for credentials bound to a user only. Unlike
+// uploads, the X-User-ID and X-Device-ID headers play no part, so callers
+// without a binding can't read or delete anyone's objects.
+func ownedObjectKey(c *gin.Context) (string, bool) {
+	principal := middleware.GetPrincipal(c)
+	if principal == nil || principal.UserID == "" || !validKeySegment(principal.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "media access requires a credential bound to a user"})
+		return "", false
+	}
+	prefix := principal.UserID + "/"
+	if principal.DeviceID != "" {
+		prefix += principal.DeviceID + "/"
+	}
+
+	key, ok := cleanObjectKey(c.Param("key"))
+	if !ok || !strings.HasPrefix(key, prefix) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+		return "", false
+	}
+	return key, true
+}
+
+// cleanObjectKey normalizes a key taken from a URL path, rejecting keys that
+// are empty or contain relative segments
+func cleanObjectKey(raw string) (string, bool) {
+	key := strings.TrimPrefix(raw, "/")
+	if key == "" || path.Clean(key) != key || strings.Contains(key, "..") {
+		return "", false
+	}
+	return key, true
+}
+
+// inlineMediaTypes are served for display in the browser. Everything else,
+// including HTML and SVG that would run on the gateway's origin, is served
+// as a download.
+var inlineMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"audio/mpeg": true,
+	"audio/mp4":  true,
+	"audio/ogg":  true,
+	"audio/webm": true,
+	"audio/wav":  true,
+	"video/mp4":  true,
+	"video/webm": true,
+	"video/ogg":  true,
+}
+
+// serveObject streams an object with support for HEAD, Range and
+// conditional requests. Browsers may not sniff the type, and only
+// inlineMediaTypes are displayed inline.
+func serveObject(c *gin.Context, store *services.MediaStore, key string) {
+	object, info, err := store.GetFile(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, services.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read object"})
+		return
+	}
+	defer object.Close()
+
+	if info.ContentType != "" {
+		c.Header("Content-Type", info.ContentType)
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	mediaType, _, _ := mime.ParseMediaType(info.ContentType)
+	if !inlineMediaTypes[mediaType] {
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}))
+	}
+	if info.ETag != "" {
+		c.Header("ETag", `"`+info.ETag+`"`)
+	}
+	http.ServeContent(c.Writer, c.Request, path.Base(key), info.LastModified, object)
+}
+
+// MediaGetHandler serves GET and HEAD for the caller's own objects
+func MediaGetHandler(store *services.MediaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := ownedObjectKey(c)
+		if !ok {
+			return
+		}
+		serveObject(c, store, key)
+	}
+}
+
+// MediaDeleteHandler deletes one of the caller's objects with its thumbnail
+// and announces the deletion on the media topic
+func MediaDeleteHandler(producer *services.KafkaProducer, store *services.MediaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := ownedObjectKey(c)
+		if !ok {
+			return
+		}
+
+		// The source the file was uploaded under is kept with the object
+		info, err := store.StatFile(c.Request.Context(), key)
+		var thumbnailKey string
+		if err == nil {
+			thumbnailKey, err = store.DeleteMedia(c.Request.Context(), key)
+		}
+		if err != nil {
+			if errors.Is(err, services.ErrObjectNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete object"})
+			return
+		}
+
+		// Uploads are stored as userID/deviceID/name
+		var userID, deviceID string
+		if parts := strings.SplitN(key, "/", 3); len(parts) == 3 {
+			userID, deviceID = parts[0], parts[1]
+		}
+		event := models.MediaEvent{
+			DeviceID:     deviceID,
+			UserID:       userID,
+			EventType:    "deleted",
+			Source:       info.Metadata[services.MetaSource],
+			Timestamp:    time.Now(),
+			ContentType:  info.ContentType,
+			Size:         info.Size,
+			ObjectKey:    key,
+			ThumbnailKey: thumbnailKey,
+		}
+		producer.SendEvent("media", event.ToJSON())
+
+		c.JSON(http.StatusOK, gin.H{"status": "deleted", "path": key})
+	}
+}
+
+// MediaLinkHandler issues a time-limited download link for one of the
+// caller's objects. The lifetime comes from ?expires_in= in seconds.
+func MediaLinkHandler(store *services.MediaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := ownedObjectKey(c)
+		if !ok {
+			return
+		}
+
+		expiry := defaultLinkExpiry
+		if raw := c.Query("expires_in"); raw != "" {
+			seconds, err := strconv.Atoi(raw)
+			if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxLinkExpiry {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be between 1 and 604800 seconds"})
+				return
+			}
+			expiry = time.Duration(seconds) * time.Second
+		}
+
+		if _, err := store.StatFile(c.Request.Context(), key); err != nil {
+			if errors.Is(err, services.ErrObjectNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read object"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+		url, err := store.PresignGet(ctx, key, expiry)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign link"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"url":        url,
+			"path":       key,
+			"expires_at": time.Now().Add(expiry).UTC(),
+		})
+	}
+}
+
+// SignedMediaHandler serves objects through gateway-signed links. It is
+// registered without authentication; the signature is the credential.
+func SignedMediaHandler(store *services.MediaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := cleanObjectKey(c.Param("key"))
+		if !ok || !store.VerifySignedLink(key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid or expired link"})
+			return
+		}
+		serveObject(c, store, key)
+	}
+}
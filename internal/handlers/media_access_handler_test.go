@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// mediaRouter serves the media endpoints to requests made as principal
+func mediaRouter(store *services.MediaStore, principal *auth.Principal) *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if principal != nil {
+			c.Set(middleware.PrincipalKey, principal)
+		}
+	})
+	producer := services.NewKafkaProducer(nil, true)
+	router.GET("/v1/media/*key", MediaGetHandler(store))
+	router.DELETE("/v1/media/*key", MediaDeleteHandler(producer, store))
+	return router
+}
+
+func putObject(t *testing.T, storage services.Storage, key string) {
+	t.Helper()
+	data := []byte("data")
+	_, err := storage.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), services.PutOptions{
+		ContentType: "image/jpeg",
+		Metadata:    map[string]string{services.MetaSource: "upload"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMediaAccessOwnership(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		headers   map[string]string
+		key       string
+		status    int
+	}{
+		{name: "bound device", principal: &auth.Principal{UserID: "user-1", DeviceID: "device-1"}, key: "user-1/device-1/a.jpg", status: http.StatusOK},
+		{name: "bound user, any of its devices", principal: &auth.Principal{UserID: "user-1"}, key: "user-1/device-1/a.jpg", status: http.StatusOK},
+		{name: "other device", principal: &auth.Principal{UserID: "user-1", DeviceID: "device-2"}, key: "user-1/device-1/a.jpg", status: http.StatusNotFound},
+		{name: "other user", principal: &auth.Principal{UserID: "user-2"}, key: "user-1/device-1/a.jpg", status: http.StatusNotFound},
+		{
+			name:      "unbound key naming the owner in headers",
+			principal: &auth.Principal{Name: "unbound"},
+			headers:   map[string]string{"X-User-ID": "user-1", "X-Device-ID": "device-1"},
+			key:       "user-1/device-1/a.jpg",
+			status:    http.StatusForbidden,
+		},
+		{name: "no credential", headers: map[string]string{"X-User-ID": "user-1", "X-Device-ID": "device-1"}, key: "user-1/device-1/a.jpg", status: http.StatusForbidden},
+		{name: "relative path", principal: &auth.Principal{UserID: "user-1", DeviceID: "device-1"}, key: "user-1/device-1/../../user-2/device-1/a.jpg", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := services.NewMemoryStorage(nil)
+			putObject(t, storage, "user-1/device-1/a.jpg")
+			router := mediaRouter(services.NewMediaStore(storage, nil, nil, 0), tt.principal)
+
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				request := httptest.NewRequest(method, "/v1/media/"+tt.key, nil)
+				for name, value := range tt.headers {
+					request.Header.Set(name, value)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, request)
+				if recorder.Code != tt.status {
+					t.Fatalf("%s status = %d, want %d: %s", method, recorder.Code, tt.status, recorder.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestMediaDeleteRemovesThumbnail(t *testing.T) {
+	storage := services.NewMemoryStorage(nil)
+	putObject(t, storage, "user-1/device-1/a.jpg")
+	putObject(t, storage, "user-1/device-1/a.jpg.thumb.jpg")
+	putObject(t, storage, "user-1/device-1/a.png")
+	putObject(t, storage, "user-1/device-1/a.png.thumb.jpg")
+	putObject(t, storage, "user-1/device-1/b.jpg")
+	router := mediaRouter(services.NewMediaStore(storage, nil, nil, 0), &auth.Principal{UserID: "user-1", DeviceID: "device-1"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v1/media/user-1/device-1/a.jpg", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	for key, want := range map[string]error{
+		"user-1/device-1/a.jpg":           services.ErrObjectNotFound,
+		"user-1/device-1/a.jpg.thumb.jpg": services.ErrObjectNotFound,
+		"user-1/device-1/a.png":           nil,
+		"user-1/device-1/a.png.thumb.jpg": nil,
+		"user-1/device-1/b.jpg":           nil,
+	} {
+		if _, err := storage.Stat(context.Background(), key); !errors.Is(err, want) {
+			t.Errorf("Stat(%s) = %v, want %v", key, err, want)
+		}
+	}
+}
+
+func TestServeObjectHeaders(t *testing.T) {
+	tests := []struct {
+		contentType string
+		disposition string
+	}{
+		{contentType: "image/jpeg"},
+		{contentType: "video/mp4; codecs=avc1"},
+		{contentType: "text/html", disposition: `attachment; filename=a.bin`},
+		{contentType: "image/svg+xml", disposition: `attachment; filename=a.bin`},
+		{contentType: "application/pdf", disposition: `attachment; filename=a.bin`},
+		{contentType: "", disposition: `attachment; filename=a.bin`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			storage := services.NewMemoryStorage(nil)
+			data := []byte("<html><script>alert(1)</script></html>")
+			storage.Put(context.Background(), "user-1/device-1/a.bin", bytes.NewReader(data), int64(len(data)), services.PutOptions{ContentType: tt.contentType})
+			router := mediaRouter(services.NewMediaStore(storage, nil, nil, 0), &auth.Principal{UserID: "user-1", DeviceID: "device-1"})
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/media/user-1/device-1/a.bin", nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+			}
+			if got := recorder.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Fatalf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+			if got := recorder.Header().Get("Content-Disposition"); got != tt.disposition {
+				t.Fatalf("Content-Disposition = %q, want %q", got, tt.disposition)
+			}
+		})
+	}
+}
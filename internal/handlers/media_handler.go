@@ -1,79 +1,291 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/models"
 	"github.com/nodelike/chronos-gateway/internal/services"
+	"github.com/nodelike/chronos-gateway/internal/utils"
 )
 
-func MediaUploadHandler(minio *services.MinIOClient) gin.HandlerFunc {
+func MediaUploadHandler(producer *services.KafkaProducer, store *services.MediaStore, validator *services.UploadValidator) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get user identification from headers or query
-		userID := c.GetHeader("X-User-ID")
-		if userID == "" {
-			userID = c.Query("user_id")
-			if userID == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "user ID required"})
-				return
-			}
+		userID, deviceID, ok := mediaIdentity(c)
+		if !ok {
+			return
 		}
 
-		// Get device ID
-		deviceID := c.GetHeader("X-Device-ID")
-		if deviceID == "" {
-			deviceID = c.Query("device_id")
-			if deviceID == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "device ID required"})
-				return
-			}
+		// The route picks the upload policy
+		source, ok := uploadSource(c, validator, c.Param("source"))
+		if !ok {
+			return
+		}
+
+		// Stop reading bodies that can't hold a file within the size limit
+		if policy, ok := validator.Policy(source); ok && policy.MaxSize > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, policy.MaxSize+maxFormOverhead)
 		}
 
-		// Get file from form
+		// Get file from form. Large files are spooled to disk, not memory.
 		file, err := c.FormFile("file")
 		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rejectUpload(c, source, services.ErrUploadTooLarge)
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": "no file provided"})
 			return
 		}
 
-		// Open the file
-		fileContent, err := file.Open()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open file"})
+		// Reject oversized files before reading them
+		if err := validator.CheckSize(source, file.Size); err != nil {
+			rejectUpload(c, source, err)
 			return
 		}
-		defer fileContent.Close()
 
-		// Read file content
-		buffer := make([]byte, file.Size)
-		_, err = fileContent.Read(buffer)
+		content, err := file.Open()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
 			return
 		}
+		defer content.Close()
 
-		// Generate object name
-		contentType := file.Header.Get("Content-Type")
-		extension := filepath.Ext(file.Filename)
-		if extension == "" {
-			extension = ".bin"
+		// Validate the real content type against the source policy
+		head, err := readHead(content)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
+			return
+		}
+		contentType, err := validator.ValidateHead(source, deviceID, file.Filename, file.Header.Get("Content-Type"), head, file.Size)
+		if err != nil {
+			rejectUpload(c, source, err)
+			return
 		}
 
-		objectName := userID + "/" + deviceID + "/" + time.Now().Format("20060102-150405") + extension
+		// Generate object name
+		objectName := mediaObjectPrefix(userID, deviceID) + mediaExtension(file.Filename, contentType)
 
-		// Upload to MinIO
-		err = minio.UploadFile(objectName, buffer, contentType)
+		// Store the file, stripping image metadata where configured. The
+		// file only counts against the quota if it was stored.
+		if err := validator.Reserve(source, deviceID, 1); err != nil {
+			rejectUpload(c, source, err)
+			return
+		}
+		upload, err := store.UploadMediaStream(c.Request.Context(), source, objectName, content, file.Size, contentType)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload file"})
+			validator.Release(source, deviceID, 1)
+			uploadFailed(c, source, err, "failed to upload file")
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"status": "uploaded",
-			"file":   file.Filename,
-			"path":   objectName,
+		// Announce the stored file
+		event := models.MediaEvent{
+			DeviceID:     deviceID,
+			UserID:       userID,
+			EventType:    "uploaded",
+			Source:       source,
+			Timestamp:    time.Now(),
+			Filename:     file.Filename,
+			ContentType:  contentType,
+			Size:         upload.Size,
+			ObjectKey:    upload.ObjectKey,
+			ThumbnailKey: upload.ThumbnailKey,
+			EXIF:         upload.EXIF,
+		}
+		producer.SendEvent("media", event.ToJSON())
+
+		// Staged uploads are accepted but not yet in the backend
+		status, state := http.StatusOK, "uploaded"
+		if upload.Staged {
+			status, state = http.StatusAccepted, "staged"
+		}
+
+		c.JSON(status, gin.H{
+			"status":    state,
+			"file":      file.Filename,
+			"path":      objectName,
+			"type":      contentType,
+			"thumbnail": upload.ThumbnailKey,
 		})
 	}
 }
+
+// mediaIdentity reads the user and device ID from the X-User-ID/X-Device-ID
+// headers or the user_id/device_id query parameters, falling back to the IDs
+// the caller's credential is bound to. It writes an error response and
+// returns false if either is missing or names someone else.
+func mediaIdentity(c *gin.Context) (string, string, bool) {
+	// Get user identification from headers or query
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		userID = c.Query("user_id")
+	}
+
+	// Get device ID
+	deviceID := c.GetHeader("X-Device-ID")
+	if deviceID == "" {
+		deviceID = c.Query("device_id")
+	}
+
+	if !bindIdentity(c, "media", &userID, &deviceID) {
+		return "", "", false
+	}
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user ID required"})
+		return "", "", false
+	}
+	if deviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device ID required"})
+		return "", "", false
+	}
+	// The IDs become the first two segments of object keys, and keys
+	// starting with "." are the gateway's own
+	if !validKeySegment(userID) || !validKeySegment(deviceID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user and device IDs may not contain \"/\" or start with \".\""})
+		return "", "", false
+	}
+
+	return userID, deviceID, true
+}
+
+func validKeySegment(id string) bool {
+	return !strings.Contains(id, "/") && !strings.HasPrefix(id, ".")
+}
+
+// uploadSource checks that the caller may upload under a policy source and
+// returns its name. An empty name is the default "upload" source, open to
+// every caller of the endpoint. Other sources need a policy of their own and,
+// for credentials limited by scopes, a "sources/<source>" scope.
+func uploadSource(c *gin.Context, validator *services.UploadValidator, source string) (string, bool) {
+	source = strings.ToLower(source)
+	if source == "" || source == "upload" {
+		return "upload", true
+	}
+	if !validator.Defined(source) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upload source " + source})
+		return "", false
+	}
+
+	principal := middleware.GetPrincipal(c)
+	if principal != nil && !principal.Allows("sources/"+source) {
+		middleware.RecordAudit(c, services.AuditEvent{Type: services.AuditScopeDenied, Reason: "source " + source + " not in scopes"})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to upload to " + source})
+		return "", false
+	}
+	return source, true
+}
+
+// rejectUpload maps an upload validation error to its HTTP status and records
+// the rejection
+func rejectUpload(c *gin.Context, source string, err error) {
+	status, reason := http.StatusBadRequest, "invalid"
+	switch {
+	case errors.Is(err, services.ErrUploadTooLarge):
+		status, reason = http.StatusRequestEntityTooLarge, "too_large"
+	case errors.Is(err, services.ErrImageTooLarge):
+		status, reason = http.StatusRequestEntityTooLarge, "too_many_pixels"
+	case errors.Is(err, services.ErrUnsupportedMediaType):
+		status, reason = http.StatusUnsupportedMediaType, "unsupported_type"
+	case errors.Is(err, services.ErrMediaTypeMismatch):
+		status, reason = http.StatusUnsupportedMediaType, "type_mismatch"
+	case errors.Is(err, services.ErrUploadQuotaExceeded):
+		status, reason = http.StatusTooManyRequests, "quota_exceeded"
+		c.Header("Retry-After", "3600")
+	}
+
+	if metricsCollector := middleware.GetMetricsFromContext(c); metricsCollector != nil {
+		metricsCollector.RecordUploadRejection(source, reason)
+	}
+	c.JSON(status, gin.H{"error": err.Error(), "reason": reason})
+}
+
+// uploadFailed reports an error from MediaStore.UploadMedia: images the
+// pipeline refuses are rejected uploads, anything else a storage failure
+func uploadFailed(c *gin.Context, source string, err error, message string) {
+	if errors.Is(err, services.ErrImageTooLarge) {
+		rejectUpload(c, source, err)
+		return
+	}
+	storeFailed(c, err, message)
+}
+
+// storeFailed reports a storage write error, distinguishing exhausted quotas
+// from backend failures
+func storeFailed(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrQuotaExceeded):
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrCircuitOpen):
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "storage temporarily unavailable"})
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "storage timed out"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// maxFormOverhead allows for the multipart headers and boundaries around an
+// uploaded file when limiting the request body
+const maxFormOverhead = 1 << 20
+
+// readHead reads the start of a file that the content type is sniffed from
+// and rewinds it
+func readHead(file io.ReadSeeker) ([]byte, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// readFormFile reads the full content of an uploaded multipart file
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// mediaObjectPrefix names uploads from a device by the time they arrived.
+// The nanoseconds and a random suffix keep uploads made in the same second
+// from overwriting each other.
+func mediaObjectPrefix(userID, deviceID string) string {
+	now := time.Now()
+	return fmt.Sprintf("%s/%s/%s-%09d-%s", userID, deviceID, now.Format("20060102-150405"), now.Nanosecond(), utils.GenerateID(8))
+}
+
+// mediaExtension picks an object extension from the filename, falling back to
+// the content type and finally to ".bin"
+func mediaExtension(filename, contentType string) string {
+	if extension := filepath.Ext(filename); extension != "" {
+		return extension
+	}
+	if contentType != "" {
+		if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+			return extensions[0]
+		}
+	}
+	return ".bin"
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testContext returns a context for a request made by principal, which may
+// be nil for unauthenticated requests
+func testContext(method, target string, principal *auth.Principal) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(method, target, nil)
+	if principal != nil {
+		c.Set(middleware.PrincipalKey, principal)
+	}
+	return c, recorder
+}
+
+func TestUploadSource(t *testing.T) {
+	validator := services.NewUploadValidator(map[string]services.UploadPolicy{
+		"default":   {MaxSize: 1024},
+		"recording": {AllowedTypes: []string{"video/*"}},
+	})
+
+	tests := []struct {
+		name      string
+		source    string
+		principal *auth.Principal
+		want      string
+		status    int
+	}{
+		{name: "default source", want: "upload"},
+		{name: "default source by name", source: "Upload", principal: &auth.Principal{Scopes: []string{"upload"}}, want: "upload"},
+		{name: "unscoped key", source: "recording", principal: &auth.Principal{}, want: "recording"},
+		{name: "source scope", source: "recording", principal: &auth.Principal{Scopes: []string{"upload", "sources/recording"}}, want: "recording"},
+		{name: "all sources", source: "recording", principal: &auth.Principal{Scopes: []string{"upload", "sources"}}, want: "recording"},
+		{name: "endpoint scope only", source: "recording", principal: &auth.Principal{Scopes: []string{"upload"}}, status: http.StatusForbidden},
+		{name: "other source scope", source: "recording", principal: &auth.Principal{Scopes: []string{"upload", "sources/browser"}}, status: http.StatusForbidden},
+		{name: "source without policy", source: "audit", principal: &auth.Principal{}, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, recorder := testContext(http.MethodPost, "/v1/upload", tt.principal)
+			got, ok := uploadSource(c, validator, tt.source)
+			if ok != (tt.status == 0) {
+				t.Fatalf("uploadSource() ok = %v, status %d", ok, recorder.Code)
+			}
+			if got != tt.want {
+				t.Fatalf("uploadSource() = %q, want %q", got, tt.want)
+			}
+			if tt.status != 0 && recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestMediaUploadHandler(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"
+	tests := []struct {
+		name    string
+		route   string
+		content string
+		status  int
+		source  string // Source recorded with the stored object
+	}{
+		{name: "stored", route: "/v1/upload", content: png, status: http.StatusOK, source: "upload"},
+		{name: "body over the size limit", route: "/v1/upload", content: png + strings.Repeat("x", 2<<20), status: http.StatusRequestEntityTooLarge},
+		{name: "source from the route", route: "/v1/upload/recording", content: png, status: http.StatusUnsupportedMediaType},
+		{name: "unknown source", route: "/v1/upload/audit", content: png, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := services.NewMemoryStorage(nil)
+			store := services.NewMediaStore(storage, nil, nil, 0)
+			validator := services.NewUploadValidator(map[string]services.UploadPolicy{
+				"default":   {MaxSize: 1 << 20},
+				"recording": {AllowedTypes: []string{"video/*"}},
+			})
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set(middleware.PrincipalKey, &auth.Principal{UserID: "user-1", DeviceID: "device-1"})
+			})
+			handler := MediaUploadHandler(services.NewKafkaProducer(nil, true), store, validator)
+			router.POST("/v1/upload", handler)
+			router.POST("/v1/upload/:source", handler)
+
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, _ := form.CreateFormFile("file", "a.png")
+			part.Write([]byte(tt.content))
+			form.Close()
+			request := httptest.NewRequest(http.MethodPost, tt.route, &body)
+			request.Header.Set("Content-Type", form.FormDataContentType())
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+			objects, _ := storage.List(context.Background(), "user-1/device-1/")
+			if tt.source == "" {
+				if len(objects) != 0 {
+					t.Fatalf("stored %v, want nothing", objects)
+				}
+				return
+			}
+			if len(objects) != 1 || objects[0].Size != int64(len(tt.content)) || objects[0].Metadata[services.MetaSource] != tt.source {
+				t.Fatalf("stored %+v, want one %d byte object from %s", objects, len(tt.content), tt.source)
+			}
+		})
+	}
+}
+
+var mediaPrefixPattern = regexp.MustCompile(`^user-1/device-1/\d{8}-\d{6}-\d{9}-[0-9a-f]{8}$`)
+
+func TestMediaObjectPrefix(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		prefix := mediaObjectPrefix("user-1", "device-1")
+		if !mediaPrefixPattern.MatchString(prefix) {
+			t.Fatalf("mediaObjectPrefix() = %q", prefix)
+		}
+		if seen[prefix] {
+			t.Fatalf("mediaObjectPrefix() repeated %q", prefix)
+		}
+		seen[prefix] = true
+	}
+}
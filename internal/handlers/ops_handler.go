@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// BuildInfoHandler reports the version the gateway was built from
+func BuildInfoHandler(version string) gin.HandlerFunc {
+	started := time.Now()
+	info := gin.H{
+		"version":    version,
+		"go_version": runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["module"] = build.Main.Path
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["revision"] = setting.Value
+			case "vcs.time":
+				info["revision_time"] = setting.Value
+			case "vcs.modified":
+				info["modified"] = setting.Value == "true"
+			}
+		}
+	}
+
+	return func(c *gin.Context) {
+		response := gin.H{"started_at": started, "uptime": time.Since(started).Round(time.Second).String()}
+		for key, value := range info {
+			response[key] = value
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// ConfigHandler serves the effective configuration, with secrets redacted
+// by the caller
+func ConfigHandler(redacted map[string]interface{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, redacted)
+	}
+}
+
+// TogglesHandler lists the runtime toggles
+func TogglesHandler(toggles *services.Toggles) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"toggles": toggles.List()})
+	}
+}
+
+// SetToggleHandler flips a runtime toggle, e.g. PUT /toggles/maintenance
+// with {"enabled": true}
+func SetToggleHandler(toggles *services.Toggles) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Enabled *bool `json:"enabled" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		state, err := toggles.Set(c.Param("name"), *request.Enabled)
+		if errors.Is(err, services.ErrUnknownToggle) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		auditAdminAction(c, "set_toggle", map[string]string{"toggle": state.Name, "enabled": strconv.FormatBool(state.Enabled)})
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// PprofHandler serves the net/http/pprof profiles under /debug/pprof/*name
+func PprofHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch strings.TrimPrefix(c.Param("name"), "/") {
+		case "cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			pprof.Index(c.Writer, c.Request)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// SchemaListHandler lists the event schemas payloads are validated against
+func SchemaListHandler(schemas *services.SchemaRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"schemas": schemas.List()})
+	}
+}
+
+// SchemaHandler serves one schema document, e.g. GET /v1/schemas/android/2
+func SchemaHandler(schemas *services.SchemaRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, err := strconv.Atoi(c.Param("version"))
+		info, ok := schemas.Info(c.Param("source"), version)
+		if err != nil || !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+			return
+		}
+		data, err := os.ReadFile(info.File)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read schema"})
+			return
+		}
+		c.Data(http.StatusOK, "application/schema+json", data)
+	}
+}
+
+// payloadSchemaVersion reads the schema_version field of a JSON object, 0
+// if it has none
+func payloadSchemaVersion(data []byte) (int, error) {
+	var versioned struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "schema_version" {
+			return 0, errors.New("schema_version must be a positive integer")
+		}
+		return 0, fmt.Errorf("invalid event: %w", err)
+	}
+	if versioned.SchemaVersion == nil {
+		return 0, nil
+	}
+	if *versioned.SchemaVersion <= 0 {
+		return 0, errors.New("schema_version must be a positive integer")
+	}
+	return *versioned.SchemaVersion, nil
+}
+
+// eventSchemaVersion finds the schema version of a payload: its
+// schema_version field, else the X-Schema-Version header, else 1
+func eventSchemaVersion(c *gin.Context, data []byte) (int, error) {
+	version, err := payloadSchemaVersion(data)
+	if err != nil || version > 0 {
+		return version, err
+	}
+	header := c.GetHeader("X-Schema-Version")
+	if header == "" {
+		return 1, nil
+	}
+	version, err = strconv.Atoi(header)
+	if err != nil || version <= 0 {
+		return 0, errors.New("X-Schema-Version must be a positive integer")
+	}
+	return version, nil
+}
+
+// bindEvent prepares a JSON body with prepareEvent and binds the upgraded
+// payload to event
+func bindEvent(c *gin.Context, schemas *services.SchemaRegistry, source string, event interface{}) error {
+	data, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	upgraded, _, err := prepareEvent(c, schemas, source, data)
+	if err != nil {
+		return err
+	}
+	return binding.JSON.BindBody(upgraded, event)
+}
+
+// prepareEvent checks a JSON payload against the schema of its source and
+// version, then upgrades it to the current version, which it returns along
+// with the version the payload was sent in. WebSocket sources are free-form.
+func prepareEvent(c *gin.Context, schemas *services.SchemaRegistry, source string, data []byte) ([]byte, int, error) {
+	version, err := eventSchemaVersion(c, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	metricsCollector := middleware.GetMetricsFromContext(c)
+	if err := schemas.Validate(source, version, data); err != nil {
+		var schemaErr *services.SchemaError
+		if errors.As(err, &schemaErr) && metricsCollector != nil {
+			metricsCollector.RecordSchemaRejection(schemaErr.Source, schemaErr.Version)
+		}
+		return nil, 0, err
+	}
+	upgraded, err := services.UpgradeEvent(source, version, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return upgraded, version, nil
+}
+
+// recordSchemaVersion counts a published event of a versioned source by the
+// version the client sent it in. Handlers call it once the event is
+// published, so rejected and throttled events aren't counted.
+func recordSchemaVersion(metricsCollector *services.MetricsCollector, source string, version int) {
+	if metricsCollector != nil && version > 0 && services.CurrentSchemaVersion(source) > 0 {
+		metricsCollector.RecordSchemaVersion(source, version)
+	}
+}
+
+// eventInvalid writes 422 with the failing fields for payloads that don't
+// match their schema, and 400 for anything else that can't be bound
+func eventInvalid(c *gin.Context, err error) {
+	var schemaErr *services.SchemaError
+	if errors.As(err, &schemaErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":   "event does not match schema",
+			"source":  schemaErr.Source,
+			"version": schemaErr.Version,
+			"fields":  schemaErr.Fields,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
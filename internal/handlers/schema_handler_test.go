@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nodelike/chronos-gateway/internal/models"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestPrepareEvent(t *testing.T) {
+	schemas, err := services.LoadSchemas("../../schemas", nil)
+	if err != nil {
+		t.Fatalf("LoadSchemas() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		header  string
+		data    string
+		version int
+		err     error
+		invalid bool // Wants a *services.SchemaError
+	}{
+		{name: "valid", source: "location", data: `{"latitude":1,"longitude":2}`, version: 1},
+		{name: "schema error", source: "location", data: `{"latitude":"north"}`, invalid: true},
+		{name: "version from header", source: "location", header: "2", data: `{"latitude":1,"longitude":2}`, err: services.ErrUnknownSchemaVersion},
+		{name: "source without schema", source: "media", data: `{}`, err: services.ErrNoSchema},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(http.MethodPost, "/v1/location", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("X-Schema-Version", tt.header)
+			}
+			_, version, err := prepareEvent(c, schemas, tt.source, []byte(tt.data))
+			var schemaErr *services.SchemaError
+			if tt.invalid != errors.As(err, &schemaErr) {
+				t.Fatalf("prepareEvent() = %v, want a schema error %v", err, tt.invalid)
+			}
+			if !tt.invalid && (!errors.Is(err, tt.err) || (tt.err == nil && err != nil)) {
+				t.Fatalf("prepareEvent() = %v, want %v", err, tt.err)
+			}
+			if version != tt.version {
+				t.Fatalf("prepareEvent() version = %d, want %d", version, tt.version)
+			}
+		})
+	}
+}
+
+func TestBindEventMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		metadata map[string]interface{} // Published metadata
+	}{
+		{name: "none", body: `{"latitude":1,"longitude":2}`, metadata: map[string]interface{}{"original_schema_version": float64(1)}},
+		{name: "client fields kept", body: `{"latitude":1,"longitude":2,"metadata":{"app":"agent","retries":2}}`, metadata: map[string]interface{}{"app": "agent", "retries": float64(2), "original_schema_version": float64(1)}},
+		{name: "version not forged", body: `{"latitude":1,"longitude":2,"metadata":{"original_schema_version":5}}`, metadata: map[string]interface{}{"original_schema_version": float64(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(http.MethodPost, "/v1/location", nil)
+			c.Request.Body = io.NopCloser(strings.NewReader(tt.body))
+			var event models.LocationEvent
+			if err := bindEvent(c, nil, "location", &event); err != nil {
+				t.Fatalf("bindEvent() = %v", err)
+			}
+
+			var published struct {
+				SchemaVersion int                    `json:"schema_version"`
+				Metadata      map[string]interface{} `json:"metadata"`
+			}
+			json.Unmarshal(event.ToJSON(), &published)
+			if published.SchemaVersion != 1 || len(published.Metadata) != len(tt.metadata) {
+				t.Fatalf("published %s, want metadata %v", event.ToJSON(), tt.metadata)
+			}
+			for key, value := range tt.metadata {
+				if published.Metadata[key] != value {
+					t.Fatalf("published %s, want metadata %v", event.ToJSON(), tt.metadata)
+				}
+			}
+		})
+	}
+}
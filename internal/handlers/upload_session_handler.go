@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/models"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+type openSessionRequest struct {
+	Filename    string            `json:"filename" binding:"required"`
+	ContentType string            `json:"content_type"`
+	Source      string            `json:"source"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+type completeSessionRequest struct {
+	TotalChunks int `json:"total_chunks" binding:"required"`
+}
+
+// UploadSessionOpenHandler starts a chunked upload session
+func UploadSessionOpenHandler(sessions *services.UploadSessions, validator *services.UploadValidator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, deviceID, ok := mediaIdentity(c)
+		if !ok {
+			return
+		}
+
+		var request openSessionRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		source, ok := uploadSource(c, validator, request.Source)
+		if !ok {
+			return
+		}
+		request.Source = source
+
+		// The content isn't known yet; the type is checked against chunk 0
+		contentType, err := validator.ValidateSession(request.Source, deviceID, request.Filename, request.ContentType)
+		if err != nil {
+			rejectUpload(c, request.Source, err)
+			return
+		}
+
+		session := &services.UploadSession{
+			UserID:      userID,
+			DeviceID:    deviceID,
+			Source:      request.Source,
+			Filename:    request.Filename,
+			ContentType: contentType,
+			Metadata:    request.Metadata,
+		}
+		if err := sessions.Open(c.Request.Context(), session); err != nil {
+			storeFailed(c, err, "failed to open upload session")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"session_id":   session.ID,
+			"content_type": session.ContentType,
+			"expires_at":   session.ExpiresAt,
+		})
+	}
+}
+
+// UploadSessionStatusHandler reports a session and the chunks received so far
+func UploadSessionStatusHandler(sessions *services.UploadSessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := loadSession(c, sessions)
+		if !ok {
+			return
+		}
+
+		received, size, err := sessions.Chunks(c.Request.Context(), session)
+		if err != nil {
+			storeFailed(c, err, "failed to list chunks")
+			return
+		}
+		if received == nil {
+			received = []int{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"session":  session,
+			"received": received,
+			"size":     size,
+		})
+	}
+}
+
+// UploadSessionChunkHandler stores one numbered chunk from the request body.
+// Chunks may be sent in any order, and resending an index replaces it.
+func UploadSessionChunkHandler(sessions *services.UploadSessions, validator *services.UploadValidator, maxChunkSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := loadSession(c, sessions)
+		if !ok {
+			return
+		}
+
+		index, err := strconv.Atoi(c.Param("index"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid chunk index"})
+			return
+		}
+
+		// Stop reading chunks past the chunk size limit, or past the size
+		// limit of the whole file if chunks have none
+		limit := maxChunkSize
+		if limit <= 0 {
+			if policy, ok := validator.Policy(session.Source); ok {
+				limit = policy.MaxSize
+			}
+		}
+		if limit > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge) && maxChunkSize > 0:
+				sessionFailed(c, services.ErrChunkTooLarge, "failed to read chunk")
+			case errors.As(err, &tooLarge):
+				rejectUpload(c, session.Source, services.ErrUploadTooLarge)
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read chunk"})
+			}
+			return
+		}
+
+		// The first chunk carries the magic bytes of the assembled file
+		if index == 0 {
+			if err := validator.CheckContent(session.Source, session.Filename, session.ContentType, data); err != nil {
+				rejectUpload(c, session.Source, err)
+				return
+			}
+		}
+
+		err = sessions.PutChunk(c.Request.Context(), session, index, data)
+		if errors.Is(err, services.ErrUploadTooLarge) {
+			rejectUpload(c, session.Source, err)
+			return
+		}
+		if err != nil && !errors.Is(err, services.ErrStaged) {
+			sessionFailed(c, err, "failed to store chunk")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "received",
+			"index":  index,
+			"size":   len(data),
+		})
+	}
+}
+
+// UploadSessionCompleteHandler assembles the chunks into one object and
+// announces it on the media topic
+func UploadSessionCompleteHandler(producer *services.KafkaProducer, sessions *services.UploadSessions, validator *services.UploadValidator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := loadSession(c, sessions)
+		if !ok {
+			return
+		}
+
+		var request completeSessionRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if session.CompletedAt == nil {
+			_, size, err := sessions.Chunks(c.Request.Context(), session)
+			if err != nil {
+				storeFailed(c, err, "failed to list chunks")
+				return
+			}
+			if err := validator.CheckSize(session.Source, size); err != nil {
+				rejectUpload(c, session.Source, err)
+				return
+			}
+			if err := validator.Reserve(session.Source, session.DeviceID, 1); err != nil {
+				rejectUpload(c, session.Source, err)
+				return
+			}
+		}
+
+		objectName := session.UserID + "/" + session.DeviceID + "/" + session.CreatedAt.Format("20060102-150405") + "-" + session.ID[:8] + mediaExtension(session.Filename, session.ContentType)
+		completed, err := sessions.Complete(c.Request.Context(), session, request.TotalChunks, objectName)
+		if err != nil {
+			if session.CompletedAt == nil {
+				validator.Release(session.Source, session.DeviceID, 1)
+			}
+			switch {
+			case errors.Is(err, services.ErrUploadTooLarge), errors.Is(err, services.ErrImageTooLarge),
+				errors.Is(err, services.ErrUnsupportedMediaType), errors.Is(err, services.ErrMediaTypeMismatch):
+				rejectUpload(c, session.Source, err)
+				return
+			}
+			sessionFailed(c, err, "failed to assemble upload")
+			return
+		}
+
+		// Retried completions don't announce the file again
+		if session.CompletedAt == nil {
+			event := models.MediaEvent{
+				DeviceID:     completed.DeviceID,
+				UserID:       completed.UserID,
+				EventType:    "uploaded",
+				Source:       completed.Source,
+				Timestamp:    time.Now(),
+				Filename:     completed.Filename,
+				ContentType:  completed.ContentType,
+				Size:         completed.Size,
+				ObjectKey:    completed.ObjectKey,
+				ThumbnailKey: completed.ThumbnailKey,
+				EXIF:         completed.EXIF,
+				Session: &models.MediaSession{
+					ID:          completed.ID,
+					Chunks:      completed.Chunks,
+					StartedAt:   completed.CreatedAt,
+					CompletedAt: *completed.CompletedAt,
+					Metadata:    completed.Metadata,
+				},
+			}
+			producer.SendEvent("media", event.ToJSON())
+		}
+
+		status, state := http.StatusOK, "uploaded"
+		if completed.Staged {
+			status, state = http.StatusAccepted, "staged"
+		}
+
+		c.JSON(status, gin.H{
+			"status":    state,
+			"file":      completed.Filename,
+			"path":      completed.ObjectKey,
+			"type":      completed.ContentType,
+			"size":      completed.Size,
+			"chunks":    completed.Chunks,
+			"thumbnail": completed.ThumbnailKey,
+		})
+	}
+}
+
+// UploadSessionAbortHandler discards a session and its chunks
+func UploadSessionAbortHandler(sessions *services.UploadSessions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := loadSession(c, sessions)
+		if !ok {
+			return
+		}
+
+		if err := sessions.Abort(c.Request.Context(), session); err != nil {
+			storeFailed(c, err, "failed to abort upload session")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "aborted", "session_id": session.ID})
+	}
+}
+
+// loadSession looks up the session in the URL for the calling user and
+// device, writing the error response if there is none
+func loadSession(c *gin.Context, sessions *services.UploadSessions) (*services.UploadSession, bool) {
+	userID, deviceID, ok := mediaIdentity(c)
+	if !ok {
+		return nil, false
+	}
+
+	session, err := sessions.Get(c.Request.Context(), userID, deviceID, c.Param("id"))
+	if err != nil {
+		sessionFailed(c, err, "failed to load upload session")
+		return nil, false
+	}
+	return session, true
+}
+
+// sessionFailed maps upload session errors to HTTP statuses, falling back to
+// the storage error mapping
+func sessionFailed(c *gin.Context, err error, message string) {
+	var missing *services.MissingChunksError
+	switch {
+	case errors.As(err, &missing):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "missing": missing.Missing})
+	case errors.Is(err, services.ErrSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrSessionExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrSessionCompleted):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrChunkOutOfRange):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrChunkTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	default:
+		storeFailed(c, err, message)
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestUploadSessionChunkLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxChunkSize int64
+		chunk        int
+		status       int
+	}{
+		{name: "within the file limit", chunk: 16, status: http.StatusOK},
+		{name: "past the file limit", chunk: 17, status: http.StatusRequestEntityTooLarge},
+		{name: "within the chunk limit", maxChunkSize: 8, chunk: 8, status: http.StatusOK},
+		{name: "past the chunk limit", maxChunkSize: 8, chunk: 9, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := services.NewUploadValidator(map[string]services.UploadPolicy{"default": {MaxSize: 16}})
+			sessions := services.NewUploadSessions(services.NewMediaStore(services.NewMemoryStorage(nil), nil, nil, 0), validator, services.UploadSessionConfig{
+				TTL:          time.Hour,
+				MaxChunkSize: tt.maxChunkSize,
+			})
+			session := &services.UploadSession{UserID: "user-1", DeviceID: "device-1", Source: "upload", Filename: "a.txt", ContentType: "text/plain"}
+			if err := sessions.Open(context.Background(), session); err != nil {
+				t.Fatal(err)
+			}
+
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set(middleware.PrincipalKey, &auth.Principal{UserID: "user-1", DeviceID: "device-1"})
+			})
+			router.PUT("/v1/upload-sessions/:id/chunks/:index", UploadSessionChunkHandler(sessions, validator, tt.maxChunkSize))
+
+			request := httptest.NewRequest(http.MethodPut, "/v1/upload-sessions/"+session.ID+"/chunks/1", strings.NewReader(strings.Repeat("x", tt.chunk)))
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+		})
+	}
+}
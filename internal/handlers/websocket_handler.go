@@ -2,33 +2,68 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/middleware"
 	"github.com/nodelike/chronos-gateway/internal/services"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for now
-	},
-}
+// eventSources are the sources clients may send raw events for over
+// WebSocket and gRPC, each mapped to its own topic. Media and audit events
+// are only produced by the gateway itself.
+var eventSources = map[string]bool{"android": true, "macos": true, "browser": true, "location": true}
+
+// WebSocketHandler accepts event streams. Browser handshakes must come from
+// one of allowedOrigins, see originChecker. Messages must name one of the
+// eventSources, which picks their Kafka topic. Each message is validated
+// against the schema of its source and version and upgraded to the current
+// version. Messages without schema_version use the handshake's
+// X-Schema-Version header. Location messages go through locationValidator
+// like the HTTP location endpoints.
+func WebSocketHandler(producer *services.KafkaProducer, allowedOrigins []string, schemas *services.SchemaRegistry, locationValidator *services.LocationValidator) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     originChecker(allowedOrigins),
+	}
 
-func WebSocketHandler(producer *services.KafkaProducer) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Browsers fail the handshake unless one of the offered subprotocols
+		// is echoed back
+		var header http.Header
+		if protocol := selectSubprotocol(websocket.Subprotocols(c.Request)); protocol != "" {
+			header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+		}
+
 		// Upgrade the HTTP connection to a WebSocket connection
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, header)
 		if err != nil {
 			log.Printf("Failed to upgrade connection: %v", err)
 			return
 		}
 		defer conn.Close()
 
+		// Close the connection when the caller's token expires
+		principal := middleware.GetPrincipal(c)
+		if principal != nil && !principal.ExpiresAt.IsZero() {
+			expiry := time.AfterFunc(time.Until(principal.ExpiresAt), func() {
+				message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+				conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+				conn.Close()
+			})
+			defer expiry.Stop()
+		}
+
 		// Set read deadline
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 
@@ -55,26 +90,146 @@ func WebSocketHandler(producer *services.KafkaProducer) gin.HandlerFunc {
 				continue
 			}
 
-			// Determine the source type
-			source, ok := event["source"].(string)
-			if !ok {
-				source = "unknown"
-			}
-
-			// Send to Kafka
-			producer.SendEvent(source, message)
-
-			// Send acknowledgment
+			// The source picks the topic, so only event sources are accepted
 			response := map[string]interface{}{
 				"status":    "received",
 				"timestamp": time.Now().Unix(),
 			}
+			source, _ := event["source"].(string)
+			if !eventSources[source] {
+				response["status"], response["error"] = "rejected", "unknown source "+strconv.Quote(source)
+				if err := writeResponse(conn, response); err != nil {
+					break
+				}
+				continue
+			}
 
-			responseJSON, _ := json.Marshal(response)
-			if err := conn.WriteMessage(websocket.TextMessage, responseJSON); err != nil {
-				log.Printf("Error sending response: %v", err)
+			// Check the event against the caller's user and device binding
+			upgraded, version, schemaErr := prepareEvent(c, schemas, source, message)
+			bound, field, err := bindRawEvent(principal, upgraded)
+			var verdict services.LocationVerdict
+			if source == "location" && schemaErr == nil && err == nil && field == "" {
+				bound, verdict, err = checkRawLocation(locationValidator, middleware.GetMetricsFromContext(c), bound)
+			}
+			deviceID, _ := event["device_id"].(string)
+			if deviceID == "" && principal != nil {
+				deviceID = principal.DeviceID
+			}
+			var invalid *services.SchemaError
+			switch {
+			case errors.As(schemaErr, &invalid):
+				response["status"], response["error"] = "rejected", "event does not match schema"
+				response["source"], response["version"], response["fields"] = invalid.Source, invalid.Version, invalid.Fields
+			case schemaErr != nil:
+				response["status"], response["error"] = "rejected", schemaErr.Error()
+			case err != nil:
+				response["status"], response["error"] = "rejected", err.Error()
+			case field != "":
+				identityMismatch(c, "websocket", field, principal)
+				response["status"], response["error"] = "rejected", field+" does not match the authenticated identity"
+			case verdict.Action == services.LocationReject:
+				response["status"], response["error"], response["rule"] = "rejected", verdict.Reason, verdict.Rule
+			default:
+				// Messages share the event budget of the upgrade request
+				if decision := middleware.TakeEvents(c, map[string]int{deviceID: 1}); !decision.Allowed {
+					response["status"], response["error"] = "throttled", "rate limit exceeded"
+					response["retry_after"] = math.Ceil(decision.RetryAfter.Seconds())
+					break
+				}
+				if verdict.Action == services.LocationDrop {
+					response["status"], response["reason"], response["rule"] = "dropped", verdict.Reason, verdict.Rule
+					break
+				}
+
+				// Send to Kafka
+				producer.SendEvent(source, bound)
+				recordSchemaVersion(middleware.GetMetricsFromContext(c), source, version)
+			}
+
+			if err := writeResponse(conn, response); err != nil {
 				break
 			}
 		}
 	}
 }
+
+// writeResponse acknowledges a WebSocket message
+func writeResponse(conn *websocket.Conn, response map[string]interface{}) error {
+	responseJSON, _ := json.Marshal(response)
+	err := conn.WriteMessage(websocket.TextMessage, responseJSON)
+	if err != nil {
+		log.Printf("Error sending response: %v", err)
+	}
+	return err
+}
+
+// WebSocketTokenHandler issues a short-lived connection token for the caller,
+// for browsers that can't send credentials on the WebSocket handshake
+func WebSocketTokenHandler(tokens *auth.ConnectionTokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := middleware.GetPrincipal(c)
+		if principal == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "connection tokens need authentication to be enabled"})
+			return
+		}
+
+		token, expires, err := tokens.Issue(principal)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue connection token"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"token":      token,
+			"protocol":   auth.ConnectionTokenProtocol + token,
+			"expires_at": expires,
+		})
+	}
+}
+
+// originChecker allows handshakes without an Origin header, which come from
+// non-browser clients, and from the allowed origins. "*" allows every origin
+// and "https://*.example.com" the subdomains of example.com. Without a list,
+// only origins on the gateway's own host are allowed.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		if len(allowed) == 0 {
+			u, err := url.Parse(origin)
+			if err == nil && strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+		}
+		for _, pattern := range allowed {
+			if pattern == "*" || strings.EqualFold(pattern, origin) {
+				return true
+			}
+			if scheme, domain, ok := strings.Cut(pattern, "://*."); ok {
+				rest, found := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+				if found && strings.HasSuffix(rest, "."+strings.ToLower(domain)) {
+					return true
+				}
+			}
+		}
+
+		log.Printf("Rejected WebSocket handshake from origin %s", origin)
+		return false
+	}
+}
+
+// selectSubprotocol picks the first offered subprotocol that isn't a
+// connection token, or the token itself if nothing else was offered
+func selectSubprotocol(offered []string) string {
+	for _, protocol := range offered {
+		if !strings.HasPrefix(protocol, auth.ConnectionTokenProtocol) {
+			return protocol
+		}
+	}
+	if len(offered) > 0 {
+		return offered[0]
+	}
+	return ""
+}
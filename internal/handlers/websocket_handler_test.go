@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nodelike/chronos-gateway/internal/services"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOriginChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin", allowed: []string{"https://app.example.com"}, want: true},
+		{name: "same host by default", origin: "https://gateway.example.com", want: true},
+		{name: "other host by default", origin: "https://evil.example", want: false},
+		{name: "listed", allowed: []string{"https://app.example.com"}, origin: "https://APP.example.com", want: true},
+		{name: "not listed", allowed: []string{"https://app.example.com"}, origin: "https://gateway.example.com", want: false},
+		{name: "other scheme", allowed: []string{"https://app.example.com"}, origin: "http://app.example.com", want: false},
+		{name: "wildcard subdomain", allowed: []string{"https://*.example.com"}, origin: "https://a.b.example.com", want: true},
+		{name: "wildcard needs a subdomain", allowed: []string{"https://*.example.com"}, origin: "https://example.com", want: false},
+		{name: "wildcard suffix trick", allowed: []string{"https://*.example.com"}, origin: "https://evilexample.com", want: false},
+		{name: "any origin", allowed: []string{"*"}, origin: "https://evil.example", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "https://gateway.example.com/v1/ws", nil)
+			if tt.origin != "" {
+				request.Header.Set("Origin", tt.origin)
+			}
+			if got := originChecker(tt.allowed)(request); got != tt.want {
+				t.Fatalf("originChecker(%v)(%q) = %v, want %v", tt.allowed, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{offered: []string{"chronos-token.abc", "json"}, want: "json"},
+		{offered: []string{"chronos-token.abc"}, want: "chronos-token.abc"},
+		{offered: nil, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := selectSubprotocol(tt.offered); got != tt.want {
+			t.Fatalf("selectSubprotocol(%v) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
+
+// dialWebSocket serves handler and connects to it. The connection and
+// server are closed when the test ends.
+func dialWebSocket(t *testing.T, handler gin.HandlerFunc) *websocket.Conn {
+	t.Helper()
+	router := gin.New()
+	router.GET("/v1/ws", handler)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestEventSources(t *testing.T) {
+	conn := dialWebSocket(t, WebSocketHandler(services.NewKafkaProducer(nil, true), nil, nil, nil))
+	grpcServer := &CollectorServer{producer: services.NewKafkaProducer(nil, true)}
+
+	tests := []struct {
+		source string
+		status string
+		code   codes.Code
+	}{
+		{source: "android", status: "received", code: codes.OK},
+		{source: "location", status: "received", code: codes.OK},
+		{source: "audit", status: "rejected", code: codes.InvalidArgument},
+		{source: "media", status: "rejected", code: codes.InvalidArgument},
+		{source: "anything", status: "rejected", code: codes.InvalidArgument},
+		{source: "", status: "rejected", code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if err := conn.WriteJSON(map[string]interface{}{"source": tt.source, "value": 1}); err != nil {
+				t.Fatalf("WriteJSON() = %v", err)
+			}
+			var response map[string]interface{}
+			if err := conn.ReadJSON(&response); err != nil {
+				t.Fatalf("ReadJSON() = %v", err)
+			}
+			if response["status"] != tt.status {
+				t.Fatalf("response = %v, want status %q", response, tt.status)
+			}
+
+			_, err := grpcServer.SendEvent(context.Background(), &Event{Source: tt.source, Data: []byte(`{"value":1}`)})
+			if status.Code(err) != tt.code {
+				t.Fatalf("SendEvent() = %v, want %v", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// AdminAuthentication requires the admin token as a bearer token. It is
+// separate from client credentials, which never grant admin access.
+func AdminAuthentication(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented, ok := auth.BearerToken(c.GetHeader("Authorization"))
+		if !ok || !secretEqual(presented, token) {
+			RecordAudit(c, services.AuditEvent{Type: services.AuditAuthFailure, Reason: "invalid admin token"})
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// OpsAuthentication accepts either HTTP basic auth with username and
+// password, or token as a bearer token. Empty credentials are never accepted.
+func OpsAuthentication(username, password, token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if presented, ok := auth.BearerToken(c.GetHeader("Authorization")); ok && token != "" && secretEqual(presented, token) {
+			c.Next()
+			return
+		}
+		if user, pass, ok := c.Request.BasicAuth(); ok && password != "" && secretEqual(user, username) && secretEqual(pass, password) {
+			c.Next()
+			return
+		}
+		RecordAudit(c, services.AuditEvent{Type: services.AuditAuthFailure, Reason: "invalid ops credentials"})
+		c.Header("WWW-Authenticate", `Basic realm="chronos-ops"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	}
+}
+
+// secretEqual compares digests in constant time, so neither the content nor
+// the length of a secret leaks through timing
+func secretEqual(presented, expected string) bool {
+	a := sha256.Sum256([]byte(presented))
+	b := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// Key for storing the audit log in context
+const AuditKey = "audit_log"
+
+// Audit makes the audit log available to later middleware and handlers
+func Audit(audit *services.AuditLog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(AuditKey, audit)
+		c.Next()
+	}
+}
+
+// RecordAudit adds the request details and the authenticated caller to an
+// event and records it
+func RecordAudit(c *gin.Context, event services.AuditEvent) {
+	value, _ := c.Get(AuditKey)
+	audit, _ := value.(*services.AuditLog)
+	if audit == nil {
+		return
+	}
+
+	event.IP = c.ClientIP()
+	event.Route = c.Request.Method + " " + c.Request.URL.Path
+	event.UserAgent = c.Request.UserAgent()
+	if principal := GetPrincipal(c); principal != nil && event.Principal == "" {
+		event.Principal = principal.Name
+		event.Subject = principal.Subject
+		event.Tenant = principal.Tenant
+		event.Method = principal.Method
+	}
+	audit.Record(event)
+}
+
+// AuthFailureLimit blocks client IPs after repeated 401 responses, so
+// credentials can't be guessed at full speed. Blocked requests get 429 and
+// are not audited one by one; the block itself is. A nil limiter blocks
+// nothing.
+func AuthFailureLimit(limiter *services.FailureLimiter) gin.HandlerFunc {
+	if limiter == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if remaining, blocked := limiter.Blocked(ip); blocked {
+			c.Header("Retry-After", strconv.Itoa(max(seconds(remaining), 1)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many failed authentication attempts"})
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() == http.StatusUnauthorized && limiter.Fail(ip) {
+			RecordAudit(c, services.AuditEvent{Type: services.AuditAuthThrottled, Reason: "too many authentication failures"})
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestAuthFailureLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := services.NewAuditLog(services.AuditConfig{File: path}, nil)
+	if err != nil {
+		t.Fatalf("NewAuditLog() = %v", err)
+	}
+	router := gin.New()
+	router.Use(Audit(audit))
+	router.Use(AuthFailureLimit(services.NewFailureLimiter(2, time.Minute, time.Minute)))
+	router.GET("/v1/schemas", func(c *gin.Context) {
+		if c.GetHeader("X-API-Key") != "valid" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		ip     string
+		apiKey string
+		status int
+	}{
+		{name: "first failure", ip: "192.0.2.1:1000", status: http.StatusUnauthorized},
+		{name: "valid key between failures", ip: "192.0.2.1:1000", apiKey: "valid", status: http.StatusOK},
+		{name: "second failure blocks", ip: "192.0.2.1:1000", status: http.StatusUnauthorized},
+		{name: "blocked with a valid key", ip: "192.0.2.1:1000", apiKey: "valid", status: http.StatusTooManyRequests},
+		{name: "other client", ip: "192.0.2.2:1000", apiKey: "valid", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/v1/schemas", nil)
+			request.RemoteAddr = tt.ip
+			request.Header.Set("X-API-Key", tt.apiKey)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.status == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "" {
+				t.Fatal("blocked response without Retry-After")
+			}
+		})
+	}
+
+	audit.Close()
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var event services.AuditEvent
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &event) != nil || event.Type != services.AuditAuthThrottled || event.IP != "192.0.2.1" {
+		t.Fatalf("audit log = %s, want one auth_throttled event for 192.0.2.1", data)
+	}
+}
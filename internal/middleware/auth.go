@@ -1,13 +1,21 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
 )
 
-func Authentication(validKeys map[string]bool, disableAuth bool) gin.HandlerFunc {
+// Key for storing the authenticated principal in context
+const PrincipalKey = "principal"
+
+func Authentication(authenticator *auth.Authenticator, disableAuth bool) gin.HandlerFunc {
 	if disableAuth {
 		log.Println("API Authentication disabled - all requests will be allowed")
 		return func(c *gin.Context) {
@@ -16,11 +24,76 @@ func Authentication(validKeys map[string]bool, disableAuth bool) gin.HandlerFunc
 	}
 
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
-		if !validKeys[apiKey] {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		var principal *auth.Principal
+		var err error
+		// Browsers can't set headers on WebSocket handshakes. They pass a
+		// connection token or a bearer token in the query string instead,
+		// or the connection token as a subprotocol.
+		if token := auth.ConnectionToken(c.Query("ws_token"), websocket.Subprotocols(c.Request)); token != "" && isWebSocketUpgrade(c.Request) {
+			principal, err = authenticator.AuthenticateConnection(token)
+		} else {
+			authorization := c.GetHeader("Authorization")
+			if authorization == "" && isWebSocketUpgrade(c.Request) {
+				if token := c.Query("access_token"); token != "" {
+					authorization = "Bearer " + token
+				}
+			}
+			principal, err = authenticator.Authenticate(authorization, c.GetHeader("X-API-Key"), c.Request.TLS)
+		}
+		if err != nil {
+			auditAuthFailure(c, err)
+			if errors.Is(err, auth.ErrInvalidConnectionToken) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid connection token"})
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidToken) {
+				c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid bearer token"})
+				return
+			}
+			message := "Invalid API key"
+			if errors.Is(err, auth.ErrExpiredAPIKey) {
+				message = "API key expired"
+			}
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+			return
+		}
+
+		c.Set(PrincipalKey, principal)
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), principal))
+
+		// Keys may be limited to some endpoints
+		if endpoint := auth.Endpoint(c.FullPath()); !principal.Allows(endpoint) {
+			RecordAudit(c, services.AuditEvent{Type: services.AuditScopeDenied, Reason: "endpoint " + endpoint + " not in scopes"})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not allowed to call " + endpoint})
 			return
 		}
+		RecordAudit(c, services.AuditEvent{Type: services.AuditAuthSuccess})
 		c.Next()
 	}
 }
+
+// auditAuthFailure records a rejected credential. Key IDs aren't secret, so
+// they are logged to trace attempts with leaked or revoked keys.
+func auditAuthFailure(c *gin.Context, err error) {
+	event := services.AuditEvent{Type: services.AuditAuthFailure, Reason: err.Error()}
+	if id, _, ok := strings.Cut(c.GetHeader("X-API-Key"), "."); ok {
+		event.Details = map[string]string{"key_id": id}
+	}
+	RecordAudit(c, event)
+}
+
+// GetPrincipal retrieves the authenticated caller from the gin context
+func GetPrincipal(c *gin.Context) *auth.Principal {
+	if value, exists := c.Get(PrincipalKey); exists {
+		if principal, ok := value.(*auth.Principal); ok {
+			return principal
+		}
+	}
+	return nil
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// IPFiltering rejects requests from client addresses blocked by the filter
+// of a route group with 403, before they are authenticated. WebSocket
+// upgrades are plain requests at this point and are filtered the same way.
+// A nil filter lets everything through.
+func IPFiltering(group string, filter *services.IPFilter, metrics *services.MetricsCollector) gin.HandlerFunc {
+	if filter == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		reason := filter.Check(ip)
+		if reason == "" {
+			c.Next()
+			return
+		}
+
+		log.Printf("[AUTH] Blocked %s request from %s: %s", group, ip, reason)
+		if metrics != nil {
+			metrics.RecordIPBlocked(group, reason)
+		}
+		RecordAudit(c, services.AuditEvent{Type: services.AuditIPBlocked, Reason: reason, Details: map[string]string{"group": group}})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Client address not allowed"})
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestIPFiltering(t *testing.T) {
+	filter, err := services.NewIPFilter(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatalf("NewIPFilter() = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    *services.IPFilter
+		remote    string
+		forwarded string
+		status    int
+	}{
+		{name: "allowed", filter: filter, remote: "198.51.100.1:1000", status: http.StatusOK},
+		{name: "blocked CIDR", filter: filter, remote: "203.0.113.7:1000", status: http.StatusForbidden},
+		{name: "blocked behind trusted proxy", filter: filter, remote: "10.0.0.1:1000", forwarded: "203.0.113.7", status: http.StatusForbidden},
+		{name: "allowed behind trusted proxy", filter: filter, remote: "10.0.0.1:1000", forwarded: "198.51.100.1", status: http.StatusOK},
+		{name: "forwarded by untrusted client", filter: filter, remote: "198.51.100.1:1000", forwarded: "198.51.100.2", status: http.StatusOK},
+		{name: "spoofed from blocked CIDR", filter: filter, remote: "203.0.113.7:1000", forwarded: "198.51.100.2", status: http.StatusForbidden},
+		{name: "no filter", remote: "203.0.113.7:1000", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.SetTrustedProxies([]string{"10.0.0.0/8"})
+			router.Use(IPFiltering("api", tt.filter, nil))
+			router.GET("/v1/schemas", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			request := httptest.NewRequest(http.MethodGet, "/v1/schemas", nil)
+			request.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				request.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
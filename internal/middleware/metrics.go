@@ -27,8 +27,14 @@ func Metrics(metrics *services.MetricsCollector) gin.HandlerFunc {
 		status := strconv.Itoa(c.Writer.Status())
 		latency := time.Since(start).Seconds()
 
+		// Label by client name, never by the credential itself
+		client := "anonymous"
+		if principal := GetPrincipal(c); principal != nil {
+			client = principal.Name
+		}
+
 		// Increment request counter with labels
-		metrics.RequestCounter.WithLabelValues(method, path, status).Inc()
+		metrics.RequestCounter.WithLabelValues(method, path, status, client).Inc()
 
 		// Record request duration
 		metrics.RequestDuration.WithLabelValues(method, path).Observe(latency)
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// Key for storing the caller's rate limit state in context
+const RateLimitKey = "rate_limit"
+
+// rateLimitState remembers the route and client keys of a request so
+// handlers can charge its events once the body is parsed
+type rateLimitState struct {
+	limiter  *services.RateLimiter
+	route    string
+	limits   services.RouteLimits
+	keys     []string // Principal and IP keys, charged for every event
+	byDevice bool
+	client   string
+}
+
+// RateLimiting charges each request against the request budget of its route,
+// keyed by principal, device and client IP as listed in keyBy. Throttled
+// requests get 429 with Retry-After.
+func RateLimiting(limiter *services.RateLimiter, keyBy []string) gin.HandlerFunc {
+	if len(keyBy) == 0 {
+		keyBy = []string{"principal", "device", "ip"}
+	}
+	by := make(map[string]bool, len(keyBy))
+	for _, key := range keyBy {
+		by[strings.ToLower(key)] = true
+	}
+	log.Printf("Rate limiting by: %s", strings.Join(keyBy, ", "))
+
+	return func(c *gin.Context) {
+		route, limits, ok := limiter.Route(auth.Endpoint(c.FullPath()))
+		if !ok {
+			c.Next()
+			return
+		}
+
+		state := &rateLimitState{limiter: limiter, route: route, limits: limits, byDevice: by["device"], client: "anonymous"}
+		principal := GetPrincipal(c)
+		if principal != nil {
+			state.client = principal.Name
+			if by["principal"] {
+				state.keys = append(state.keys, "principal:"+principal.Method+":"+principal.Subject)
+			}
+		}
+		if by["ip"] {
+			state.keys = append(state.keys, "ip:"+c.ClientIP())
+		}
+
+		takes := make(map[string]int, len(state.keys)+1)
+		for _, key := range state.keys {
+			takes[key] = 1
+		}
+		if state.byDevice {
+			if deviceID := requestDevice(c, principal); deviceID != "" {
+				takes["device:"+deviceID] = 1
+			}
+		}
+
+		decision := state.take(c, "requests", limits.Requests, takes)
+		if !decision.Allowed {
+			throttled(c, decision, 1)
+			return
+		}
+		c.Set(RateLimitKey, state)
+		c.Next()
+	}
+}
+
+// requestDevice finds the device of a request before its body is read
+func requestDevice(c *gin.Context, principal *auth.Principal) string {
+	if principal != nil && principal.DeviceID != "" {
+		return principal.DeviceID
+	}
+	if deviceID := c.GetHeader("X-Device-ID"); deviceID != "" {
+		return deviceID
+	}
+	return c.Query("device_id")
+}
+
+// take charges the buckets, sets the X-RateLimit-* headers and counts
+// throttled requests
+func (s *rateLimitState) take(c *gin.Context, budget string, limit services.RateLimit, takes map[string]int) services.RateDecision {
+	decision := s.limiter.Take(s.route, budget, limit, takes)
+	if limit.Rate <= 0 {
+		return decision
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(seconds(decision.Reset)))
+	if !decision.Allowed {
+		if metricsCollector := GetMetricsFromContext(c); metricsCollector != nil {
+			metricsCollector.RecordRateLimited(s.route, budget, decision.Dimension, s.client)
+		}
+	}
+	return decision
+}
+
+// TakeEvents charges events against the caller's event budget. devices maps
+// each device ID in the payload to its number of events; the principal and
+// IP budgets are charged for the total.
+func TakeEvents(c *gin.Context, devices map[string]int) services.RateDecision {
+	value, exists := c.Get(RateLimitKey)
+	state, ok := value.(*rateLimitState)
+	if !exists || !ok {
+		return services.RateDecision{Allowed: true}
+	}
+
+	total := 0
+	takes := make(map[string]int, len(state.keys)+len(devices))
+	for deviceID, n := range devices {
+		total += n
+		if state.byDevice && deviceID != "" {
+			takes["device:"+deviceID] += n
+		}
+	}
+	for _, key := range state.keys {
+		takes[key] = total
+	}
+	return state.take(c, "events", state.limits.Events, takes)
+}
+
+// AllowEvents charges events like TakeEvents. It writes a 429 response, or
+// 413 for more events than the budget can ever hold, and returns false if
+// they are over the budget.
+func AllowEvents(c *gin.Context, devices map[string]int) bool {
+	decision := TakeEvents(c, devices)
+	if decision.Allowed {
+		return true
+	}
+	total := 0
+	for _, n := range devices {
+		total += n
+	}
+	throttled(c, decision, total)
+	return false
+}
+
+// throttled writes the response for a request over its budget
+func throttled(c *gin.Context, decision services.RateDecision, n int) {
+	if n > decision.Limit {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("%d events exceed the limit of %d per request", n, decision.Limit),
+		})
+		return
+	}
+	retryAfter := max(seconds(decision.RetryAfter), 1)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded", "retry_after": retryAfter})
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestRateLimiting(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []int // Events per request, sent in turn; the last one is checked
+		devices  []string
+		keyBy    []string // Defaults to the principal
+		status   int
+		remain   string // X-RateLimit-Remaining of the last response
+	}{
+		{name: "allowed", requests: []int{1}, devices: []string{"d1"}, status: http.StatusOK, remain: "4"},
+		{name: "request budget used up", requests: []int{1, 1, 1}, devices: []string{"d1", "d1", "d1"}, status: http.StatusTooManyRequests, remain: "0"},
+		{name: "event budget used up", requests: []int{4, 2}, devices: []string{"d1", "d1"}, status: http.StatusTooManyRequests, remain: "1"},
+		{name: "batch larger than the event burst", requests: []int{6}, devices: []string{"d1"}, status: http.StatusRequestEntityTooLarge},
+		{name: "shared principal budget", requests: []int{1, 1, 1}, devices: []string{"d1", "d1", "d2"}, status: http.StatusTooManyRequests, remain: "0"},
+		{name: "per-device budget", requests: []int{1, 1, 1}, devices: []string{"d1", "d1", "d2"}, keyBy: []string{"device"}, status: http.StatusOK, remain: "4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := services.NewRateLimiter(map[string]services.RouteLimits{
+				"locations/batch": {
+					Requests: services.RateLimit{Rate: 0.001, Burst: 2},
+					Events:   services.RateLimit{Rate: 0.001, Burst: 5},
+				},
+			})
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set(PrincipalKey, &auth.Principal{Name: "agent", Subject: "agent", Method: auth.MethodAPIKey})
+			})
+			keyBy := tt.keyBy
+			if keyBy == nil {
+				keyBy = []string{"principal"}
+			}
+			router.Use(RateLimiting(limiter, keyBy))
+			router.POST("/v1/locations/batch", func(c *gin.Context) {
+				events, _ := strconv.Atoi(c.Query("events"))
+				if !AllowEvents(c, map[string]int{c.GetHeader("X-Device-ID"): events}) {
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+
+			var recorder *httptest.ResponseRecorder
+			for i, events := range tt.requests {
+				recorder = httptest.NewRecorder()
+				request := httptest.NewRequest(http.MethodPost, "/v1/locations/batch?events="+strconv.Itoa(events), nil)
+				request.Header.Set("X-Device-ID", tt.devices[i])
+				router.ServeHTTP(recorder, request)
+			}
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+			if tt.remain != "" && recorder.Header().Get("X-RateLimit-Remaining") != tt.remain {
+				t.Fatalf("X-RateLimit-Remaining = %q, want %q", recorder.Header().Get("X-RateLimit-Remaining"), tt.remain)
+			}
+			if tt.status == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "" {
+				t.Fatal("throttled response without Retry-After")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// defaultMaxSignedBody caps the body buffered to check a signature
+const defaultMaxSignedBody = 1 << 20
+
+// RequestSigning requires an HMAC signature on the listed /v1 endpoints
+// (matched like API key scopes). Other endpoints pass through unchanged.
+// Signed bodies are buffered to hash them, so bodies over maxBody are
+// rejected. A valid signature binds the request to the signing device: the
+// device is set on the principal, so payloads naming another device are
+// rejected like for device-bound keys.
+func RequestSigning(verifier *auth.RequestVerifier, endpoints []string, maxBody int64) gin.HandlerFunc {
+	if maxBody <= 0 {
+		maxBody = defaultMaxSignedBody
+	}
+	log.Printf("Request signing required for: %s", strings.Join(endpoints, ", "))
+
+	return func(c *gin.Context) {
+		endpoint := auth.Endpoint(c.FullPath())
+		if !auth.MatchScope(endpoints, endpoint) {
+			c.Next()
+			return
+		}
+
+		// The body is part of the signature; keep it readable for the handler
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBody+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			return
+		}
+		if int64(len(body)) > maxBody {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large to sign"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		deviceID := c.GetHeader("X-Device-ID")
+		if deviceID == "" {
+			deviceID = c.Query("device_id")
+		}
+
+		err = verifier.Verify(auth.SignedRequest{
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.RequestURI(),
+			DeviceID:   deviceID,
+			Timestamp:  c.GetHeader("X-Signature-Timestamp"),
+			Nonce:      c.GetHeader("X-Signature-Nonce"),
+			BodySHA256: auth.BodyDigest(body),
+			Signature:  c.GetHeader("X-Signature"),
+		})
+		if err != nil {
+			RecordAudit(c, services.AuditEvent{Type: services.AuditSignatureFailure, Reason: err.Error(), Details: map[string]string{"device_id": deviceID}})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Without credentials the signature alone identifies the caller
+		principal := &auth.Principal{Subject: deviceID, Name: "signed-request"}
+		if current := GetPrincipal(c); current != nil {
+			if current.DeviceID != "" && current.DeviceID != deviceID {
+				log.Printf("[AUTH] Rejected request from %s signed by device %s: device_id does not match its credential", current.Name, deviceID)
+				RecordAudit(c, services.AuditEvent{Type: services.AuditIdentityMismatch, Reason: "signing device does not match the credential", Details: map[string]string{"device_id": deviceID}})
+				if metricsCollector := GetMetricsFromContext(c); metricsCollector != nil {
+					metricsCollector.RecordIdentityMismatch(endpoint, "device_id", current.Name)
+				}
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "signing device does not match the authenticated identity"})
+				return
+			}
+			bound := *current
+			principal = &bound
+		}
+		principal.DeviceID = deviceID
+		c.Set(PrincipalKey, principal)
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), principal))
+		c.Next()
+	}
+}
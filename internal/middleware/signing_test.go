@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/auth"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+const signingSecret = "0123456789abcdef0123456789abcdef"
+
+func signingVerifier(t *testing.T) *auth.RequestVerifier {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "signing.json")
+	secret := base64.StdEncoding.EncodeToString([]byte(signingSecret))
+	if err := os.WriteFile(path, []byte(`{"devices": {"mac1": "`+secret+`", "mac2": "`+secret+`"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := auth.LoadRequestVerifier(path, time.Minute, 100)
+	if err != nil {
+		t.Fatalf("LoadRequestVerifier() = %v", err)
+	}
+	return verifier
+}
+
+func signedHTTPRequest(path, deviceID, nonce, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	signed := auth.SignedRequest{
+		Method:     http.MethodPost,
+		Path:       path,
+		DeviceID:   deviceID,
+		Timestamp:  strconv.FormatInt(time.Now().Unix(), 10),
+		Nonce:      nonce,
+		BodySHA256: auth.BodyDigest([]byte(body)),
+	}
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(signed.Canonical()))
+	request.Header.Set("X-Device-ID", deviceID)
+	request.Header.Set("X-Signature-Timestamp", signed.Timestamp)
+	request.Header.Set("X-Signature-Nonce", nonce)
+	request.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return request
+}
+
+func TestRequestSigning(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		request   func() *http.Request
+		status    int
+		device    string // Device bound to the principal the handler sees
+		body      string // Body the handler reads
+	}{
+		{
+			name:    "signed without credentials",
+			request: func() *http.Request { return signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`) },
+			status:  http.StatusOK, device: "mac1", body: `{"a":1}`,
+		},
+		{
+			name:      "signing device bound to the key",
+			principal: &auth.Principal{Name: "agent", UserID: "user-1"},
+			request:   func() *http.Request { return signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`) },
+			status:    http.StatusOK, device: "mac1", body: `{"a":1}`,
+		},
+		{
+			name:      "key bound to the same device",
+			principal: &auth.Principal{Name: "agent", DeviceID: "mac1"},
+			request:   func() *http.Request { return signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`) },
+			status:    http.StatusOK, device: "mac1", body: `{"a":1}`,
+		},
+		{
+			name:      "key bound to another device",
+			principal: &auth.Principal{Name: "agent", DeviceID: "mac1"},
+			request:   func() *http.Request { return signedHTTPRequest("/v1/location", "mac2", "n1", `{"a":1}`) },
+			status:    http.StatusForbidden,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				request := signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`)
+				request.Body = io.NopCloser(strings.NewReader(`{"a":2}`))
+				return request
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "claimed device differs from the signer",
+			request: func() *http.Request {
+				request := signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`)
+				request.Header.Set("X-Device-ID", "mac2")
+				return request
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "body over the limit",
+			request: func() *http.Request { return signedHTTPRequest("/v1/location", "mac1", "n1", strings.Repeat("x", 65)) },
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "endpoint not signed",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/v1/upload", strings.NewReader(strings.Repeat("x", 100)))
+			},
+			status: http.StatusOK, body: strings.Repeat("x", 100),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var credentialDevice string
+			if tt.principal != nil {
+				credentialDevice = tt.principal.DeviceID
+			}
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				if tt.principal != nil {
+					c.Set(PrincipalKey, tt.principal)
+				}
+			})
+			router.Use(RequestSigning(signingVerifier(t), []string{"location"}, 64))
+			var device, body string
+			handler := func(c *gin.Context) {
+				if principal := GetPrincipal(c); principal != nil {
+					device = principal.DeviceID
+				}
+				data, _ := c.GetRawData()
+				body = string(data)
+				c.Status(http.StatusOK)
+			}
+			router.POST("/v1/location", handler)
+			router.POST("/v1/upload", handler)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, tt.request())
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+			if device != tt.device || body != tt.body {
+				t.Fatalf("handler saw device %q and body %q, want %q and %q", device, body, tt.device, tt.body)
+			}
+			// The device is bound to a copy, not to the credential's principal
+			if tt.principal != nil && tt.principal.DeviceID != credentialDevice {
+				t.Fatalf("credential principal bound to %q", tt.principal.DeviceID)
+			}
+		})
+	}
+}
+
+func TestRequestSigningReplay(t *testing.T) {
+	router := gin.New()
+	router.Use(RequestSigning(signingVerifier(t), []string{"location"}, 0))
+	router.POST("/v1/location", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := signedHTTPRequest("/v1/location", "mac1", "n1", `{"a":1}`)
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		replay := httptest.NewRequest(http.MethodPost, "/v1/location", strings.NewReader(`{"a":1}`))
+		replay.Header = request.Header.Clone()
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, replay)
+		if recorder.Code != want {
+			t.Fatalf("request %d status = %d, want %d", i, recorder.Code, want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+// When runs handler only while the toggle is on
+func When(toggle *services.Toggle, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if toggle.Enabled() {
+			handler(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Maintenance rejects requests with 503, so clients back off and retry while
+// the gateway is drained
+func Maintenance() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Retry-After", "60")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "gateway is in maintenance"})
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nodelike/chronos-gateway/internal/services"
+)
+
+func TestWhen(t *testing.T) {
+	tests := []struct {
+		name        string
+		maintenance bool
+		logging     bool
+		status      int
+		handled     int // Times the route handler ran
+		logged      int // Times the toggled middleware ran
+	}{
+		{name: "all off", status: http.StatusOK, handled: 1},
+		{name: "maintenance", maintenance: true, status: http.StatusServiceUnavailable},
+		{name: "toggled middleware", logging: true, status: http.StatusOK, handled: 1, logged: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toggles := services.NewToggles()
+			maintenance := toggles.Register("maintenance", "", tt.maintenance)
+			logging := toggles.Register("request_logging", "", tt.logging)
+
+			logged, handled := 0, 0
+			router := gin.New()
+			router.Use(When(logging, func(c *gin.Context) {
+				c.Next()
+				logged++
+			}))
+			router.Use(When(maintenance, Maintenance()))
+			router.GET("/v1/schemas", func(c *gin.Context) {
+				handled++
+				c.Status(http.StatusOK)
+			})
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/schemas", nil))
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.maintenance && recorder.Header().Get("Retry-After") == "" {
+				t.Fatal("maintenance response without Retry-After")
+			}
+			if handled != tt.handled || logged != tt.logged {
+				t.Fatalf("handler ran %d and middleware %d times, want %d and %d", handled, logged, tt.handled, tt.logged)
+			}
+		})
+	}
+}
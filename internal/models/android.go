@@ -14,6 +14,7 @@ type AndroidEvent struct {
 	AppVersion  string            `json:"app_version"`
 	OSVersion   string            `json:"os_version"`
 	DeviceModel string            `json:"device_model"`
+	EventVersion
 }
 
 func (e *AndroidEvent) ToJSON() []byte {
@@ -12,12 +12,26 @@ type BrowserEvent struct {
 	EventData map[string]string `json:"event_data"`
 	Timestamp time.Time         `json:"timestamp"`
 	// Browser specific fields
-	Browser    string `json:"browser"`
-	BrowserVer string `json:"browser_version"`
-	UserAgent  string `json:"user_agent"`
-	HasMedia   bool   `json:"has_media"`
-	Media      []byte `json:"-"` // Not serialized to JSON
-	MediaType  string `json:"media_type,omitempty"`
+	Browser    string            `json:"browser"`
+	BrowserVer string            `json:"browser_version"`
+	UserAgent  string            `json:"user_agent"`
+	HasMedia   bool              `json:"has_media"`
+	Media      []MediaAttachment `json:"media,omitempty"`
+	MediaType  string            `json:"media_type,omitempty"` // Default content type for attachments
+	EventVersion
+}
+
+// MediaAttachment is a file attached to a browser event. In JSON requests Data
+// carries the base64-encoded content; once stored, Data is cleared and
+// ObjectKey points at the uploaded object.
+type MediaAttachment struct {
+	Filename     string            `json:"filename,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Data         []byte            `json:"data,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	ObjectKey    string            `json:"object_key,omitempty"`
+	ThumbnailKey string            `json:"thumbnail_key,omitempty"`
+	EXIF         map[string]string `json:"exif,omitempty"`
 }
 
 func (e *BrowserEvent) ToJSON() []byte {
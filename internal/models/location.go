@@ -18,10 +18,14 @@ type LocationEvent struct {
 	Heading   float64   `json:"heading,omitempty"`
 	Accuracy  float64   `json:"accuracy,omitempty"`
 	EventType string    `json:"event_type"` // "location", "motion", "geofence", etc.
-	
-	GeofenceID     string `json:"geofence_id,omitempty"`
-	ActivityType string  `json:"activity_type,omitempty"` // "still", "walking", "in_vehicle", etc.
 
+	GeofenceID   string `json:"geofence_id,omitempty"`
+	ActivityType string `json:"activity_type,omitempty"` // "still", "walking", "in_vehicle", etc.
+
+	// Validation rules the event broke, set by the gateway
+	QualityFlags []string `json:"quality_flags,omitempty"`
+
+	EventVersion
 }
 
 func (e *LocationEvent) ToJSON() []byte {
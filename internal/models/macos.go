@@ -16,6 +16,7 @@ type MacOSEvent struct {
 	DeviceModel string            `json:"device_model"`
 	// MacOS specific fields
 	DesktopEnv string `json:"desktop_env"`
+	EventVersion
 }
 
 func (e *MacOSEvent) ToJSON() []byte {
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MediaEvent announces a file stored through the upload endpoint
+type MediaEvent struct {
+	DeviceID     string            `json:"device_id"`
+	UserID       string            `json:"user_id"`
+	EventType    string            `json:"event_type"` // "uploaded"
+	Source       string            `json:"source"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Filename     string            `json:"filename,omitempty"`
+	ContentType  string            `json:"content_type"`
+	Size         int64             `json:"size"`
+	ObjectKey    string            `json:"object_key"`
+	ThumbnailKey string            `json:"thumbnail_key,omitempty"`
+	EXIF         map[string]string `json:"exif,omitempty"`
+	Session      *MediaSession     `json:"session,omitempty"`
+}
+
+// MediaSession describes the chunked upload session a file was assembled from
+type MediaSession struct {
+	ID          string            `json:"id"`
+	Chunks      int               `json:"chunks"`
+	StartedAt   time.Time         `json:"started_at"`
+	CompletedAt time.Time         `json:"completed_at"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func (e *MediaEvent) ToJSON() []byte {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return []byte{}
+	}
+	return data
+}
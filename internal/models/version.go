@@ -0,0 +1,60 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// EventVersion is embedded in every event type. The gateway sets it when it
+// upgrades a payload to the current schema version.
+type EventVersion struct {
+	SchemaVersion int            `json:"schema_version,omitempty"`
+	Metadata      *EventMetadata `json:"metadata,omitempty"`
+}
+
+// OriginalSchemaVersion returns the version the client sent the event in, 0
+// if the gateway didn't upgrade it
+func (v EventVersion) OriginalSchemaVersion() int {
+	if v.Metadata == nil {
+		return 0
+	}
+	return v.Metadata.OriginalSchemaVersion
+}
+
+// EventMetadata describes how the gateway received an event. Other fields
+// the client sent in metadata are kept in Client and published alongside.
+type EventMetadata struct {
+	OriginalSchemaVersion int                    `json:"original_schema_version"` // Version the client sent
+	Client                map[string]interface{} `json:"-"`
+}
+
+func (m *EventMetadata) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	*m = EventMetadata{}
+	if version, ok := fields["original_schema_version"].(json.Number); ok {
+		original, err := version.Int64()
+		if err != nil {
+			return err
+		}
+		m.OriginalSchemaVersion = int(original)
+	}
+	delete(fields, "original_schema_version")
+	if len(fields) > 0 {
+		m.Client = fields
+	}
+	return nil
+}
+
+func (m EventMetadata) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(m.Client)+1)
+	for key, value := range m.Client {
+		fields[key] = value
+	}
+	fields["original_schema_version"] = m.OriginalSchemaVersion
+	return json.Marshal(fields)
+}
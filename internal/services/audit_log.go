@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditAuthSuccess      = "auth_success"
+	AuditAuthFailure      = "auth_failure"
+	AuditAuthThrottled    = "auth_throttled"
+	AuditScopeDenied      = "scope_denied"
+	AuditSignatureFailure = "signature_failure"
+	AuditIdentityMismatch = "identity_mismatch"
+	AuditAdminAction      = "admin_action"
+	AuditIPBlocked        = "ip_blocked"
+)
+
+// AuditEvent is one entry of the security audit stream
+type AuditEvent struct {
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	Principal string            `json:"principal,omitempty"` // Client name
+	Subject   string            `json:"subject,omitempty"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Method    string            `json:"auth_method,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	Route     string            `json:"route,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Reason    string            `json:"reason,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// AuditConfig configures where audit events are written
+type AuditConfig struct {
+	File       string // JSON lines file, rotated at MaxSize
+	MaxSize    int64  // Bytes; 0 means 100 MB
+	MaxBackups int    // Rotated files to keep; 0 means 5
+	Topic      string // Kafka topic, empty to skip Kafka
+	Successes  bool   // Also record successful authentications
+}
+
+// AuditLog writes security events as JSON lines to a rotating file and
+// optionally to a Kafka topic. A nil AuditLog records nothing.
+type AuditLog struct {
+	config   AuditConfig
+	producer *KafkaProducer
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(config AuditConfig, producer *KafkaProducer) (*AuditLog, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100 << 20
+	}
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = 5
+	}
+	audit := &AuditLog{config: config, producer: producer}
+	if config.File != "" {
+		if err := os.MkdirAll(filepath.Dir(config.File), 0700); err != nil {
+			return nil, err
+		}
+		if err := audit.open(); err != nil {
+			return nil, err
+		}
+	}
+	return audit, nil
+}
+
+// Record writes an event. Successful authentications are dropped unless
+// configured, since they come with every request.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil || (event.Type == AuditAuthSuccess && !a.config.Successes) {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[AUDIT] Error encoding event: %v", err)
+		return
+	}
+
+	if a.file != nil {
+		a.write(append(data, '\n'))
+	}
+	if a.config.Topic != "" && a.producer != nil {
+		a.producer.SendToTopic(a.config.Topic, data)
+	}
+}
+
+// Close closes the audit file
+func (a *AuditLog) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) write(line []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size+int64(len(line)) > a.config.MaxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("[AUDIT] Error rotating %s: %v", a.config.File, err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("[AUDIT] Error writing %s: %v", a.config.File, err)
+	}
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size = file, stat.Size()
+	return nil
+}
+
+// rotate shifts audit.log.1 to audit.log.2 and so on, dropping the oldest,
+// and starts a new file. The caller holds the lock.
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	for i := a.config.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.config.File, i), fmt.Sprintf("%s.%d", a.config.File, i+1))
+	}
+	if err := os.Rename(a.config.File, a.config.File+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAuditFile(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		successes bool
+		events    []AuditEvent
+		want      []string // Types written to the file
+	}{
+		{
+			name:   "failures",
+			events: []AuditEvent{{Type: AuditAuthFailure, Reason: "invalid API key"}, {Type: AuditIdentityMismatch}},
+			want:   []string{AuditAuthFailure, AuditIdentityMismatch},
+		},
+		{
+			name:   "successes dropped by default",
+			events: []AuditEvent{{Type: AuditAuthSuccess}, {Type: AuditScopeDenied}},
+			want:   []string{AuditScopeDenied},
+		},
+		{
+			name:      "successes when configured",
+			successes: true,
+			events:    []AuditEvent{{Type: AuditAuthSuccess}},
+			want:      []string{AuditAuthSuccess},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit", "audit.log")
+			audit, err := NewAuditLog(AuditConfig{File: path, Successes: tt.successes}, nil)
+			if err != nil {
+				t.Fatalf("NewAuditLog() = %v", err)
+			}
+			defer audit.Close()
+			for _, event := range tt.events {
+				audit.Record(event)
+			}
+
+			events := readAuditFile(t, path)
+			if len(events) != len(tt.want) {
+				t.Fatalf("recorded %+v, want types %v", events, tt.want)
+			}
+			for i, event := range events {
+				if event.Type != tt.want[i] || event.Time.IsZero() {
+					t.Fatalf("event %d = %+v, want type %s with a time", i, event, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// A nil log records nothing
+	var audit *AuditLog
+	audit.Record(AuditEvent{Type: AuditAuthFailure})
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(AuditConfig{File: path, MaxSize: 300, MaxBackups: 2}, nil)
+	if err != nil {
+		t.Fatalf("NewAuditLog() = %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		audit.Record(AuditEvent{Type: AuditAuthFailure, Reason: fmt.Sprintf("attempt %02d", i)})
+	}
+	audit.Close()
+
+	tests := []struct {
+		file   string
+		exists bool
+	}{
+		{file: path, exists: true},
+		{file: path + ".1", exists: true},
+		{file: path + ".2", exists: true},
+		{file: path + ".3", exists: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.file), func(t *testing.T) {
+			stat, err := os.Stat(tt.file)
+			if tt.exists != (err == nil) {
+				t.Fatalf("Stat() = %v, want exists=%v", err, tt.exists)
+			}
+			if tt.exists && stat.Size() > 300 {
+				t.Fatalf("size = %d, want at most 300", stat.Size())
+			}
+		})
+	}
+
+	// The newest events are in the current file
+	events := readAuditFile(t, path)
+	if last := events[len(events)-1]; last.Reason != "attempt 19" {
+		t.Fatalf("last event = %+v", last)
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupportedSchemaVersion is returned for a version newer than the
+// gateway's current one
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// EventUpgrade converts a payload from one schema version to the next,
+// in place. Numbers are json.Number.
+type EventUpgrade func(event map[string]interface{}) error
+
+// currentSchemaVersions is the canonical version of each event type, the
+// shape of its struct in models. Payloads without a version are version 1,
+// the shape every client sent before versioning. To change a shape, bump
+// the version here, add its schema file and register an upgrade from the
+// previous version with RegisterUpgrade in an init function of this package.
+var currentSchemaVersions = map[string]int{
+	"android":  1,
+	"macos":    1,
+	"browser":  1,
+	"location": 1,
+}
+
+// eventUpgrades holds the upgrades by source and the version they upgrade from
+var eventUpgrades = map[string]map[int]EventUpgrade{}
+
+// RegisterUpgrade adds the upgrade of a source's payloads from version from
+// to from+1
+func RegisterUpgrade(source string, from int, upgrade EventUpgrade) {
+	source = strings.ToLower(source)
+	if eventUpgrades[source] == nil {
+		eventUpgrades[source] = make(map[int]EventUpgrade)
+	}
+	eventUpgrades[source][from] = upgrade
+}
+
+// CurrentSchemaVersion returns the canonical version of a source, 0 for
+// sources without one
+func CurrentSchemaVersion(source string) int {
+	return currentSchemaVersions[strings.ToLower(source)]
+}
+
+// CheckUpgrades verifies that every version below the current one of each
+// source has an upgrade
+func CheckUpgrades() error {
+	sources := make([]string, 0, len(currentSchemaVersions))
+	for source := range currentSchemaVersions {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		for version := 1; version < currentSchemaVersions[source]; version++ {
+			if eventUpgrades[source][version] == nil {
+				return fmt.Errorf("no upgrade for %s from version %d to %d", source, version, version+1)
+			}
+		}
+	}
+	return nil
+}
+
+// UpgradeEvent converts a JSON object of the given version to the current
+// version of its source. The result carries the current version in
+// schema_version and the client's version in metadata.original_schema_version,
+// next to any other metadata the client sent. Payloads of sources without a
+// current version are returned unchanged.
+func UpgradeEvent(source string, version int, data []byte) ([]byte, error) {
+	source = strings.ToLower(source)
+	current := currentSchemaVersions[source]
+	if current == 0 {
+		return data, nil
+	}
+	if version > current {
+		return nil, fmt.Errorf("%w %d for %s, the newest is %d", ErrUnsupportedSchemaVersion, version, source, current)
+	}
+
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil || event == nil {
+		return nil, errors.New("event must be a JSON object")
+	}
+	for from := version; from < current; from++ {
+		if err := eventUpgrades[source][from](event); err != nil {
+			return nil, fmt.Errorf("error upgrading %s event from version %d: %w", source, from, err)
+		}
+	}
+
+	// Only the gateway sets original_schema_version
+	metadata, ok := event["metadata"].(map[string]interface{})
+	if !ok && event["metadata"] != nil {
+		return nil, errors.New("metadata must be a JSON object")
+	}
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["original_schema_version"] = version
+	event["schema_version"] = current
+	event["metadata"] = metadata
+	return json.Marshal(event)
+}
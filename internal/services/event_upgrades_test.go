@@ -0,0 +1,123 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// withTestSource registers a "test" source at version 3 whose upgrades
+// rename a field, for the duration of a test
+func withTestSource(t *testing.T) {
+	t.Helper()
+	currentSchemaVersions["test"] = 3
+	RegisterUpgrade("test", 1, func(event map[string]interface{}) error {
+		event["lat"] = event["latitude"]
+		delete(event, "latitude")
+		return nil
+	})
+	RegisterUpgrade("test", 2, func(event map[string]interface{}) error {
+		if _, ok := event["lat"]; !ok {
+			return errors.New("lat is missing")
+		}
+		event["position"] = map[string]interface{}{"lat": event["lat"]}
+		delete(event, "lat")
+		return nil
+	})
+	t.Cleanup(func() {
+		delete(currentSchemaVersions, "test")
+		delete(eventUpgrades, "test")
+	})
+}
+
+// decodeNumbers decodes JSON keeping numbers as written
+func decodeNumbers(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	return value
+}
+
+func TestUpgradeEvent(t *testing.T) {
+	withTestSource(t)
+
+	tests := []struct {
+		name    string
+		source  string
+		version int
+		data    string
+		want    string // "" when the payload must come back unchanged
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "upgraded through every version", source: "Test", version: 1,
+			data: `{"latitude":52.5}`,
+			want: `{"position":{"lat":52.5},"schema_version":3,"metadata":{"original_schema_version":1}}`,
+		},
+		{
+			name: "current version", source: "test", version: 3,
+			data: `{"position":{"lat":1}}`,
+			want: `{"position":{"lat":1},"schema_version":3,"metadata":{"original_schema_version":3}}`,
+		},
+		{
+			name: "client metadata kept", source: "test", version: 2,
+			data: `{"lat":1,"metadata":{"app":"agent","original_schema_version":9}}`,
+			want: `{"position":{"lat":1},"schema_version":3,"metadata":{"app":"agent","original_schema_version":2}}`,
+		},
+		{
+			name: "large numbers kept", source: "test", version: 3,
+			data: `{"id":12345678901234567890}`,
+			want: `{"id":12345678901234567890,"schema_version":3,"metadata":{"original_schema_version":3}}`,
+		},
+		{name: "unversioned source", source: "media", version: 1, data: `{"metadata":"free-form", "b":1}`},
+		{name: "unversioned source at any version", source: "media", version: 7, data: `[1,2]`},
+		{name: "newer than current", source: "test", version: 4, data: `{}`, err: ErrUnsupportedSchemaVersion},
+		{name: "metadata not an object", source: "test", version: 3, data: `{"metadata":"x"}`, wantErr: true},
+		{name: "not an object", source: "test", version: 3, data: `[1]`, wantErr: true},
+		{name: "null", source: "test", version: 3, data: `null`, wantErr: true},
+		{name: "failing upgrade", source: "test", version: 2, data: `{}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UpgradeEvent(tt.source, tt.version, []byte(tt.data))
+			if (err != nil) != (tt.wantErr || tt.err != nil) || !errors.Is(err, tt.err) && tt.err != nil {
+				t.Fatalf("UpgradeEvent() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if tt.want == "" {
+				if string(got) != tt.data {
+					t.Fatalf("UpgradeEvent() = %s, want unchanged", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(decodeNumbers(t, got), decodeNumbers(t, []byte(tt.want))) {
+				t.Fatalf("UpgradeEvent() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUpgrades(t *testing.T) {
+	if err := CheckUpgrades(); err != nil {
+		t.Fatalf("CheckUpgrades() = %v", err)
+	}
+
+	withTestSource(t)
+	if err := CheckUpgrades(); err != nil {
+		t.Fatalf("CheckUpgrades() with a complete chain = %v", err)
+	}
+	delete(eventUpgrades["test"], 2)
+	if err := CheckUpgrades(); err == nil {
+		t.Fatal("CheckUpgrades() accepted a missing upgrade")
+	}
+}
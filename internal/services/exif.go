@@ -0,0 +1,222 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exifTag identifies a tag within one of the IFDs we read
+type exifTag struct {
+	ifd string
+	id  uint16
+}
+
+// exifTags lists the EXIF fields that can be extracted into media events
+var exifTags = map[string]exifTag{
+	"Make":             {"ifd0", 0x010F},
+	"Model":            {"ifd0", 0x0110},
+	"Orientation":      {"ifd0", 0x0112},
+	"Software":         {"ifd0", 0x0131},
+	"DateTime":         {"ifd0", 0x0132},
+	"ExposureTime":     {"exif", 0x829A},
+	"FNumber":          {"exif", 0x829D},
+	"ISOSpeedRatings":  {"exif", 0x8827},
+	"DateTimeOriginal": {"exif", 0x9003},
+	"FocalLength":      {"exif", 0x920A},
+	"PixelXDimension":  {"exif", 0xA002},
+	"PixelYDimension":  {"exif", 0xA003},
+	"LensModel":        {"exif", 0xA434},
+	"GPSLatitudeRef":   {"gps", 0x0001},
+	"GPSLatitude":      {"gps", 0x0002},
+	"GPSLongitudeRef":  {"gps", 0x0003},
+	"GPSLongitude":     {"gps", 0x0004},
+	"GPSAltitude":      {"gps", 0x0006},
+}
+
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// findEXIF returns the raw TIFF-structured EXIF block of a JPEG or PNG image
+func findEXIF(contentType string, data []byte) []byte {
+	switch contentType {
+	case "image/jpeg":
+		return findJPEGEXIF(data)
+	case "image/png":
+		return findPNGEXIF(data)
+	}
+	return nil
+}
+
+func findJPEGEXIF(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		// Start of scan or end of image: no more metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+func findPNGEXIF(data []byte) []byte {
+	const signatureLen = 8
+	for i := signatureLen; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil
+		}
+		if chunkType == "eXIf" {
+			return data[i+8 : i+8+length]
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			return nil
+		}
+		i = end
+	}
+	return nil
+}
+
+// parseEXIF extracts the requested fields from a TIFF-structured EXIF block.
+// Unknown fields and malformed entries are skipped.
+func parseEXIF(tiff []byte, fields []string) map[string]string {
+	if len(tiff) < 8 || len(fields) == 0 {
+		return nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	ifds := map[string]map[uint16][]byte{}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	ifds["ifd0"] = ifd0
+	// Pointer entries hold the IFD offset as their value, after the type
+	// and count fields
+	if ptr, ok := ifd0[exifIFDPointer]; ok {
+		ifds["exif"] = readIFD(tiff, order, order.Uint32(ptr[6:10]))
+	}
+	if ptr, ok := ifd0[gpsIFDPointer]; ok {
+		ifds["gps"] = readIFD(tiff, order, order.Uint32(ptr[6:10]))
+	}
+
+	result := make(map[string]string)
+	for _, field := range fields {
+		tag, ok := exifTags[field]
+		if !ok {
+			continue
+		}
+		entry, ok := ifds[tag.ifd][tag.id]
+		if !ok {
+			continue
+		}
+		if value := formatEXIFValue(tiff, order, entry); value != "" {
+			result[field] = value
+		}
+	}
+	return result
+}
+
+// readIFD returns the 12-byte entries of an IFD keyed by tag, with the tag
+// itself stripped so each value starts at the type field
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := make(map[uint16][]byte)
+	if int(offset)+2 > len(tiff) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entries[order.Uint16(tiff[start:])] = tiff[start+2 : start+12]
+	}
+	return entries
+}
+
+func formatEXIFValue(tiff []byte, order binary.ByteOrder, entry []byte) string {
+	valueType := order.Uint16(entry)
+	count := int(order.Uint32(entry[2:]))
+
+	typeSizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	size, ok := typeSizes[valueType]
+	if !ok || count <= 0 || count > 1<<16 {
+		return ""
+	}
+
+	// Values up to four bytes are stored inline, larger ones at an offset
+	raw := entry[6:10]
+	if size*count > 4 {
+		offset := int(order.Uint32(entry[6:]))
+		if offset+size*count > len(tiff) {
+			return ""
+		}
+		raw = tiff[offset : offset+size*count]
+	}
+
+	switch valueType {
+	case 2: // ASCII
+		return strings.TrimRight(string(raw[:count]), "\x00 ")
+	case 3: // SHORT
+		values := make([]string, count)
+		for i := range values {
+			values[i] = strconv.Itoa(int(order.Uint16(raw[i*2:])))
+		}
+		return strings.Join(values, ",")
+	case 4, 9: // LONG, SLONG
+		values := make([]string, count)
+		for i := range values {
+			values[i] = strconv.FormatInt(int64(int32(order.Uint32(raw[i*4:]))), 10)
+			if valueType == 4 {
+				values[i] = strconv.FormatUint(uint64(order.Uint32(raw[i*4:])), 10)
+			}
+		}
+		return strings.Join(values, ",")
+	case 5, 10: // RATIONAL, SRATIONAL
+		values := make([]string, count)
+		for i := range values {
+			num, den := order.Uint32(raw[i*8:]), order.Uint32(raw[i*8+4:])
+			if den == 0 {
+				return ""
+			}
+			if valueType == 10 {
+				values[i] = strconv.FormatFloat(float64(int32(num))/float64(int32(den)), 'f', -1, 64)
+			} else {
+				values[i] = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			}
+		}
+		return strings.Join(values, ",")
+	case 1, 7: // BYTE, UNDEFINED
+		return fmt.Sprintf("%x", raw[:count])
+	}
+	return ""
+}
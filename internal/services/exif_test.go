@@ -0,0 +1,82 @@
+package services
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testdata/exif-gps.jpg is a 16x8 JPEG with a big-endian Exif block: IFD0
+// with Make, Model, Orientation 6 and pointers to an Exif IFD and a GPS IFD
+func TestParseEXIF(t *testing.T) {
+	data, err := os.ReadFile("testdata/exif-gps.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff := findEXIF("image/jpeg", data)
+	if tiff == nil {
+		t.Fatal("findEXIF() found no Exif block")
+	}
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   map[string]string
+	}{
+		{
+			name:   "ifd0",
+			fields: []string{"Make", "Model", "Orientation"},
+			want:   map[string]string{"Make": "Chronos", "Model": "TestCam 1", "Orientation": "6"},
+		},
+		{
+			name:   "exif ifd",
+			fields: []string{"DateTimeOriginal", "ExposureTime", "ISOSpeedRatings"},
+			want:   map[string]string{"DateTimeOriginal": "2024:05:01 12:34:56", "ExposureTime": "0.008", "ISOSpeedRatings": "200"},
+		},
+		{
+			name:   "gps ifd",
+			fields: []string{"GPSLatitudeRef", "GPSLatitude", "GPSLongitudeRef", "GPSLongitude"},
+			want: map[string]string{
+				"GPSLatitudeRef":  "N",
+				"GPSLatitude":     "52,31,12.34",
+				"GPSLongitudeRef": "E",
+				"GPSLongitude":    "13,24,56.78",
+			},
+		},
+		{
+			name:   "missing and unknown fields are skipped",
+			fields: []string{"LensModel", "GPSAltitude", "NotATag", "Make"},
+			want:   map[string]string{"Make": "Chronos"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseEXIF(tiff, tt.fields); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseEXIF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindEXIF(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{name: "not a jpeg", contentType: "image/jpeg", data: []byte("GIF89a")},
+		{name: "truncated segment", contentType: "image/jpeg", data: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x40, 0x00, 'E'}},
+		{name: "no exif before scan", contentType: "image/jpeg", data: []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}},
+		{name: "png without exif", contentType: "image/png", data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00IEND\xaeB`\x82")},
+		{name: "other type", contentType: "image/gif", data: []byte("GIF89a")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findEXIF(tt.contentType, tt.data); got != nil {
+				t.Fatalf("findEXIF() = %x, want nil", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureLimiter blocks clients after repeated authentication failures:
+// MaxFailures within Window blocks the client for Block
+type FailureLimiter struct {
+	maxFailures int
+	window      time.Duration
+	block       time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*failureRecord
+	lastSweep time.Time
+}
+
+type failureRecord struct {
+	failures     int
+	windowStart  time.Time
+	blockedUntil time.Time
+}
+
+func NewFailureLimiter(maxFailures int, window, block time.Duration) *FailureLimiter {
+	if maxFailures <= 0 {
+		maxFailures = 10
+	}
+	if window <= 0 {
+		window = time.Minute
+	}
+	if block <= 0 {
+		block = window
+	}
+	return &FailureLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		block:       block,
+		clients:     make(map[string]*failureRecord),
+	}
+}
+
+// Blocked reports whether a client is blocked and for how much longer
+func (l *FailureLimiter) Blocked(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record, ok := l.clients[client]
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(record.blockedUntil)
+	return remaining, remaining > 0
+}
+
+// Fail records a failure and reports whether it got the client blocked
+func (l *FailureLimiter) Fail(client string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	record, ok := l.clients[client]
+	if !ok || now.Sub(record.windowStart) > l.window {
+		record = &failureRecord{windowStart: now}
+		l.clients[client] = record
+	}
+	record.failures++
+	if record.failures >= l.maxFailures && now.After(record.blockedUntil) {
+		record.blockedUntil = now.Add(l.block)
+		record.failures = 0
+		record.windowStart = now
+		return true
+	}
+	return false
+}
+
+// sweep drops clients whose window and block are over, at most once a window
+func (l *FailureLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for client, record := range l.clients {
+		if now.Sub(record.windowStart) > l.window && now.After(record.blockedUntil) {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wait      time.Duration // Shifts the client's window start back before the last failure
+		blockedBy int           // Failure that got the client blocked, 0 for none
+	}{
+		{name: "below the limit", failures: 2},
+		{name: "at the limit", failures: 3, blockedBy: 3},
+		{name: "window restarts", failures: 3, wait: 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewFailureLimiter(3, time.Minute, 5*time.Minute)
+			blockedBy := 0
+			for i := 1; i <= tt.failures; i++ {
+				if i == tt.failures && tt.wait > 0 {
+					limiter.clients["10.0.0.1"].windowStart = time.Now().Add(-tt.wait)
+				}
+				if limiter.Fail("10.0.0.1") {
+					blockedBy = i
+				}
+			}
+			if blockedBy != tt.blockedBy {
+				t.Fatalf("blocked by failure %d, want %d", blockedBy, tt.blockedBy)
+			}
+
+			remaining, blocked := limiter.Blocked("10.0.0.1")
+			if blocked != (tt.blockedBy > 0) || remaining > 5*time.Minute {
+				t.Fatalf("Blocked() = %v, %v", remaining, blocked)
+			}
+			if _, blocked := limiter.Blocked("10.0.0.2"); blocked {
+				t.Fatal("Blocked() for another client")
+			}
+		})
+	}
+}
+
+func TestFailureLimiterSweep(t *testing.T) {
+	limiter := NewFailureLimiter(3, time.Minute, 0)
+	limiter.Fail("10.0.0.1")
+	limiter.clients["10.0.0.1"].windowStart = time.Now().Add(-2 * time.Minute)
+	limiter.lastSweep = time.Time{}
+
+	limiter.Fail("10.0.0.2")
+	if _, ok := limiter.clients["10.0.0.1"]; ok || len(limiter.clients) != 1 {
+		t.Fatalf("clients after sweep = %v", limiter.clients)
+	}
+}
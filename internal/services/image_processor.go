@@ -0,0 +1,224 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// ErrImageTooLarge is returned for images with more pixels than the
+// source's MaxPixels, which are rejected before they are decoded
+var ErrImageTooLarge = errors.New("image dimensions exceed the pixel limit")
+
+// defaultMaxPixels bounds decoded images when a source sets no MaxPixels
+const defaultMaxPixels = 50_000_000
+
+// ImageProcessingConfig controls the privacy pipeline for one source
+type ImageProcessingConfig struct {
+	StripMetadata bool     // Re-encode without EXIF and other metadata
+	ExtractEXIF   []string // EXIF fields copied into the media event
+	Thumbnail     bool     // Store a JPEG thumbnail next to the original
+	ThumbnailSize int      // Longest thumbnail edge in pixels
+	MaxPixels     int64    // Largest width*height decoded, 0 for the default
+}
+
+// ProcessedImage is the result of running an upload through the pipeline
+type ProcessedImage struct {
+	Data      []byte
+	EXIF      map[string]string
+	Thumbnail []byte
+}
+
+// ImageProcessor strips metadata from JPEG and PNG uploads, extracts
+// selected EXIF fields and renders thumbnails. Sources without a config fall
+// back to "default"; other content types pass through untouched.
+type ImageProcessor struct {
+	configs map[string]ImageProcessingConfig
+}
+
+func NewImageProcessor(configs map[string]ImageProcessingConfig) *ImageProcessor {
+	normalized := make(map[string]ImageProcessingConfig, len(configs))
+	for source, config := range configs {
+		if config.ThumbnailSize <= 0 {
+			config.ThumbnailSize = 320
+		}
+		if config.MaxPixels <= 0 {
+			config.MaxPixels = defaultMaxPixels
+		}
+		normalized[strings.ToLower(source)] = config
+	}
+	return &ImageProcessor{configs: normalized}
+}
+
+func (p *ImageProcessor) config(source string) (ImageProcessingConfig, bool) {
+	if config, ok := p.configs[strings.ToLower(source)]; ok {
+		return config, true
+	}
+	config, ok := p.configs["default"]
+	return config, ok
+}
+
+// Applies reports whether the pipeline has anything to do for an upload
+func (p *ImageProcessor) Applies(source, contentType string) bool {
+	if p == nil || (contentType != "image/jpeg" && contentType != "image/png") {
+		return false
+	}
+	config, ok := p.config(source)
+	return ok && (config.StripMetadata || config.Thumbnail || len(config.ExtractEXIF) > 0)
+}
+
+// Process runs the configured pipeline for a source. It returns nil when
+// nothing applies to the upload.
+func (p *ImageProcessor) Process(source, contentType string, data []byte) (*ProcessedImage, error) {
+	if !p.Applies(source, contentType) {
+		return nil, nil
+	}
+	config, _ := p.config(source)
+
+	result := &ProcessedImage{Data: data}
+	tiff := findEXIF(contentType, data)
+	if len(config.ExtractEXIF) > 0 && tiff != nil {
+		result.EXIF = parseEXIF(tiff, config.ExtractEXIF)
+	}
+
+	if !config.StripMetadata && !config.Thumbnail {
+		return result, nil
+	}
+
+	// The header is enough to size the image; a small file can declare
+	// dimensions that would take gigabytes to decode
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	if int64(header.Width)*int64(header.Height) > config.MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, header.Width, header.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	// The orientation tag is lost on re-encode, so bake it into the pixels
+	if tiff != nil {
+		if value := parseEXIF(tiff, []string{"Orientation"})["Orientation"]; value != "" {
+			if orientation, err := strconv.Atoi(value); err == nil {
+				img = applyOrientation(img, orientation)
+			}
+		}
+	}
+
+	if config.StripMetadata {
+		var buf bytes.Buffer
+		if contentType == "image/png" {
+			err = png.Encode(&buf, img)
+		} else {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error re-encoding image: %w", err)
+		}
+		result.Data = buf.Bytes()
+	}
+
+	if config.Thumbnail {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail(img, config.ThumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+			return nil, fmt.Errorf("error encoding thumbnail: %w", err)
+		}
+		result.Thumbnail = buf.Bytes()
+	}
+
+	return result, nil
+}
+
+// applyOrientation rotates and flips an image according to its EXIF
+// orientation value (1-8)
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// thumbnail downscales an image so its longest edge is at most size pixels,
+// averaging the source pixels covered by each thumbnail pixel
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*h/th, (ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*w/tw, (tx+1)*w/tw
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(tx, ty, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// pngHeader returns the start of a PNG declaring the given dimensions, which
+// is all DecodeConfig reads
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+func TestImageProcessorPixelLimit(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		maxPixels int64
+		data      []byte
+		err       error
+	}{
+		{name: "within limit", maxPixels: 1200, data: small.Bytes()},
+		{name: "over limit", maxPixels: 1199, data: small.Bytes(), err: ErrImageTooLarge},
+		{name: "decompression bomb header", data: pngHeader(100000, 100000), err: ErrImageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processor := NewImageProcessor(map[string]ImageProcessingConfig{
+				"default": {StripMetadata: true, MaxPixels: tt.maxPixels},
+			})
+			_, err := processor.Process("upload", "image/png", tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Process() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestImageProcessorStripsEXIF(t *testing.T) {
+	data, err := os.ReadFile("testdata/exif-gps.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := NewImageProcessor(map[string]ImageProcessingConfig{
+		"default": {StripMetadata: true, ExtractEXIF: []string{"Model"}, Thumbnail: true, ThumbnailSize: 4},
+	})
+
+	result, err := processor.Process("upload", "image/jpeg", data)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if findEXIF("image/jpeg", result.Data) != nil {
+		t.Fatal("processed image still carries Exif data")
+	}
+	if result.EXIF["Model"] != "TestCam 1" {
+		t.Fatalf("EXIF = %v, want Model TestCam 1", result.EXIF)
+	}
+
+	// Orientation 6 rotates the 16x8 original to 8x16
+	stripped, _, err := image.DecodeConfig(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripped.Width != 8 || stripped.Height != 16 {
+		t.Fatalf("processed image is %dx%d, want 8x16", stripped.Width, stripped.Height)
+	}
+	thumb, _, err := image.DecodeConfig(bytes.NewReader(result.Thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Width != 2 || thumb.Height != 4 {
+		t.Fatalf("thumbnail is %dx%d, want 2x4", thumb.Width, thumb.Height)
+	}
+}
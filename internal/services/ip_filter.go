@@ -0,0 +1,87 @@
+package services
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Reasons an IPFilter blocks an address
+const (
+	IPDenied     = "denied"
+	IPNotAllowed = "not_allowed"
+	IPInvalid    = "invalid"
+)
+
+// IPFilter allows or blocks client addresses by CIDR. Deny entries win over
+// allow entries, and an empty allow list allows every address that isn't
+// denied. A nil IPFilter allows everything.
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter parses the allow and deny lists. Entries are CIDRs like
+// "10.0.0.0/8" or single addresses.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	filter := &IPFilter{}
+	var err error
+	if filter.allow, err = ParsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow entry: %w", err)
+	}
+	if filter.deny, err = ParsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny entry: %w", err)
+	}
+	return filter, nil
+}
+
+// ParsePrefixes parses CIDRs and single addresses
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Check returns why an address is blocked, or "" if it is allowed
+func (f *IPFilter) Check(ip string) string {
+	if f == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return IPInvalid
+	}
+	addr = addr.Unmap()
+	if containsAddr(f.deny, addr) {
+		return IPDenied
+	}
+	if len(f.allow) > 0 && !containsAddr(f.allow, addr) {
+		return IPNotAllowed
+	}
+	return ""
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package services
+
+import "testing"
+
+func TestIPFilterCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  string
+	}{
+		{name: "no lists", ip: "203.0.113.7"},
+		{name: "in blocked CIDR", deny: []string{"203.0.113.0/24"}, ip: "203.0.113.7", want: IPDenied},
+		{name: "outside blocked CIDR", deny: []string{"203.0.113.0/24"}, ip: "203.0.114.1"},
+		{name: "blocked address", deny: []string{"198.51.100.9"}, ip: "198.51.100.9", want: IPDenied},
+		{name: "unmasked blocked CIDR", deny: []string{"203.0.113.77/24"}, ip: "203.0.113.1", want: IPDenied},
+		{name: "mapped IPv4 in blocked CIDR", deny: []string{"203.0.113.0/24"}, ip: "::ffff:203.0.113.7", want: IPDenied},
+		{name: "blocked IPv6 CIDR", deny: []string{"2001:db8::/32"}, ip: "2001:db8::1", want: IPDenied},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, ip: "10.1.2.3"},
+		{name: "not allowed", allow: []string{"10.0.0.0/8"}, ip: "192.168.1.1", want: IPNotAllowed},
+		{name: "deny wins over allow", allow: []string{"10.0.0.0/8"}, deny: []string{"10.6.0.0/16"}, ip: "10.6.1.1", want: IPDenied},
+		{name: "invalid address", deny: []string{"10.0.0.0/8"}, ip: "not-an-ip", want: IPInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewIPFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("NewIPFilter() = %v", err)
+			}
+			if got := filter.Check(tt.ip); got != tt.want {
+				t.Fatalf("Check(%q) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	var filter *IPFilter
+	if got := filter.Check("not-an-ip"); got != "" {
+		t.Fatalf("nil filter Check() = %q, want allowed", got)
+	}
+}
+
+func TestNewIPFilterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+	}{
+		{name: "bad allow entry", allow: []string{"10.0.0.0/33"}},
+		{name: "bad deny entry", deny: []string{"example.com"}},
+		{name: "empty entry", deny: []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewIPFilter(tt.allow, tt.deny); err == nil {
+				t.Fatal("NewIPFilter() succeeded")
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ func NewKafkaProducer(brokers []string, developmentMode bool) *KafkaProducer {
 		"macos":    "macos-events",
 		"browser":  "browser-events",
 		"location": "location-events",
+		"media":    "media-events",
 	}
 
 	// If in development mode, we don't connect to Kafka
@@ -110,7 +111,11 @@ func (kp *KafkaProducer) SendEvent(source string, event []byte) {
 		// Default to source name as topic if not in map
 		topic = source + "-events"
 	}
+	kp.SendToTopic(topic, event)
+}
 
+// SendToTopic sends a message to a topic directly, bypassing the source mapping
+func (kp *KafkaProducer) SendToTopic(topic string, event []byte) {
 	// In development mode, just log the message
 	if kp.developmentMode {
 		// Pretty print JSON if possible
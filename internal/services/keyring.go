@@ -0,0 +1,107 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring holds per-tenant 256-bit encryption keys loaded from a local file:
+//
+//	{
+//	  "tenants": {
+//	    "default": {"active": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}},
+//	    "user123": {"active": "u1", "keys": {"u1": "<base64>"}}
+//	  }
+//	}
+//
+// New objects are encrypted with the tenant's active key and record its id,
+// so rotating means adding a key, making it active and keeping the old one
+// until nothing references it. Tenants without an entry use "default".
+type Keyring struct {
+	tenants map[string]tenantKeys
+}
+
+type tenantKeys struct {
+	active string
+	keys   map[string][]byte
+}
+
+type keyringFile struct {
+	Tenants map[string]struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	} `json:"tenants"`
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keyring: %w", err)
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing keyring: %w", err)
+	}
+
+	keyring := &Keyring{tenants: make(map[string]tenantKeys)}
+	for tenant, entry := range file.Tenants {
+		keys := make(map[string][]byte, len(entry.Keys))
+		for id, encoded := range entry.Keys {
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("key %s of tenant %s must be 32 base64-encoded bytes", id, tenant)
+			}
+			keys[id] = key
+		}
+		if _, ok := keys[entry.Active]; !ok {
+			return nil, fmt.Errorf("active key %q of tenant %s is not in its keys", entry.Active, tenant)
+		}
+		keyring.tenants[tenant] = tenantKeys{active: entry.Active, keys: keys}
+	}
+
+	if _, ok := keyring.tenants["default"]; !ok {
+		return nil, fmt.Errorf("keyring has no default tenant")
+	}
+	return keyring, nil
+}
+
+func (k *Keyring) tenant(name string) tenantKeys {
+	if keys, ok := k.tenants[name]; ok {
+		return keys
+	}
+	return k.tenants["default"]
+}
+
+// ActiveKey returns the id and key used for new objects of a tenant
+func (k *Keyring) ActiveKey(tenant string) (string, []byte) {
+	keys := k.tenant(tenant)
+	return keys.active, keys.keys[keys.active]
+}
+
+// Key returns a tenant key by id
+func (k *Keyring) Key(tenant, id string) ([]byte, bool) {
+	key, ok := k.tenant(tenant).keys[id]
+	return key, ok
+}
+
+// Keys returns all key ids of a tenant, active key first
+func (k *Keyring) Keys(tenant string) []string {
+	keys := k.tenant(tenant)
+	ids := []string{keys.active}
+	for id := range keys.keys {
+		if id != keys.active {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// tenantOf derives the tenant from an object key, which starts with the user ID
+func tenantOf(objectKey string) string {
+	tenant, _, _ := strings.Cut(objectKey, "/")
+	return tenant
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/nodelike/chronos-gateway/internal/models"
+)
+
+// Location validation rules
+const (
+	RuleLatitude    = "latitude"     // Latitude outside -90..90
+	RuleLongitude   = "longitude"    // Longitude outside -180..180
+	RuleNullIsland  = "null_island"  // Exactly 0,0, usually a missing fix
+	RuleHeading     = "heading"      // Heading outside 0..360
+	RuleSpeed       = "speed"        // Negative speed
+	RuleAccuracy    = "accuracy"     // Negative accuracy
+	RuleMaxAccuracy = "max_accuracy" // Accuracy radius above MaxAccuracy
+)
+
+// What happens to an event that breaks a rule
+const (
+	LocationReject = "reject" // Fail the request with 422
+	LocationDrop   = "drop"   // Accept the request but don't publish the event
+	LocationFlag   = "flag"   // Publish the event with the rule in quality_flags
+	LocationIgnore = "ignore" // Don't check the rule
+)
+
+// defaultLocationRules apply to rules missing from the configuration. Many
+// devices report -1 for an unknown heading or speed, so those are flagged
+// rather than rejected.
+var defaultLocationRules = map[string]string{
+	RuleLatitude:    LocationReject,
+	RuleLongitude:   LocationReject,
+	RuleNullIsland:  LocationFlag,
+	RuleHeading:     LocationFlag,
+	RuleSpeed:       LocationFlag,
+	RuleAccuracy:    LocationReject,
+	RuleMaxAccuracy: LocationFlag,
+}
+
+// LocationVerdict is the outcome of validating one event. Action is the
+// strictest action of the broken rules, and Rule the first rule that
+// demanded it.
+type LocationVerdict struct {
+	Action string
+	Rule   string
+	Reason string
+	Flags  []string
+}
+
+// LocationValidator checks location events for physically impossible
+// coordinates and motion fields
+type LocationValidator struct {
+	actions     map[string]string
+	maxAccuracy float64
+}
+
+// NewLocationValidator sets the action of each rule. maxAccuracy is the
+// largest accuracy radius in meters; 0 disables the max_accuracy rule.
+func NewLocationValidator(rules map[string]string, maxAccuracy float64) (*LocationValidator, error) {
+	actions := make(map[string]string, len(defaultLocationRules))
+	for rule, action := range defaultLocationRules {
+		actions[rule] = action
+	}
+	for rule, action := range rules {
+		rule, action = strings.ToLower(rule), strings.ToLower(action)
+		if _, ok := defaultLocationRules[rule]; !ok {
+			return nil, fmt.Errorf("unknown location rule %q", rule)
+		}
+		switch action {
+		case LocationReject, LocationDrop, LocationFlag, LocationIgnore:
+		default:
+			return nil, fmt.Errorf("unknown action %q for location rule %s", action, rule)
+		}
+		actions[rule] = action
+	}
+	if maxAccuracy <= 0 {
+		actions[RuleMaxAccuracy] = LocationIgnore
+	}
+	return &LocationValidator{actions: actions, maxAccuracy: maxAccuracy}, nil
+}
+
+// Check validates an event. A nil validator accepts everything.
+func (v *LocationValidator) Check(event *models.LocationEvent) LocationVerdict {
+	var verdict LocationVerdict
+	if v == nil {
+		return verdict
+	}
+
+	broken := func(rule, reason string) {
+		action := v.actions[rule]
+		switch action {
+		case LocationIgnore:
+			return
+		case LocationFlag:
+			verdict.Flags = append(verdict.Flags, rule)
+		}
+		if locationSeverity[action] > locationSeverity[verdict.Action] {
+			verdict.Action, verdict.Rule, verdict.Reason = action, rule, reason
+		}
+	}
+
+	if math.Abs(event.Latitude) > 90 {
+		broken(RuleLatitude, "latitude must be between -90 and 90")
+	}
+	if math.Abs(event.Longitude) > 180 {
+		broken(RuleLongitude, "longitude must be between -180 and 180")
+	}
+	if event.Latitude == 0 && event.Longitude == 0 {
+		broken(RuleNullIsland, "latitude and longitude are both 0")
+	}
+	if event.Heading < 0 || event.Heading > 360 {
+		broken(RuleHeading, "heading must be between 0 and 360")
+	}
+	if event.Speed < 0 {
+		broken(RuleSpeed, "speed must not be negative")
+	}
+	if event.Accuracy < 0 {
+		broken(RuleAccuracy, "accuracy must not be negative")
+	} else if event.Accuracy > v.maxAccuracy {
+		broken(RuleMaxAccuracy, fmt.Sprintf("accuracy is over %g meters", v.maxAccuracy))
+	}
+	return verdict
+}
+
+var locationSeverity = map[string]int{
+	"":             0,
+	LocationFlag:   1,
+	LocationDrop:   2,
+	LocationReject: 3,
+}
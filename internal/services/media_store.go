@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// StorageConfig selects and configures the object storage backend
+type StorageConfig struct {
+	Backend    string // "s3", "filesystem" or "memory"
+	S3         MinIOConfig
+	Filesystem FilesystemConfig
+	// Use the filesystem backend if the S3 backend can't be set up, instead
+	// of failing. Uploads then land on local disk, so it must be asked for.
+	FallbackToFilesystem bool
+	// Envelope-encrypt objects in the filesystem and memory backends with
+	// keys from the keyring. The S3 backend uses S3.Encryption instead.
+	EncryptFiles bool
+	Keyring      *Keyring
+}
+
+// NewStorage creates the configured backend
+func NewStorage(config StorageConfig, signer *URLSigner) (Storage, error) {
+	switch strings.ToLower(config.Backend) {
+	case "memory":
+		log.Println("Starting in-memory storage - uploaded files are lost on restart")
+		return config.encrypt(NewMemoryStorage(signer))
+	case "s3", "minio":
+		storage, err := NewS3Storage(config.S3, signer)
+		if err == nil {
+			log.Printf("[STORAGE] Using S3 bucket %s at %s", config.S3.Bucket, config.S3.Endpoint)
+			return storage, nil
+		}
+		if !config.FallbackToFilesystem {
+			return nil, fmt.Errorf("error setting up S3 storage: %w", err)
+		}
+		log.Printf("[STORAGE] WARNING: S3 storage unavailable: %v", err)
+		log.Printf("[STORAGE] WARNING: FallbackToFilesystem is set - uploads will be stored on local disk at %s, not in bucket %s", config.Filesystem.Path, config.S3.Bucket)
+	case "filesystem", "":
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+
+	log.Println("Starting filesystem storage - files will be saved to disk at", config.Filesystem.Path)
+	storage, err := NewFilesystemStorage(config.Filesystem, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating filesystem storage: %w", err)
+	}
+	return config.encrypt(storage)
+}
+
+// NewStagingStorage creates the local staging area for uploads the backend
+// can't take, encrypted like the filesystem backend
+func NewStagingStorage(path string, config StorageConfig, signer *URLSigner) (Storage, error) {
+	storage, err := NewFilesystemStorage(FilesystemConfig{Path: path}, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging storage: %w", err)
+	}
+	return config.encrypt(storage)
+}
+
+func (config StorageConfig) encrypt(storage Storage) (Storage, error) {
+	if !config.EncryptFiles {
+		return storage, nil
+	}
+	if config.Keyring == nil {
+		return nil, errors.New("file encryption requires a keyring")
+	}
+	return NewEncryptedStorage(storage, config.Keyring), nil
+}
+
+// MetaSource is the object metadata field recording the source an upload
+// was stored under
+const MetaSource = "Source"
+
+// MediaStore writes uploads to a Storage backend, running the image privacy
+// pipeline first, and serves them back for the media endpoints
+type MediaStore struct {
+	storage       Storage
+	images        *ImageProcessor
+	signer        *URLSigner
+	uploadTimeout time.Duration
+}
+
+// MediaUpload describes the objects written for one uploaded file
+type MediaUpload struct {
+	ObjectKey    string
+	ThumbnailKey string
+	Size         int64
+	EXIF         map[string]string
+	Staged       bool // Accepted locally, forwarded to the backend later
+}
+
+// NewMediaStore creates a media store. uploadTimeout bounds each upload,
+// including retries; 0 leaves it to the request context.
+func NewMediaStore(storage Storage, signer *URLSigner, imageProcessing map[string]ImageProcessingConfig, uploadTimeout time.Duration) *MediaStore {
+	return &MediaStore{
+		storage:       storage,
+		images:        NewImageProcessor(imageProcessing),
+		signer:        signer,
+		uploadTimeout: uploadTimeout,
+	}
+}
+
+// Storage returns the underlying backend
+func (m *MediaStore) Storage() Storage {
+	return m.storage
+}
+
+// Processes reports whether uploads of a type from a source go through the
+// image pipeline, which needs the whole file in memory
+func (m *MediaStore) Processes(source, contentType string) bool {
+	return m.images.Applies(source, contentType)
+}
+
+// UploadFile writes data to the backend, recording the source it came
+// from. It returns ErrStaged if the backend was unavailable and the file was
+// staged locally instead.
+func (m *MediaStore) UploadFile(ctx context.Context, source, objectName string, data []byte, contentType string) error {
+	_, err := m.storage.Put(ctx, objectName, bytes.NewReader(data), int64(len(data)), PutOptions{
+		ContentType: contentType,
+		Metadata:    map[string]string{MetaSource: source},
+	})
+	return err
+}
+
+// UploadMedia runs the source's image pipeline before writing the file, and
+// stores the thumbnail, if any, next to the original
+func (m *MediaStore) UploadMedia(ctx context.Context, source, objectName string, data []byte, contentType string) (*MediaUpload, error) {
+	if m.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.uploadTimeout)
+		defer cancel()
+	}
+
+	processed, err := m.images.Process(source, contentType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &MediaUpload{ObjectKey: objectName}
+	if processed != nil {
+		data = processed.Data
+		upload.EXIF = processed.EXIF
+	}
+
+	if err := m.UploadFile(ctx, source, objectName, data, contentType); err != nil {
+		if !errors.Is(err, ErrStaged) {
+			return nil, err
+		}
+		upload.Staged = true
+	}
+	upload.Size = int64(len(data))
+
+	if processed != nil && len(processed.Thumbnail) > 0 {
+		thumbnailKey := ThumbnailKey(objectName)
+		if err := m.UploadFile(ctx, source, thumbnailKey, processed.Thumbnail, "image/jpeg"); err != nil {
+			if !errors.Is(err, ErrStaged) {
+				// Don't leave an original behind that was reported as failed
+				m.storage.Delete(context.Background(), objectName)
+				return nil, err
+			}
+			upload.Staged = true
+		}
+		upload.ThumbnailKey = thumbnailKey
+	}
+
+	return upload, nil
+}
+
+// UploadMediaStream is UploadMedia for a file read from reader, size bytes
+// long. Files the image pipeline doesn't apply to are streamed to the
+// backend without being held in memory.
+func (m *MediaStore) UploadMediaStream(ctx context.Context, source, objectName string, reader io.Reader, size int64, contentType string) (*MediaUpload, error) {
+	if m.Processes(source, contentType) {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return m.UploadMedia(ctx, source, objectName, data, contentType)
+	}
+
+	if m.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.uploadTimeout)
+		defer cancel()
+	}
+	upload := &MediaUpload{ObjectKey: objectName, Size: size}
+	_, err := m.storage.Put(ctx, objectName, reader, size, PutOptions{
+		ContentType: contentType,
+		Metadata:    map[string]string{MetaSource: source},
+	})
+	if err != nil {
+		if !errors.Is(err, ErrStaged) {
+			return nil, err
+		}
+		upload.Staged = true
+	}
+	return upload, nil
+}
+
+// GetFile opens a stored object for reading
+func (m *MediaStore) GetFile(ctx context.Context, objectName string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	return m.storage.Get(ctx, objectName)
+}
+
+// StatFile returns metadata for a stored object
+func (m *MediaStore) StatFile(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	return m.storage.Stat(ctx, objectName)
+}
+
+// DeleteFile removes a stored object
+func (m *MediaStore) DeleteFile(ctx context.Context, objectName string) error {
+	return m.storage.Delete(ctx, objectName)
+}
+
+// DeleteMedia removes an uploaded file together with its thumbnail, and
+// returns the thumbnail's key, or "" if there was none
+func (m *MediaStore) DeleteMedia(ctx context.Context, objectName string) (string, error) {
+	thumbnailKey := ThumbnailKey(objectName)
+	if _, err := m.storage.Stat(ctx, thumbnailKey); err != nil {
+		if !errors.Is(err, ErrObjectNotFound) {
+			return "", err
+		}
+		thumbnailKey = ""
+	}
+
+	if err := m.storage.Delete(ctx, objectName); err != nil {
+		return "", err
+	}
+	if thumbnailKey != "" {
+		if err := m.storage.Delete(ctx, thumbnailKey); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return "", err
+		}
+	}
+	return thumbnailKey, nil
+}
+
+// ThumbnailKey returns the key of the thumbnail stored next to an upload.
+// The upload's extension is kept, so a.png and a.jpg don't share one.
+func ThumbnailKey(objectName string) string {
+	return objectName + ".thumb.jpg"
+}
+
+// PresignGet returns a time-limited download link from the backend
+func (m *MediaStore) PresignGet(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	return m.storage.Presign(ctx, objectName, expiry)
+}
+
+// VerifySignedLink checks a gateway-signed download link
+func (m *MediaStore) VerifySignedLink(objectName, expires, signature string) bool {
+	return m.signer.Verify(objectName, expires, signature)
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewStorage(t *testing.T) {
+	// An unknown encryption mode fails S3 setup before any network access
+	badS3 := MinIOConfig{Endpoint: "localhost:9000", Bucket: "media", Encryption: "rot13"}
+
+	tests := []struct {
+		name    string
+		config  StorageConfig
+		want    string // Type of the backend, "" for an error
+		wantErr bool
+	}{
+		{name: "memory", config: StorageConfig{Backend: "memory"}, want: "*services.MemoryStorage"},
+		{name: "filesystem", config: StorageConfig{Backend: "filesystem"}, want: "*services.FilesystemStorage"},
+		{name: "s3 failure is an error", config: StorageConfig{Backend: "s3", S3: badS3}, wantErr: true},
+		{name: "s3 failure with fallback", config: StorageConfig{Backend: "s3", S3: badS3, FallbackToFilesystem: true}, want: "*services.FilesystemStorage"},
+		{name: "unknown backend", config: StorageConfig{Backend: "tape"}, wantErr: true},
+		{name: "encryption without keyring", config: StorageConfig{Backend: "memory", EncryptFiles: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Filesystem.Path = t.TempDir()
+			storage, err := NewStorage(tt.config, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewStorage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := typeName(storage); !tt.wantErr && got != tt.want {
+				t.Fatalf("NewStorage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func typeName(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -11,6 +13,13 @@ type MetricsCollector struct {
 	LocationCounter    *prometheus.CounterVec
 	LocationLatency    *prometheus.HistogramVec
 	BatchSizeHistogram *prometheus.HistogramVec
+	UploadRejections   *prometheus.CounterVec
+	IdentityMismatches *prometheus.CounterVec
+	RateLimited        *prometheus.CounterVec
+	IPBlocked          *prometheus.CounterVec
+	LocationRejections *prometheus.CounterVec
+	SchemaRejections   *prometheus.CounterVec
+	SchemaVersions     *prometheus.CounterVec
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -21,7 +30,7 @@ func NewMetricsCollector() *MetricsCollector {
 				Name: "api_requests_total",
 				Help: "Total API requests",
 			},
-			[]string{"method", "path", "status"},
+			[]string{"method", "path", "status", "client"},
 		),
 		RequestDuration: promauto.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -54,6 +63,55 @@ func NewMetricsCollector() *MetricsCollector {
 			},
 			[]string{"source"},
 		),
+		UploadRejections: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "upload_rejections_total",
+				Help: "Total uploads rejected by content validation",
+			},
+			[]string{"source", "reason"},
+		),
+		IdentityMismatches: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "identity_mismatches_total",
+				Help: "Total payloads rejected for naming another user or device than the caller's credential",
+			},
+			[]string{"source", "field", "client"},
+		),
+		RateLimited: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rate_limited_total",
+				Help: "Total requests throttled by rate limits",
+			},
+			[]string{"route", "budget", "dimension", "client"},
+		),
+		IPBlocked: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ip_blocked_total",
+				Help: "Total requests and calls rejected by IP allow and deny lists",
+			},
+			[]string{"group", "reason"},
+		),
+		LocationRejections: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "location_validation_failures_total",
+				Help: "Total location events that broke a validation rule, by rule and the action taken",
+			},
+			[]string{"reason", "action"},
+		),
+		SchemaRejections: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "schema_validation_failures_total",
+				Help: "Total event payloads that did not match their JSON schema",
+			},
+			[]string{"source", "version"},
+		),
+		SchemaVersions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "events_by_schema_version_total",
+				Help: "Total events accepted by source and the schema version the client sent",
+			},
+			[]string{"source", "version"},
+		),
 	}
 
 	// No need to register metrics manually since promauto does it for us
@@ -70,3 +128,41 @@ func (m *MetricsCollector) RecordLocationEvent(eventType, source string, latency
 func (m *MetricsCollector) RecordBatchSize(source string, size int) {
 	m.BatchSizeHistogram.WithLabelValues(source).Observe(float64(size))
 }
+
+// RecordUploadRejection records an upload rejected by validation
+func (m *MetricsCollector) RecordUploadRejection(source, reason string) {
+	m.UploadRejections.WithLabelValues(source, reason).Inc()
+}
+
+// RecordIdentityMismatch records a payload rejected for naming another user
+// or device than the caller is bound to
+func (m *MetricsCollector) RecordIdentityMismatch(source, field, client string) {
+	m.IdentityMismatches.WithLabelValues(source, field, client).Inc()
+}
+
+// RecordRateLimited records a request throttled by a rate limit
+func (m *MetricsCollector) RecordRateLimited(route, budget, dimension, client string) {
+	m.RateLimited.WithLabelValues(route, budget, dimension, client).Inc()
+}
+
+// RecordIPBlocked records a request rejected by the IP filter of a group
+func (m *MetricsCollector) RecordIPBlocked(group, reason string) {
+	m.IPBlocked.WithLabelValues(group, reason).Inc()
+}
+
+// RecordLocationRejection records a location event that broke a validation
+// rule, and whether it was rejected, dropped or flagged
+func (m *MetricsCollector) RecordLocationRejection(reason, action string) {
+	m.LocationRejections.WithLabelValues(reason, action).Inc()
+}
+
+// RecordSchemaRejection records a payload that did not match its schema
+func (m *MetricsCollector) RecordSchemaRejection(source string, version int) {
+	m.SchemaRejections.WithLabelValues(source, strconv.Itoa(version)).Inc()
+}
+
+// RecordSchemaVersion records an accepted event by the version the client
+// sent, to tell when an old version can be retired
+func (m *MetricsCollector) RecordSchemaVersion(source string, version int) {
+	m.SchemaVersions.WithLabelValues(source, strconv.Itoa(version)).Inc()
+}
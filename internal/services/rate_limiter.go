@@ -0,0 +1,162 @@
+package services
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled at Rate tokens per second, holding at
+// most Burst tokens. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RouteLimits holds the request and event budgets of a route. Requests are
+// counted once each; events are counted per item, so a batch of 1000
+// locations takes 1000 event tokens.
+type RouteLimits struct {
+	Requests RateLimit
+	Events   RateLimit
+}
+
+// RateDecision is the outcome of taking tokens from one or more buckets,
+// reported for the tightest of them
+type RateDecision struct {
+	Allowed    bool
+	Limit      int           // Burst of the budget
+	Remaining  int           // Tokens left in the tightest bucket
+	RetryAfter time.Duration // Wait until the request would be allowed
+	Reset      time.Duration // Wait until the tightest bucket is full again
+	Dimension  string        // Kind of key that ran out, e.g. "device"
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter keeps token buckets per route, budget and client key. Buckets
+// that have refilled completely are dropped, so idle clients cost nothing.
+type RateLimiter struct {
+	routes map[string]RouteLimits
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter for routes keyed by endpoint name, e.g.
+// "locations/batch". A route also covers the endpoints below it, and "*"
+// covers every endpoint without a more specific route.
+func NewRateLimiter(routes map[string]RouteLimits) *RateLimiter {
+	normalized := make(map[string]RouteLimits, len(routes))
+	for route, limits := range routes {
+		limits.Requests = withBurst(limits.Requests)
+		limits.Events = withBurst(limits.Events)
+		normalized[strings.Trim(route, "/")] = limits
+	}
+	return &RateLimiter{
+		routes:  normalized,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// withBurst defaults the burst to one second's worth of tokens
+func withBurst(limit RateLimit) RateLimit {
+	if limit.Rate > 0 && limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return limit
+}
+
+// Route returns the name and limits of the route covering an endpoint
+func (l *RateLimiter) Route(endpoint string) (string, RouteLimits, bool) {
+	for route := endpoint; route != ""; {
+		if limits, ok := l.routes[route]; ok {
+			return route, limits, true
+		}
+		slash := strings.LastIndex(route, "/")
+		if slash < 0 {
+			break
+		}
+		route = route[:slash]
+	}
+	limits, ok := l.routes["*"]
+	return "*", limits, ok
+}
+
+// Take removes tokens from several buckets at once: either every bucket has
+// enough and all of them are charged, or none is. takes maps bucket keys of
+// the form "<dimension>:<id>" to the tokens they need.
+func (l *RateLimiter) Take(route, budget string, limit RateLimit, takes map[string]int) RateDecision {
+	decision := RateDecision{Allowed: true, Limit: limit.Burst, Remaining: limit.Burst}
+	if limit.Rate <= 0 || len(takes) == 0 {
+		return decision
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	buckets := make(map[string]*tokenBucket, len(takes))
+	for key, n := range takes {
+		bucketKey := route + "|" + budget + "|" + key
+		bucket, ok := l.buckets[bucketKey]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		} else {
+			bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate)
+			bucket.updated = now
+		}
+		buckets[bucketKey] = bucket
+
+		if bucket.tokens < float64(n) {
+			decision.Allowed = false
+			wait := time.Duration((float64(n) - bucket.tokens) / limit.Rate * float64(time.Second))
+			if n > limit.Burst || wait > decision.RetryAfter {
+				decision.RetryAfter = wait
+				decision.Dimension, _, _ = strings.Cut(key, ":")
+			}
+		}
+	}
+
+	for bucketKey, bucket := range buckets {
+		if decision.Allowed {
+			key := bucketKey[len(route)+len(budget)+2:]
+			bucket.tokens -= float64(takes[key])
+		}
+		if remaining := int(bucket.tokens); remaining < decision.Remaining {
+			decision.Remaining = max(remaining, 0)
+		}
+		if reset := time.Duration((float64(limit.Burst) - bucket.tokens) / limit.Rate * float64(time.Second)); reset > decision.Reset {
+			decision.Reset = reset
+		}
+		l.buckets[bucketKey] = bucket
+	}
+	return decision
+}
+
+// sweep drops buckets that are full again, at most once a minute
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		route, rest, _ := strings.Cut(key, "|")
+		budget, _, _ := strings.Cut(rest, "|")
+		limits := l.routes[route]
+		limit := limits.Requests
+		if budget == "events" {
+			limit = limits.Events
+		}
+		if limit.Rate <= 0 || bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
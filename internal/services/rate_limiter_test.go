@@ -0,0 +1,115 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRoute(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RouteLimits{
+		"*":                {Requests: RateLimit{Rate: 100}},
+		"/locations/batch": {Requests: RateLimit{Rate: 1}},
+		"upload-sessions":  {Requests: RateLimit{Rate: 5}},
+	})
+
+	tests := []struct {
+		endpoint string
+		want     string
+		rate     float64
+		burst    int
+	}{
+		{endpoint: "locations/batch", want: "locations/batch", rate: 1, burst: 1},
+		{endpoint: "upload-sessions/chunks", want: "upload-sessions", rate: 5, burst: 5},
+		{endpoint: "location", want: "*", rate: 100, burst: 100},
+		{endpoint: "", want: "*", rate: 100, burst: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			route, limits, ok := limiter.Route(tt.endpoint)
+			if !ok || route != tt.want || limits.Requests.Rate != tt.rate || limits.Requests.Burst != tt.burst {
+				t.Fatalf("Route() = %q %+v %v, want %q rate %v burst %d", route, limits, ok, tt.want, tt.rate, tt.burst)
+			}
+		})
+	}
+
+	if _, _, ok := NewRateLimiter(map[string]RouteLimits{"location": {}}).Route("upload"); ok {
+		t.Fatal("Route() found limits for an endpoint without a route")
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		name      string
+		takes     []map[string]int // Taken in turn, the last one is checked
+		allowed   bool
+		remaining int
+		dimension string
+	}{
+		{name: "within burst", takes: []map[string]int{{"ip:a": 1}}, allowed: true, remaining: 2},
+		{name: "burst used up", takes: []map[string]int{{"ip:a": 3}, {"ip:a": 1}}, remaining: 0, dimension: "ip"},
+		{name: "other client has its own bucket", takes: []map[string]int{{"ip:a": 3}, {"ip:b": 1}}, allowed: true, remaining: 2},
+		{name: "tightest bucket decides", takes: []map[string]int{{"device:d": 2}, {"device:d": 2, "ip:a": 2}}, remaining: 1, dimension: "device"},
+		{name: "nothing charged when one bucket is short", takes: []map[string]int{{"device:d": 3}, {"device:d": 1, "ip:a": 1}, {"ip:a": 3}}, allowed: true, remaining: 0},
+		{name: "more than the burst", takes: []map[string]int{{"ip:a": 4}}, remaining: 3, dimension: "ip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(map[string]RouteLimits{"location": {Requests: limit}})
+			var decision RateDecision
+			for _, takes := range tt.takes {
+				decision = limiter.Take("location", "requests", limit, takes)
+			}
+			if decision.Allowed != tt.allowed || decision.Remaining != tt.remaining || decision.Dimension != tt.dimension {
+				t.Fatalf("Take() = %+v, want allowed=%v remaining=%d dimension=%q", decision, tt.allowed, tt.remaining, tt.dimension)
+			}
+			if decision.Limit != limit.Burst {
+				t.Fatalf("Take() limit = %d, want %d", decision.Limit, limit.Burst)
+			}
+			if !decision.Allowed && decision.RetryAfter <= 0 {
+				t.Fatalf("Take() retry after = %v for a throttled request", decision.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 4}
+	limiter := NewRateLimiter(map[string]RouteLimits{"location": {Requests: limit}})
+	if decision := limiter.Take("location", "requests", limit, map[string]int{"ip:a": 4}); !decision.Allowed {
+		t.Fatalf("Take() = %+v", decision)
+	}
+	decision := limiter.Take("location", "requests", limit, map[string]int{"ip:a": 1})
+	if decision.Allowed || decision.RetryAfter > 500*time.Millisecond || decision.Reset > 2*time.Second {
+		t.Fatalf("Take() = %+v, want throttled for at most 500ms", decision)
+	}
+
+	// One second later two tokens are back
+	limiter.buckets["location|requests|ip:a"].updated = time.Now().Add(-time.Second)
+	if decision := limiter.Take("location", "requests", limit, map[string]int{"ip:a": 2}); !decision.Allowed {
+		t.Fatalf("Take() after refill = %+v", decision)
+	}
+
+	// Buckets that are full again are swept
+	limiter.buckets["location|requests|ip:a"].updated = time.Now().Add(-time.Minute)
+	limiter.lastSweep = time.Time{}
+	limiter.Take("location", "requests", limit, map[string]int{"ip:b": 1})
+	if _, ok := limiter.buckets["location|requests|ip:a"]; ok || len(limiter.buckets) != 1 {
+		t.Fatalf("buckets after sweep = %v", limiter.buckets)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RouteLimits{"location": {}})
+	for i := 0; i < 100; i++ {
+		if decision := limiter.Take("location", "events", RateLimit{}, map[string]int{"ip:a": 1000}); !decision.Allowed {
+			t.Fatalf("Take() = %+v without a limit", decision)
+		}
+	}
+	if len(limiter.buckets) != 0 {
+		t.Fatalf("buckets = %v without a limit", limiter.buckets)
+	}
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ErrUnknownSchemaVersion is returned for a version without a schema file
+var ErrUnknownSchemaVersion = errors.New("unknown schema version")
+
+// ErrNoSchema is returned for a source without schema files that isn't
+// listed as unvalidated
+var ErrNoSchema = errors.New("no schema for source")
+
+// SchemaError is a payload that doesn't match its schema
+type SchemaError struct {
+	Source  string
+	Version int
+	Fields  []FieldError
+}
+
+// FieldError names a failing location in the payload as a JSON pointer
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *SchemaError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Path + ": " + field.Message
+	}
+	return fmt.Sprintf("event does not match schema %s v%d: %s", e.Source, e.Version, strings.Join(messages, "; "))
+}
+
+// SchemaInfo describes a loaded schema
+type SchemaInfo struct {
+	Source  string `json:"source"`
+	Version int    `json:"version"`
+	Latest  bool   `json:"latest"`
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title,omitempty"`
+	File    string `json:"-"`
+}
+
+// SchemaRegistry validates event payloads against JSON Schema (draft
+// 2020-12) files laid out as <dir>/<source>/<version>.json, with integer
+// versions. Sources without a schema are rejected unless they are listed as
+// unvalidated. A nil SchemaRegistry validates nothing.
+type SchemaRegistry struct {
+	schemas     map[string]map[int]*jsonschema.Schema
+	latest      map[string]int
+	infos       []SchemaInfo
+	unvalidated map[string]bool
+}
+
+// LoadSchemas compiles every schema under dir. Formats such as date-time
+// are asserted, not just annotated. Payloads of the unvalidated sources are
+// accepted without a schema.
+func LoadSchemas(dir string, unvalidated []string) (*SchemaRegistry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(jsonschema.Draft2020)
+	compiler.AssertFormat()
+
+	registry := &SchemaRegistry{
+		schemas:     make(map[string]map[int]*jsonschema.Schema),
+		latest:      make(map[string]int),
+		unvalidated: make(map[string]bool),
+	}
+	for _, source := range unvalidated {
+		registry.unvalidated[strings.ToLower(source)] = true
+	}
+	for _, file := range files {
+		source := strings.ToLower(filepath.Base(filepath.Dir(file)))
+		version, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("schema file %s must be named <version>.json with a positive integer version", file)
+		}
+		schema, err := compiler.Compile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling %s: %w", file, err)
+		}
+
+		if registry.schemas[source] == nil {
+			registry.schemas[source] = make(map[int]*jsonschema.Schema)
+		}
+		registry.schemas[source][version] = schema
+		registry.latest[source] = max(registry.latest[source], version)
+		if registry.unvalidated[source] {
+			return nil, fmt.Errorf("source %s has schema %s but is listed as unvalidated", source, file)
+		}
+		registry.infos = append(registry.infos, SchemaInfo{
+			Source:  source,
+			Version: version,
+			ID:      schema.ID,
+			Title:   schema.Title,
+			File:    file,
+		})
+	}
+
+	for i := range registry.infos {
+		info := &registry.infos[i]
+		info.Latest = registry.latest[info.Source] == info.Version
+	}
+	sort.Slice(registry.infos, func(i, j int) bool {
+		a, b := registry.infos[i], registry.infos[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Version < b.Version
+	})
+	log.Printf("Loaded %d event schemas from %s", len(registry.infos), dir)
+	return registry, nil
+}
+
+// List returns the loaded schemas by source and version
+func (r *SchemaRegistry) List() []SchemaInfo {
+	if r == nil {
+		return []SchemaInfo{}
+	}
+	return r.infos
+}
+
+// Info returns a loaded schema's description
+func (r *SchemaRegistry) Info(source string, version int) (SchemaInfo, bool) {
+	for _, info := range r.List() {
+		if info.Source == strings.ToLower(source) && info.Version == version {
+			return info, true
+		}
+	}
+	return SchemaInfo{}, false
+}
+
+// Validate checks a JSON payload against the schema of a source. Version 0
+// picks the latest schema. It returns a *SchemaError naming the failing
+// fields if the payload doesn't match, and ErrNoSchema for a source without
+// a schema that isn't listed as unvalidated.
+func (r *SchemaRegistry) Validate(source string, version int, data []byte) error {
+	if r == nil {
+		return nil
+	}
+	source = strings.ToLower(source)
+	versions, ok := r.schemas[source]
+	if !ok {
+		if r.unvalidated[source] {
+			return nil
+		}
+		return fmt.Errorf("%w %s", ErrNoSchema, source)
+	}
+	if version == 0 {
+		version = r.latest[source]
+	}
+	schema, ok := versions[version]
+	if !ok {
+		return fmt.Errorf("%w %d for %s", ErrUnknownSchemaVersion, version, source)
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	err = schema.Validate(instance)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+
+	schemaErr := &SchemaError{Source: source, Version: version}
+	output := validationErr.BasicOutput()
+	for _, unit := range append(output.Errors, *output) {
+		if unit.Error == nil {
+			continue
+		}
+		schemaErr.Fields = append(schemaErr.Fields, FieldError{Path: unit.InstanceLocation, Message: unit.Error.String()})
+	}
+	return schemaErr
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSchema writes a schema requiring field to <dir>/<source>/<version>.json
+func writeSchema(t *testing.T, dir, source, version, field string) {
+	t.Helper()
+	schema := `{"type":"object","required":["` + field + `"],"properties":{"` + field + `":{"type":"number"},"timestamp":{"type":"string","format":"date-time"}}}`
+	if err := os.MkdirAll(filepath.Join(dir, source), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, source, version+".json"), []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaRegistryValidate(t *testing.T) {
+	dir := t.TempDir()
+	writeSchema(t, dir, "location", "1", "latitude")
+	writeSchema(t, dir, "location", "2", "lat")
+	registry, err := LoadSchemas(dir, []string{"MacOS"})
+	if err != nil {
+		t.Fatalf("LoadSchemas() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		version int
+		data    string
+		err     error
+		fields  []string // Paths of a *SchemaError
+	}{
+		{name: "valid", source: "location", version: 1, data: `{"latitude":1}`},
+		{name: "source case", source: "Location", version: 1, data: `{"latitude":1}`},
+		{name: "latest by default", source: "location", data: `{"lat":1}`},
+		{name: "missing field", source: "location", version: 1, data: `{"lat":1}`, fields: []string{""}},
+		{name: "wrong type", source: "location", version: 2, data: `{"lat":"north"}`, fields: []string{"/lat"}},
+		{name: "format asserted", source: "location", version: 1, data: `{"latitude":1,"timestamp":"yesterday"}`, fields: []string{"/timestamp"}},
+		{name: "unknown version", source: "location", version: 3, data: `{"lat":1}`, err: ErrUnknownSchemaVersion},
+		{name: "source without schema", source: "android", version: 1, data: `{}`, err: ErrNoSchema},
+		{name: "unvalidated source", source: "macos", version: 1, data: `{"anything":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := registry.Validate(tt.source, tt.version, []byte(tt.data))
+			if tt.fields != nil {
+				var schemaErr *SchemaError
+				if !errors.As(err, &schemaErr) || len(schemaErr.Fields) == 0 {
+					t.Fatalf("Validate() = %v, want a schema error", err)
+				}
+				for _, path := range tt.fields {
+					found := false
+					for _, field := range schemaErr.Fields {
+						found = found || field.Path == path
+					}
+					if !found {
+						t.Fatalf("Validate() fields = %+v, want %q", schemaErr.Fields, path)
+					}
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("Validate() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// A nil registry validates nothing
+	var disabled *SchemaRegistry
+	if err := disabled.Validate("android", 1, []byte(`{}`)); err != nil {
+		t.Fatalf("nil registry Validate() = %v", err)
+	}
+}
+
+func TestLoadSchemas(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string // Source/version to required field
+		unvalidated []string
+		wantErr     bool
+		infos       []SchemaInfo
+	}{
+		{
+			name:  "versions sorted and latest marked",
+			files: map[string]string{"location/2": "lat", "location/1": "latitude", "Android/1": "app"},
+			infos: []SchemaInfo{{Source: "android", Version: 1, Latest: true}, {Source: "location", Version: 1}, {Source: "location", Version: 2, Latest: true}},
+		},
+		{name: "version not a number", files: map[string]string{"location/v1": "lat"}, wantErr: true},
+		{name: "version zero", files: map[string]string{"location/0": "lat"}, wantErr: true},
+		{name: "unvalidated source with a schema", files: map[string]string{"location/1": "lat"}, unvalidated: []string{"location"}, wantErr: true},
+		{name: "shipped schemas", infos: []SchemaInfo{{Source: "android", Version: 1, Latest: true}, {Source: "browser", Version: 1, Latest: true}, {Source: "location", Version: 1, Latest: true}, {Source: "macos", Version: 1, Latest: true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := "../../schemas"
+			if tt.files != nil {
+				dir = t.TempDir()
+				for name, field := range tt.files {
+					writeSchema(t, dir, filepath.Dir(name), filepath.Base(name), field)
+				}
+			}
+			registry, err := LoadSchemas(dir, tt.unvalidated)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadSchemas() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			infos := registry.List()
+			if len(infos) != len(tt.infos) {
+				t.Fatalf("List() = %+v, want %+v", infos, tt.infos)
+			}
+			for i, info := range infos {
+				want := tt.infos[i]
+				if info.Source != want.Source || info.Version != want.Version || info.Latest != want.Latest {
+					t.Fatalf("List()[%d] = %+v, want %+v", i, info, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Object metadata written by the encryption layers
+const (
+	metaKeyID      = "Key-Id"
+	metaEncryption = "Encryption"
+	metaWrappedKey = "Wrapped-Key"
+	metaNonce      = "Nonce"
+	metaPlainSize  = "Plaintext-Size"
+
+	envelopeScheme    = "aes-256-gcm-chunked"
+	envelopeChunkSize = 64 * 1024
+)
+
+// EncryptedStorage adds AES-GCM envelope encryption to a backend that has no
+// encryption of its own, such as the filesystem. Every object gets a random
+// data key, which is wrapped with the tenant's active keyring key and stored
+// in the object metadata together with the key id. Content is encrypted in
+// 64 KiB chunks so reads can seek without decrypting the whole object.
+// Objects written before encryption was enabled are returned as stored.
+type EncryptedStorage struct {
+	backend Storage
+	keyring *Keyring
+}
+
+func NewEncryptedStorage(backend Storage, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{backend: backend, keyring: keyring}
+}
+
+func (s *EncryptedStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	// The plaintext size goes into the metadata, so it must be known upfront
+	if size < 0 {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	keyID, kek := s.keyring.ActiveKey(tenantOf(key))
+	dataKey := make([]byte, 32)
+	baseNonce := make([]byte, 12)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(baseNonce); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := sealWithKey(kek, dataKey, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string, len(opts.Metadata)+5)
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaEncryption] = envelopeScheme
+	metadata[metaKeyID] = keyID
+	metadata[metaWrappedKey] = base64.StdEncoding.EncodeToString(wrapped)
+	metadata[metaNonce] = base64.StdEncoding.EncodeToString(baseNonce)
+	metadata[metaPlainSize] = strconv.FormatInt(size, 10)
+
+	encrypted := &encryptingReader{src: bufio.NewReaderSize(reader, envelopeChunkSize), aead: aead, baseNonce: baseNonce}
+	info, err := s.backend.Put(ctx, key, encrypted, envelopeCipherSize(size), PutOptions{ContentType: opts.ContentType, Metadata: metadata})
+	if err != nil {
+		return info, err
+	}
+	return plaintextInfo(info), nil
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	object, info, err := s.backend.Get(ctx, key)
+	if err != nil || info.Metadata[metaEncryption] != envelopeScheme {
+		return object, info, err
+	}
+
+	aead, baseNonce, size, err := s.openEnvelope(key, info.Metadata)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	return &decryptingReader{src: object, aead: aead, baseNonce: baseNonce, size: size, chunk: -1}, plaintextInfo(info), nil
+}
+
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.backend.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return plaintextInfo(info), nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, key)
+}
+
+func (s *EncryptedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		objects[i] = *plaintextInfo(&objects[i])
+	}
+	return objects, nil
+}
+
+func (s *EncryptedStorage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.backend.Presign(ctx, key, expiry)
+}
+
+// Compose decrypts the sources and encrypts the result under a new data key
+func (s *EncryptedStorage) Compose(ctx context.Context, key string, sources []string, opts PutOptions) (*ObjectInfo, error) {
+	return concatObjects(ctx, s, key, sources, opts)
+}
+
+// openEnvelope unwraps an object's data key with the keyring key it names
+func (s *EncryptedStorage) openEnvelope(key string, metadata map[string]string) (cipher.AEAD, []byte, int64, error) {
+	keyID := metadata[metaKeyID]
+	kek, ok := s.keyring.Key(tenantOf(key), keyID)
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("encryption key %q not in keyring", keyID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[metaWrappedKey])
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	baseNonce, err := base64.StdEncoding.DecodeString(metadata[metaNonce])
+	if err != nil || len(baseNonce) != 12 {
+		return nil, nil, 0, errors.New("invalid object nonce")
+	}
+	size, err := strconv.ParseInt(metadata[metaPlainSize], 10, 64)
+	if err != nil {
+		return nil, nil, 0, errors.New("invalid plaintext size")
+	}
+
+	dataKey, err := openWithKey(kek, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return aead, baseNonce, size, nil
+}
+
+// plaintextInfo reports the plaintext size and hides the envelope fields
+func plaintextInfo(info *ObjectInfo) *ObjectInfo {
+	if info == nil || info.Metadata[metaEncryption] != envelopeScheme {
+		return info
+	}
+	result := *info
+	result.Metadata = make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		if k != metaWrappedKey && k != metaNonce && k != metaPlainSize {
+			result.Metadata[k] = v
+		}
+	}
+	if size, err := strconv.ParseInt(info.Metadata[metaPlainSize], 10, 64); err == nil {
+		result.Size = size
+	}
+	return &result
+}
+
+// withoutEncryptionMetadata copies metadata without the fields written by
+// the encryption layers. They describe how one backend stored the object, so
+// they are dropped when the object is copied to another.
+func withoutEncryptionMetadata(metadata map[string]string) map[string]string {
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		switch k {
+		case metaKeyID, metaEncryption, metaWrappedKey, metaNonce, metaPlainSize:
+		default:
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWithKey encrypts data with a random nonce prepended to the output
+func sealWithKey(key, data, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, additional), nil
+}
+
+func openWithKey(key, sealed, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// envelopeCipherSize is the stored size of a plaintext of the given size.
+// An empty object is still one (empty) chunk.
+func envelopeCipherSize(size int64) int64 {
+	chunks := (size + envelopeChunkSize - 1) / envelopeChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*16
+}
+
+// chunkNonce derives the nonce of a chunk from the object's base nonce
+func chunkNonce(base []byte, index int64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	counter := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(index)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// chunkAAD binds a chunk to its position and marks the final chunk, so chunks
+// can't be reordered and objects can't be truncated
+func chunkAAD(index int64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+type encryptingReader struct {
+	src       *bufio.Reader
+	aead      cipher.AEAD
+	baseNonce []byte
+	index     int64
+	buf       []byte
+	done      bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		plain := make([]byte, envelopeChunkSize)
+		n, err := io.ReadFull(r.src, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// The chunk is last if nothing follows it
+		_, peekErr := r.src.Peek(1)
+		last := peekErr != nil
+		if last && peekErr != io.EOF {
+			return 0, peekErr
+		}
+		r.buf = r.aead.Seal(nil, chunkNonce(r.baseNonce, r.index), plain[:n], chunkAAD(r.index, last))
+		r.index++
+		r.done = last
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type decryptingReader struct {
+	src       io.ReadSeekCloser
+	aead      cipher.AEAD
+	baseNonce []byte
+	size      int64
+	pos       int64
+	chunk     int64 // Index of the chunk in plain, -1 if none
+	plain     []byte
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / envelopeChunkSize
+	if index != r.chunk {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*envelopeChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) load(index int64) error {
+	lastIndex := (r.size - 1) / envelopeChunkSize
+	if r.size == 0 {
+		lastIndex = 0
+	}
+	length := int64(envelopeChunkSize)
+	if index == lastIndex {
+		length = r.size - index*envelopeChunkSize
+	}
+
+	if _, err := r.src.Seek(index*(envelopeChunkSize+16), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, length+16)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return fmt.Errorf("error reading encrypted chunk: %w", err)
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.baseNonce, index), sealed, chunkAAD(index, index == lastIndex))
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %w", index, err)
+	}
+	r.chunk, r.plain = index, plain
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
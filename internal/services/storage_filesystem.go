@@ -0,0 +1,391 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fsTempDir     = ".tmp"
+	fsMetadataDir = ".meta"
+)
+
+// FilesystemConfig configures the local directory backend
+type FilesystemConfig struct {
+	Path          string
+	PrefixQuota   int64            // Bytes allowed under each top-level (user) prefix but .sessions/, 0 for unlimited
+	Quotas        map[string]int64 // Bytes allowed under specific prefixes
+	MaxAge        time.Duration    // Objects older than this are swept, 0 to keep forever
+	SweepInterval time.Duration
+}
+
+// FilesystemStorage stores objects as files below a root directory. Writes go
+// to a temporary file first and are renamed into place, so readers never see
+// partial objects. Content type and metadata live in JSON sidecars under .meta.
+type FilesystemStorage struct {
+	root   string
+	config FilesystemConfig
+	signer *URLSigner
+	mu     sync.Mutex       // Serializes quota checks with writes and deletes
+	usage  map[string]int64 // Bytes under each quota prefix, counted on first use
+}
+
+type fsMetadata struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func NewFilesystemStorage(config FilesystemConfig, signer *URLSigner) (*FilesystemStorage, error) {
+	if config.Path == "" {
+		config.Path = "./storage"
+	}
+	root, err := filepath.Abs(config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{root, filepath.Join(root, fsTempDir), filepath.Join(root, fsMetadataDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating storage directory: %w", err)
+		}
+	}
+
+	storage := &FilesystemStorage{root: root, config: config, signer: signer, usage: make(map[string]int64)}
+	if config.MaxAge > 0 {
+		go storage.sweep()
+	}
+	return storage, nil
+}
+
+// path resolves a key inside the root, refusing keys that would escape it or
+// reach the internal directories
+func (s *FilesystemStorage) path(key string) (string, error) {
+	full := filepath.Join(s.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(full, s.root+string(filepath.Separator)) {
+		return "", ErrObjectNotFound
+	}
+	first := strings.SplitN(filepath.ToSlash(strings.TrimPrefix(full, s.root+string(filepath.Separator))), "/", 2)[0]
+	if first == fsTempDir || first == fsMetadataDir {
+		return "", ErrObjectNotFound
+	}
+	return full, nil
+}
+
+func (s *FilesystemStorage) metadataPath(key string) string {
+	return filepath.Join(s.root, fsMetadataDir, filepath.FromSlash(key)+".json")
+}
+
+func (s *FilesystemStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stream into a temporary file so a failed write leaves no partial object
+	tmp, err := os.CreateTemp(filepath.Join(s.root, fsTempDir), "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, reader)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing file: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.storedSize(key)
+	if err := s.checkQuota(key, written, existing); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	if err := s.writeMetadata(key, fsMetadata{ContentType: opts.ContentType, Metadata: opts.Metadata}); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return nil, fmt.Errorf("error moving file into place: %w", err)
+	}
+	s.charge(key, written-existing)
+
+	log.Printf("[STORAGE] Saved file to %s (%d bytes)", target, written)
+	return &ObjectInfo{
+		Key:          key,
+		Size:         written,
+		ContentType:  opts.ContentType,
+		LastModified: time.Now(),
+		Metadata:     opts.Metadata,
+	}, nil
+}
+
+func (s *FilesystemStorage) writeMetadata(key string, meta fsMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metaPath := s.metadataPath(key)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return fmt.Errorf("error creating metadata directory: %w", err)
+	}
+	tmp := metaPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing metadata: %w", err)
+	}
+	return os.Rename(tmp, metaPath)
+}
+
+// quotas returns the limit of each prefix a key counts against. Keys under
+// internal prefixes like .sessions/ don't belong to a user and only count
+// against explicit Quotas.
+func (s *FilesystemStorage) quotas(key string) map[string]int64 {
+	quotas := make(map[string]int64)
+	for prefix, limit := range s.config.Quotas {
+		if strings.HasPrefix(key, prefix) {
+			quotas[prefix] = limit
+		}
+	}
+	if s.config.PrefixQuota > 0 && !strings.HasPrefix(key, ".") {
+		if i := strings.Index(key, "/"); i > 0 {
+			quotas[key[:i+1]] = s.config.PrefixQuota
+		}
+	}
+	return quotas
+}
+
+// storedSize returns the size of an existing object, 0 if there is none
+func (s *FilesystemStorage) storedSize(key string) int64 {
+	if target, err := s.path(key); err == nil {
+		if stat, err := os.Stat(target); err == nil && !stat.IsDir() {
+			return stat.Size()
+		}
+	}
+	return 0
+}
+
+// checkQuota rejects a write that would push any matching prefix over its
+// quota. Overwrites of an existing key only count the size difference. The
+// caller holds s.mu.
+func (s *FilesystemStorage) checkQuota(key string, size, existing int64) error {
+	for prefix, limit := range s.quotas(key) {
+		used, err := s.used(prefix)
+		if err != nil {
+			return err
+		}
+		if used-existing+size > limit {
+			return fmt.Errorf("%w for %s", ErrQuotaExceeded, prefix)
+		}
+	}
+	return nil
+}
+
+// used returns the bytes stored under a quota prefix. The prefix is walked
+// the first time only; after that writes and deletes keep the count. The
+// caller holds s.mu.
+func (s *FilesystemStorage) used(prefix string) (int64, error) {
+	if used, ok := s.usage[prefix]; ok {
+		return used, nil
+	}
+	objects, err := s.List(context.Background(), prefix)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+	s.usage[prefix] = total
+	return total, nil
+}
+
+// charge adds delta bytes to the counted prefixes of a key. The caller holds
+// s.mu.
+func (s *FilesystemStorage) charge(key string, delta int64) {
+	for prefix := range s.quotas(key) {
+		if _, ok := s.usage[prefix]; ok {
+			s.usage[prefix] += delta
+		}
+	}
+}
+
+func (s *FilesystemStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, _ := s.path(key)
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening file: %w", err)
+	}
+	return file, info, nil
+}
+
+func (s *FilesystemStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(target)
+	if err != nil || stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return s.objectInfo(key, stat), nil
+}
+
+func (s *FilesystemStorage) objectInfo(key string, stat fs.FileInfo) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+	}
+
+	// Files written before sidecars existed fall back to the extension
+	if data, err := os.ReadFile(s.metadataPath(key)); err == nil {
+		var meta fsMetadata
+		if json.Unmarshal(data, &meta) == nil {
+			info.ContentType = meta.ContentType
+			info.Metadata = meta.Metadata
+		}
+	}
+	if info.ContentType == "" {
+		info.ContentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+	if info.ContentType == "" {
+		info.ContentType = "application/octet-stream"
+	}
+	return info
+}
+
+func (s *FilesystemStorage) Delete(ctx context.Context, key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := s.storedSize(key)
+	if err := os.Remove(target); err != nil {
+		if os.IsNotExist(err) {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("error deleting file: %w", err)
+	}
+	s.charge(key, -size)
+	os.Remove(s.metadataPath(key))
+	log.Printf("[STORAGE] Deleted file %s", target)
+	return nil
+}
+
+func (s *FilesystemStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel := filepath.ToSlash(strings.TrimPrefix(path, s.root+string(filepath.Separator)))
+		if entry.IsDir() {
+			if path == s.root {
+				return nil
+			}
+			if rel == fsTempDir || rel == fsMetadataDir {
+				return filepath.SkipDir
+			}
+			// Skip directories that can't contain matching keys
+			if !strings.HasPrefix(rel+"/", prefix) && !strings.HasPrefix(prefix, rel+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, *s.objectInfo(rel, stat))
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *FilesystemStorage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.signer.Sign(key, time.Now().Add(expiry)), nil
+}
+
+// Compose concatenates the source files into the target file
+func (s *FilesystemStorage) Compose(ctx context.Context, key string, sources []string, opts PutOptions) (*ObjectInfo, error) {
+	return concatObjects(ctx, s, key, sources, opts)
+}
+
+// sweep periodically deletes objects older than MaxAge and prunes the
+// directories they leave empty
+func (s *FilesystemStorage) sweep() {
+	interval := s.config.SweepInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		objects, err := s.List(context.Background(), "")
+		if err != nil {
+			log.Printf("[STORAGE] Sweep failed: %v", err)
+			continue
+		}
+
+		cutoff := time.Now().Add(-s.config.MaxAge)
+		removed := 0
+		for _, object := range objects {
+			if object.LastModified.Before(cutoff) && s.Delete(context.Background(), object.Key) == nil {
+				removed++
+				s.pruneEmptyDirs(object.Key)
+			}
+		}
+		if removed > 0 {
+			log.Printf("[STORAGE] Swept %d objects older than %s", removed, s.config.MaxAge)
+		}
+	}
+}
+
+func (s *FilesystemStorage) pruneEmptyDirs(key string) {
+	for dir := filepath.Dir(key); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		// os.Remove fails on non-empty directories, which ends the walk up
+		if os.Remove(filepath.Join(s.root, dir)) != nil {
+			return
+		}
+		os.Remove(filepath.Join(s.root, fsMetadataDir, dir))
+	}
+}
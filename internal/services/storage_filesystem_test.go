@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFilesystemStorageQuota(t *testing.T) {
+	type write struct {
+		key    string
+		size   int
+		delete bool
+		err    error
+	}
+
+	tests := []struct {
+		name   string
+		quotas map[string]int64
+		writes []write
+	}{
+		{
+			name: "user prefix",
+			writes: []write{
+				{key: "user-1/a", size: 6},
+				{key: "user-1/b", size: 5, err: ErrQuotaExceeded},
+				{key: "user-2/a", size: 10},
+			},
+		},
+		{
+			name: "overwrite counts the difference",
+			writes: []write{
+				{key: "user-1/a", size: 8},
+				{key: "user-1/a", size: 10},
+				{key: "user-1/b", size: 1, err: ErrQuotaExceeded},
+			},
+		},
+		{
+			name: "delete frees space",
+			writes: []write{
+				{key: "user-1/a", size: 8},
+				{key: "user-1/a", delete: true},
+				{key: "user-1/b", size: 10},
+			},
+		},
+		{
+			name: "sessions are not one user",
+			writes: []write{
+				{key: ".sessions/s1/chunk-0", size: 10},
+				{key: ".sessions/s2/chunk-0", size: 10},
+				{key: "user-1/a", size: 10},
+			},
+		},
+		{
+			name:   "explicit quota on sessions",
+			quotas: map[string]int64{".sessions/": 15},
+			writes: []write{
+				{key: ".sessions/s1/chunk-0", size: 10},
+				{key: ".sessions/s2/chunk-0", size: 10, err: ErrQuotaExceeded},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, err := NewFilesystemStorage(FilesystemConfig{Path: t.TempDir(), PrefixQuota: 10, Quotas: tt.quotas}, nil)
+			if err != nil {
+				t.Fatalf("NewFilesystemStorage() = %v", err)
+			}
+			ctx := context.Background()
+			for i, w := range tt.writes {
+				if w.delete {
+					err = storage.Delete(ctx, w.key)
+				} else {
+					_, err = storage.Put(ctx, w.key, strings.NewReader(strings.Repeat("x", w.size)), int64(w.size), PutOptions{})
+				}
+				if !errors.Is(err, w.err) {
+					t.Fatalf("write %d to %s = %v, want %v", i, w.key, err, w.err)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesystemStorageUsageCounted(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewFilesystemStorage(FilesystemConfig{Path: dir}, nil)
+	ctx := context.Background()
+	storage.Put(ctx, "user-1/a", strings.NewReader("12345"), 5, PutOptions{})
+
+	// Usage already on disk is found on the first write after a restart,
+	// and counted from then on without walking the prefix again
+	storage, _ = NewFilesystemStorage(FilesystemConfig{Path: dir, PrefixQuota: 10}, nil)
+	storage.Put(ctx, "user-1/b", strings.NewReader("123"), 3, PutOptions{})
+	if used := storage.usage["user-1/"]; used != 8 {
+		t.Fatalf("usage = %d, want 8", used)
+	}
+	storage.Delete(ctx, "user-1/a")
+	if used := storage.usage["user-1/"]; used != 3 {
+		t.Fatalf("usage after delete = %d, want 3", used)
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps objects in memory. It is meant for tests and local
+// runs where nothing should touch disk or the network.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	signer  *URLSigner
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+func NewMemoryStorage(signer *URLSigner) *MemoryStorage {
+	return &MemoryStorage{
+		objects: make(map[string]memoryObject),
+		signer:  signer,
+	}
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum(data)
+	info := ObjectInfo{
+		Key:          key,
+		Size:         int64(len(data)),
+		ContentType:  opts.ContentType,
+		LastModified: time.Now(),
+		ETag:         hex.EncodeToString(sum[:]),
+		Metadata:     opts.Metadata,
+	}
+
+	s.mu.Lock()
+	s.objects[key] = memoryObject{data: data, info: info}
+	s.mu.Unlock()
+
+	return &info, nil
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrObjectNotFound
+	}
+	info := object.info
+	return nopSeekCloser{bytes.NewReader(object.data)}, &info, nil
+}
+
+func (s *MemoryStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	info := object.info
+	return &info, nil
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return ErrObjectNotFound
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	var objects []ObjectInfo
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object.info)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *MemoryStorage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.signer.Sign(key, time.Now().Add(expiry)), nil
+}
+
+func (s *MemoryStorage) Compose(ctx context.Context, key string, sources []string, opts PutOptions) (*ObjectInfo, error) {
+	return concatObjects(ctx, s, key, sources, opts)
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
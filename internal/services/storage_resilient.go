@@ -0,0 +1,356 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned without calling the backend while it is
+	// considered down
+	ErrCircuitOpen = errors.New("storage unavailable: circuit open")
+	// ErrStaged is returned by Put, together with the object info, when the
+	// object was accepted into the local staging area instead of the backend
+	ErrStaged = errors.New("object staged for later upload")
+)
+
+// ResilienceConfig controls retries, circuit breaking and staging
+type ResilienceConfig struct {
+	MaxAttempts      int           // Attempts per call, including the first
+	BaseDelay        time.Duration // Backoff before the first retry, doubled each time
+	MaxDelay         time.Duration
+	FailureThreshold int           // Consecutive failures that open the circuit
+	OpenTimeout      time.Duration // How long the circuit stays open before a trial call
+	ForwardInterval  time.Duration // How often staged objects are retried
+}
+
+// ResilientStorage wraps a backend with retries, a circuit breaker and an
+// optional staging area. Failed uploads are written to staging and forwarded
+// to the backend in the background once it recovers.
+type ResilientStorage struct {
+	backend Storage
+	staging Storage
+	config  ResilienceConfig
+	breaker *circuitBreaker
+}
+
+// NewResilientStorage wraps backend. staging, usually a local filesystem
+// store, receives uploads the backend rejects; nil disables staging.
+func NewResilientStorage(backend, staging Storage, config ResilienceConfig) *ResilientStorage {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 200 * time.Millisecond
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = 5 * time.Second
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 30 * time.Second
+	}
+	if config.ForwardInterval <= 0 {
+		config.ForwardInterval = 30 * time.Second
+	}
+
+	storage := &ResilientStorage{
+		backend: backend,
+		staging: staging,
+		config:  config,
+		breaker: &circuitBreaker{threshold: config.FailureThreshold, openTimeout: config.OpenTimeout},
+	}
+	if staging != nil {
+		go storage.forward()
+	}
+
+	return storage
+}
+
+// transient reports whether an error may go away on retry. Missing objects,
+// full quotas and rejected requests are answers from a working backend.
+func transient(err error) bool {
+	return err != nil && !errors.Is(err, ErrObjectNotFound) && !errors.Is(err, ErrQuotaExceeded) && !errors.Is(err, ErrPermanent)
+}
+
+// call runs fn with retries and jittered exponential backoff, going through
+// the circuit breaker. Only transient errors are retried and count as
+// failures; calls the caller cancelled count as neither.
+func (s *ResilientStorage) call(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < s.config.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := s.config.BaseDelay << (attempt - 1)
+			if delay > s.config.MaxDelay || delay <= 0 {
+				delay = s.config.MaxDelay
+			}
+			// Full jitter spreads retries from many requests
+			delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		allowed, trial := s.breaker.allow()
+		if !allowed {
+			return ErrCircuitOpen
+		}
+		err = fn()
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about the backend
+			if trial {
+				s.breaker.release()
+			}
+			return err
+		}
+		if !transient(err) {
+			s.breaker.success()
+			return err
+		}
+		s.breaker.failure()
+	}
+	return err
+}
+
+func (s *ResilientStorage) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	// Retries need to rewind the reader; unseekable readers get one attempt
+	seeker, seekable := reader.(io.Seeker)
+
+	var info *ObjectInfo
+	attempt := 0
+	err := s.call(ctx, func() error {
+		if attempt > 0 {
+			if !seekable {
+				return fmt.Errorf("%w: cannot retry unseekable upload", ErrPermanent)
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		attempt++
+		var err error
+		info, err = s.backend.Put(ctx, key, reader, size, opts)
+		return err
+	})
+	// Only uploads the backend couldn't take are staged; rejected ones would
+	// be rejected again when forwarded
+	if !transient(err) || s.staging == nil || !seekable || ctx.Err() != nil {
+		return info, err
+	}
+
+	// Keep the upload locally and forward it once the backend is back
+	if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+		return nil, err
+	}
+	info, stageErr := s.staging.Put(context.Background(), key, reader, size, opts)
+	if stageErr != nil {
+		log.Printf("[STORAGE] Failed to stage %s after backend error %v: %v", key, err, stageErr)
+		return nil, err
+	}
+	log.Printf("[STORAGE] Staged %s for later upload: %v", key, err)
+	return info, ErrStaged
+}
+
+func (s *ResilientStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	var (
+		object io.ReadSeekCloser
+		info   *ObjectInfo
+	)
+	err := s.call(ctx, func() error {
+		var err error
+		object, info, err = s.backend.Get(ctx, key)
+		return err
+	})
+	if err != nil && s.staging != nil {
+		// Objects waiting in staging are still readable
+		if object, info, stagedErr := s.staging.Get(ctx, key); stagedErr == nil {
+			return object, info, nil
+		}
+	}
+	return object, info, err
+}
+
+func (s *ResilientStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := s.call(ctx, func() error {
+		var err error
+		info, err = s.backend.Stat(ctx, key)
+		return err
+	})
+	if err != nil && s.staging != nil {
+		if info, stagedErr := s.staging.Stat(ctx, key); stagedErr == nil {
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+func (s *ResilientStorage) Delete(ctx context.Context, key string) error {
+	stagedErr := ErrObjectNotFound
+	if s.staging != nil {
+		stagedErr = s.staging.Delete(ctx, key)
+	}
+	err := s.call(ctx, func() error {
+		return s.backend.Delete(ctx, key)
+	})
+	// A staged-only object was deleted before it reached the backend
+	if errors.Is(err, ErrObjectNotFound) && stagedErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (s *ResilientStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.call(ctx, func() error {
+		var err error
+		objects, err = s.backend.List(ctx, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (s *ResilientStorage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	var url string
+	err := s.call(ctx, func() error {
+		var err error
+		url, err = s.backend.Presign(ctx, key, expiry)
+		return err
+	})
+	return url, err
+}
+
+func (s *ResilientStorage) Compose(ctx context.Context, key string, sources []string, opts PutOptions) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := s.call(ctx, func() error {
+		var err error
+		info, err = s.backend.Compose(ctx, key, sources, opts)
+		return err
+	})
+	if err == nil || s.staging == nil || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrPermanent) || ctx.Err() != nil {
+		return info, err
+	}
+	// Some sources may still be staged, or the backend is down; go through
+	// Get and Put so staged sources are read and the result can be staged
+	return concatObjects(ctx, s, key, sources, opts)
+}
+
+// forward periodically moves staged objects to the backend
+func (s *ResilientStorage) forward() {
+	ticker := time.NewTicker(s.config.ForwardInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		objects, err := s.staging.List(context.Background(), "")
+		if err != nil || len(objects) == 0 {
+			continue
+		}
+
+		forwarded := 0
+		for _, object := range objects {
+			if err := s.forwardObject(object.Key); err != nil {
+				if !errors.Is(err, ErrCircuitOpen) {
+					log.Printf("[STORAGE] Forwarding staged objects paused: %v", err)
+				}
+				break
+			}
+			forwarded++
+		}
+		if forwarded > 0 {
+			log.Printf("[STORAGE] Forwarded %d staged objects, %d remaining", forwarded, len(objects)-forwarded)
+		}
+	}
+}
+
+func (s *ResilientStorage) forwardObject(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	object, info, err := s.staging.Get(ctx, key)
+	if err != nil {
+		return nil // Deleted in the meantime
+	}
+	defer object.Close()
+
+	err = s.call(ctx, func() error {
+		if _, err := object.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// The backend encrypts the object its own way, if at all
+		metadata := withoutEncryptionMetadata(info.Metadata)
+		_, err := s.backend.Put(ctx, key, object, info.Size, PutOptions{ContentType: info.ContentType, Metadata: metadata})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.staging.Delete(ctx, key)
+}
+
+// circuitBreaker opens after threshold consecutive failures, rejects calls
+// for openTimeout, then lets a single trial call through
+type circuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow reports whether a call may go ahead, and whether it is the trial
+// call of an open circuit
+func (b *circuitBreaker) allow() (bool, bool) {
+	if b.threshold <= 0 {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if b.trial || time.Since(b.openedAt) < b.openTimeout {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold > 0 && b.failures >= b.threshold {
+		log.Println("[STORAGE] Circuit closed - backend recovered")
+	}
+	b.failures = 0
+	b.trial = false
+}
+
+// release ends the trial call without a verdict, so the next call is tried
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if !b.trial && b.failures == b.threshold {
+			log.Printf("[STORAGE] Circuit opened after %d consecutive failures", b.failures)
+		}
+		b.openedAt = time.Now()
+		b.trial = false
+	}
+}
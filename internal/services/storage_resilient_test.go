@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyStorage is a memory store whose Stat returns the queued errors in
+// turn before succeeding
+type flakyStorage struct {
+	*MemoryStorage
+	errs  []error
+	calls int
+	// Called on each Stat, e.g. to cancel the caller's context
+	onCall func()
+}
+
+func (s *flakyStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	s.calls++
+	if s.onCall != nil {
+		s.onCall()
+	}
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return &ObjectInfo{Key: key}, nil
+}
+
+func TestResilientStorageRetries(t *testing.T) {
+	unavailable := errors.New("503 Service Unavailable")
+	forbidden := fmt.Errorf("%w: 403 Access Denied", ErrPermanent)
+
+	tests := []struct {
+		name     string
+		errs     []error
+		cancel   bool
+		want     error
+		calls    int
+		failures int // Failures the breaker has counted afterwards
+	}{
+		{name: "success", calls: 1},
+		{name: "transient error is retried", errs: []error{unavailable}, calls: 2},
+		{name: "transient errors exhaust attempts", errs: []error{unavailable, unavailable, unavailable}, want: unavailable, calls: 3, failures: 3},
+		{name: "missing object is an answer", errs: []error{ErrObjectNotFound}, want: ErrObjectNotFound, calls: 1},
+		{name: "quota is an answer", errs: []error{ErrQuotaExceeded}, want: ErrQuotaExceeded, calls: 1},
+		{name: "rejected request is not retried", errs: []error{forbidden}, want: ErrPermanent, calls: 1},
+		{name: "rejection resets failures", errs: []error{unavailable, forbidden}, want: ErrPermanent, calls: 2},
+		{name: "cancelled call is not a failure", errs: []error{context.Canceled}, cancel: true, want: context.Canceled, calls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backend := &flakyStorage{MemoryStorage: NewMemoryStorage(nil), errs: tt.errs}
+			if tt.cancel {
+				backend.onCall = cancel
+			}
+			storage := NewResilientStorage(backend, nil, ResilienceConfig{
+				MaxAttempts:      3,
+				BaseDelay:        time.Millisecond,
+				MaxDelay:         time.Millisecond,
+				FailureThreshold: 10,
+			})
+
+			_, err := storage.Stat(ctx, "key")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Stat() error = %v, want %v", err, tt.want)
+			}
+			if backend.calls != tt.calls {
+				t.Fatalf("backend called %d times, want %d", backend.calls, tt.calls)
+			}
+			if storage.breaker.failures != tt.failures {
+				t.Fatalf("breaker counted %d failures, want %d", storage.breaker.failures, tt.failures)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		wait    time.Duration
+		allowed bool
+		trial   bool
+		result  string // "success", "failure", "release" or "" for none
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after threshold failures",
+			steps: []step{
+				{allowed: true, result: "failure"},
+				{allowed: true, result: "failure"},
+				{allowed: false},
+			},
+		},
+		{
+			name: "success resets the count",
+			steps: []step{
+				{allowed: true, result: "failure"},
+				{allowed: true, result: "success"},
+				{allowed: true, result: "failure"},
+				{allowed: true},
+			},
+		},
+		{
+			name: "half-open trial closes on success",
+			steps: []step{
+				{allowed: true, result: "failure"},
+				{allowed: true, result: "failure"},
+				{wait: 30 * time.Millisecond, allowed: true, trial: true},
+				{allowed: false}, // One trial at a time
+				{result: "success"},
+				{allowed: true},
+			},
+		},
+		{
+			name: "half-open trial reopens on failure",
+			steps: []step{
+				{allowed: true, result: "failure"},
+				{allowed: true, result: "failure"},
+				{wait: 30 * time.Millisecond, allowed: true, trial: true, result: "failure"},
+				{allowed: false},
+				{wait: 30 * time.Millisecond, allowed: true, trial: true},
+			},
+		},
+		{
+			name: "released trial lets the next call try",
+			steps: []step{
+				{allowed: true, result: "failure"},
+				{allowed: true, result: "failure"},
+				{wait: 30 * time.Millisecond, allowed: true, trial: true, result: "release"},
+				{allowed: true, trial: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := &circuitBreaker{threshold: 2, openTimeout: 20 * time.Millisecond}
+			for i, step := range tt.steps {
+				time.Sleep(step.wait)
+				if step.allowed || step.trial || step.result == "" {
+					allowed, trial := breaker.allow()
+					if allowed != step.allowed || trial != step.trial {
+						t.Fatalf("step %d: allow() = %v, %v, want %v, %v", i, allowed, trial, step.allowed, step.trial)
+					}
+				}
+				switch step.result {
+				case "success":
+					breaker.success()
+				case "failure":
+					breaker.failure()
+				case "release":
+					breaker.release()
+				}
+			}
+		})
+	}
+}
+
+func TestResilientStorageStaging(t *testing.T) {
+	unavailable := errors.New("connection refused")
+	tests := []struct {
+		name   string
+		err    error
+		staged bool
+	}{
+		{name: "backend down", err: unavailable, staged: true},
+		{name: "backend rejected the upload", err: fmt.Errorf("%w: 400 Bad Request", ErrPermanent)},
+		{name: "quota exceeded", err: ErrQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staging := NewMemoryStorage(nil)
+			storage := NewResilientStorage(&failingPut{MemoryStorage: NewMemoryStorage(nil), err: tt.err}, staging, ResilienceConfig{ForwardInterval: time.Hour})
+
+			_, err := storage.Put(context.Background(), "key", strings.NewReader("data"), 4, PutOptions{})
+			if staged := errors.Is(err, ErrStaged); staged != tt.staged {
+				t.Fatalf("Put() error = %v, staged %v, want staged %v", err, staged, tt.staged)
+			}
+			_, statErr := staging.Stat(context.Background(), "key")
+			if (statErr == nil) != tt.staged {
+				t.Fatalf("staging Stat() = %v, want staged %v", statErr, tt.staged)
+			}
+		})
+	}
+}
+
+func TestResilientStorageForwardDropsEnvelope(t *testing.T) {
+	ctx := context.Background()
+	staging := NewEncryptedStorage(NewMemoryStorage(nil), testKeyring("k1", "k1"))
+	backend := NewMemoryStorage(nil)
+	storage := NewResilientStorage(backend, staging, ResilienceConfig{ForwardInterval: time.Hour})
+	staging.Put(ctx, "tenant/key", strings.NewReader("data"), 4, PutOptions{ContentType: "text/plain", Metadata: map[string]string{MetaSource: "upload"}})
+
+	if err := storage.forwardObject("tenant/key"); err != nil {
+		t.Fatalf("forwardObject() = %v", err)
+	}
+	object, info, err := backend.Get(ctx, "tenant/key")
+	if err != nil {
+		t.Fatalf("backend Get() = %v", err)
+	}
+	defer object.Close()
+	data, _ := io.ReadAll(object)
+	if string(data) != "data" || info.ContentType != "text/plain" {
+		t.Fatalf("forwarded %q as %s, want the plaintext", data, info.ContentType)
+	}
+	if len(info.Metadata) != 1 || info.Metadata[MetaSource] != "upload" {
+		t.Fatalf("forwarded metadata = %v, want only the source", info.Metadata)
+	}
+	if _, err := staging.Stat(ctx, "tenant/key"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("staging Stat() after forwarding = %v", err)
+	}
+}
+
+type failingPut struct {
+	*MemoryStorage
+	err error
+}
+
+func (s *failingPut) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	return nil, s.err
+}
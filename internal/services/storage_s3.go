@@ -0,0 +1,436 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// Type alias to match the config struct
+type MinIOConfig struct {
+	Endpoint      string
+	AccessKey     string
+	SecretKey     string
+	AccessKeyFile string // Read the access key from a file, e.g. a Docker secret
+	SecretKeyFile string
+	Bucket        string
+	Region        string
+	Secure        bool   // Use HTTPS
+	CABundle      string // PEM file with extra CAs trusted for HTTPS
+	BucketLookup  string // "auto", "dns" or "path"
+	Bootstrap     BucketBootstrap
+	Encryption    string   // "", "sse-s3" or "sse-c"
+	Keyring       *Keyring // Per-tenant keys for SSE-C
+}
+
+// BucketBootstrap controls what is done to the bucket at startup
+type BucketBootstrap struct {
+	CreateBucket         bool   // Create the bucket if it doesn't exist
+	Versioning           bool   // Enable versioning
+	ObjectLock           bool   // Enable object lock when creating the bucket
+	RetentionMode        string // "GOVERNANCE" or "COMPLIANCE", requires ObjectLock
+	RetentionDays        uint   // Default retention for new objects
+	ExpireDays           int    // Lifecycle expiration for current objects, 0 to keep forever
+	NoncurrentExpireDays int    // Lifecycle expiration for old versions
+}
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload, other
+// than the last one
+const s3MinPartSize = 5 * 1024 * 1024
+
+// S3Storage stores objects in a MinIO or other S3-compatible bucket
+type S3Storage struct {
+	client     *minio.Client
+	bucket     string
+	encryption string
+	keyring    *Keyring
+	signer     *URLSigner
+}
+
+// NewS3Storage connects to the bucket and applies the bootstrap settings.
+// A bucket that can't be reached, is missing or is unusable is an error.
+// The signer issues download links for SSE-C objects, which can't be
+// presigned because the client would need the key.
+func NewS3Storage(config MinIOConfig, signer *URLSigner) (*S3Storage, error) {
+	encryption := strings.ToLower(config.Encryption)
+	switch encryption {
+	case "", "none":
+		encryption = ""
+	case "sse-s3":
+	case "sse-c":
+		if config.Keyring == nil {
+			return nil, fmt.Errorf("SSE-C requires a keyring")
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q", config.Encryption)
+	}
+
+	client, err := newMinIOConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the bucket now so misconfiguration shows up at startup
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := bootstrapBucket(ctx, client, config); err != nil {
+		return nil, fmt.Errorf("bucket %s is not usable: %w", config.Bucket, err)
+	}
+
+	return &S3Storage{
+		client:     client,
+		bucket:     config.Bucket,
+		encryption: encryption,
+		keyring:    config.Keyring,
+		signer:     signer,
+	}, nil
+}
+
+// readWithKeys runs a read with the object's SSE-C key. The key id can only be
+// read with the key itself, so the tenant's keys are tried newest first.
+func (s *S3Storage) readWithKeys(key string, read func(sse encrypt.ServerSide) error) error {
+	if s.encryption != "sse-c" {
+		return minioError(read(nil))
+	}
+
+	var err error
+	for _, keyID := range s.keyring.Keys(tenantOf(key)) {
+		secret, _ := s.keyring.Key(tenantOf(key), keyID)
+		sse, sseErr := encrypt.NewSSEC(secret)
+		if sseErr != nil {
+			return sseErr
+		}
+		if err = minioError(read(sse)); err == nil || err == ErrObjectNotFound {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, reader io.Reader, size int64, opts PutOptions) (*ObjectInfo, error) {
+	putOpts := minio.PutObjectOptions{
+		ContentType:  opts.ContentType,
+		UserMetadata: opts.Metadata,
+	}
+	switch s.encryption {
+	case "sse-s3":
+		putOpts.ServerSideEncryption = encrypt.NewSSE()
+	case "sse-c":
+		keyID, secret := s.keyring.ActiveKey(tenantOf(key))
+		sse, err := encrypt.NewSSEC(secret)
+		if err != nil {
+			return nil, err
+		}
+		putOpts.ServerSideEncryption = sse
+		putOpts.UserMetadata = make(map[string]string, len(opts.Metadata)+1)
+		for k, v := range opts.Metadata {
+			putOpts.UserMetadata[k] = v
+		}
+		putOpts.UserMetadata[metaKeyID] = keyID
+	}
+
+	info, err := s.client.PutObject(ctx, s.bucket, key, reader, size, putOpts)
+	if err != nil {
+		return nil, minioError(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size,
+		ContentType:  opts.ContentType,
+		LastModified: info.LastModified,
+		ETag:         info.ETag,
+		Metadata:     putOpts.UserMetadata,
+	}, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	var (
+		object *minio.Object
+		stat   minio.ObjectInfo
+	)
+	err := s.readWithKeys(key, func(sse encrypt.ServerSide) error {
+		var err error
+		object, err = s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{ServerSideEncryption: sse})
+		if err != nil {
+			return err
+		}
+		if stat, err = object.Stat(); err != nil {
+			object.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return object, objectInfo(stat), nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	var stat minio.ObjectInfo
+	err := s.readWithKeys(key, func(sse encrypt.ServerSide) error {
+		var err error
+		stat, err = s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{ServerSideEncryption: sse})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objectInfo(stat), nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	// RemoveObject succeeds for missing keys, so check first to report 404s
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return minioError(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, minioError(object.Err)
+		}
+		objects = append(objects, *objectInfo(object))
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	// SSE-C objects are decrypted by the gateway, so link to it instead
+	if s.encryption == "sse-c" {
+		return s.signer.Sign(key, time.Now().Add(expiry)), nil
+	}
+	presigned, err := s.client.PresignedGetObject(ctx, s.bucket, key, expiry, nil)
+	if err != nil {
+		return "", minioError(err)
+	}
+	return presigned.String(), nil
+}
+
+// Compose uses server-side ComposeObject when every source but the last meets
+// the S3 minimum part size, and otherwise streams the sources through the
+// gateway. SSE-C sources are always streamed, as each may use a different key.
+func (s *S3Storage) Compose(ctx context.Context, key string, sources []string, opts PutOptions) (*ObjectInfo, error) {
+	if s.encryption == "sse-c" || len(sources) == 0 {
+		return concatObjects(ctx, s, key, sources, opts)
+	}
+
+	srcs := make([]minio.CopySrcOptions, len(sources))
+	for i, source := range sources {
+		if i < len(sources)-1 {
+			stat, err := s.Stat(ctx, source)
+			if err != nil {
+				return nil, err
+			}
+			if stat.Size < s3MinPartSize {
+				return concatObjects(ctx, s, key, sources, opts)
+			}
+		}
+		srcs[i] = minio.CopySrcOptions{Bucket: s.bucket, Object: source}
+	}
+
+	metadata := map[string]string{"Content-Type": opts.ContentType}
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: key, UserMetadata: metadata, ReplaceMetadata: true}
+	if s.encryption == "sse-s3" {
+		dst.Encryption = encrypt.NewSSE()
+	}
+
+	info, err := s.client.ComposeObject(ctx, dst, srcs...)
+	if err != nil {
+		return nil, minioError(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size,
+		ContentType:  opts.ContentType,
+		LastModified: info.LastModified,
+		ETag:         info.ETag,
+		Metadata:     opts.Metadata,
+	}, nil
+}
+
+// newMinIOConnection builds a client from the TLS, region, lookup and
+// credential settings. No request is made to the server.
+func newMinIOConnection(config MinIOConfig) (*minio.Client, error) {
+	creds, err := minioCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := minio.BucketLookupAuto
+	switch strings.ToLower(config.BucketLookup) {
+	case "", "auto":
+	case "dns", "virtual":
+		lookup = minio.BucketLookupDNS
+	case "path":
+		lookup = minio.BucketLookupPath
+	default:
+		return nil, fmt.Errorf("unknown bucket lookup style %q", config.BucketLookup)
+	}
+
+	transport, err := minio.DefaultTransport(config.Secure)
+	if err != nil {
+		return nil, err
+	}
+	if config.Secure && config.CABundle != "" {
+		pem, err := os.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CABundle)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return minio.New(config.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       config.Secure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+		Transport:    transport,
+	})
+}
+
+// minioCredentials resolves credentials from the config, then key files, then
+// the MINIO_ACCESS_KEY/MINIO_SECRET_KEY or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY
+// environment variables
+func minioCredentials(config MinIOConfig) (*credentials.Credentials, error) {
+	accessKey, secretKey := config.AccessKey, config.SecretKey
+	if config.AccessKeyFile != "" {
+		data, err := os.ReadFile(config.AccessKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading access key file: %w", err)
+		}
+		accessKey = strings.TrimSpace(string(data))
+	}
+	if config.SecretKeyFile != "" {
+		data, err := os.ReadFile(config.SecretKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret key file: %w", err)
+		}
+		secretKey = strings.TrimSpace(string(data))
+	}
+
+	if accessKey != "" && secretKey != "" {
+		return credentials.NewStaticV4(accessKey, secretKey, ""), nil
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvMinio{},
+		&credentials.EnvAWS{},
+	}), nil
+}
+
+// bootstrapBucket makes sure the bucket exists and applies the configured
+// versioning, retention and lifecycle settings
+func bootstrapBucket(ctx context.Context, client *minio.Client, config MinIOConfig) error {
+	if config.Bucket == "" {
+		return fmt.Errorf("no bucket configured")
+	}
+	bootstrap := config.Bootstrap
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return fmt.Errorf("error checking bucket: %w", err)
+	}
+
+	if !exists {
+		if !bootstrap.CreateBucket {
+			return fmt.Errorf("bucket does not exist and CreateBucket is disabled")
+		}
+		err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{
+			Region:        config.Region,
+			ObjectLocking: bootstrap.ObjectLock,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating bucket: %w", err)
+		}
+		log.Printf("[MINIO] Created bucket %s (object lock: %v)", config.Bucket, bootstrap.ObjectLock)
+	}
+
+	if bootstrap.Versioning {
+		if err := client.EnableVersioning(ctx, config.Bucket); err != nil {
+			return fmt.Errorf("error enabling versioning: %w", err)
+		}
+	}
+
+	if bootstrap.RetentionDays > 0 {
+		mode := minio.RetentionMode(strings.ToUpper(bootstrap.RetentionMode))
+		if !mode.IsValid() {
+			return fmt.Errorf("invalid retention mode %q", bootstrap.RetentionMode)
+		}
+		unit := minio.Days
+		if err := client.SetObjectLockConfig(ctx, config.Bucket, &mode, &bootstrap.RetentionDays, &unit); err != nil {
+			return fmt.Errorf("error setting retention: %w", err)
+		}
+	}
+
+	if bootstrap.ExpireDays > 0 || bootstrap.NoncurrentExpireDays > 0 {
+		rule := lifecycle.Rule{
+			ID:     "chronos-gateway-expiry",
+			Status: "Enabled",
+		}
+		if bootstrap.ExpireDays > 0 {
+			rule.Expiration.Days = lifecycle.ExpirationDays(bootstrap.ExpireDays)
+		}
+		if bootstrap.NoncurrentExpireDays > 0 {
+			rule.NoncurrentVersionExpiration.NoncurrentDays = lifecycle.ExpirationDays(bootstrap.NoncurrentExpireDays)
+		}
+		lifecycleConfig := lifecycle.NewConfiguration()
+		lifecycleConfig.Rules = []lifecycle.Rule{rule}
+		if err := client.SetBucketLifecycle(ctx, config.Bucket, lifecycleConfig); err != nil {
+			return fmt.Errorf("error setting lifecycle policy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func objectInfo(stat minio.ObjectInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          stat.Key,
+		Size:         stat.Size,
+		ContentType:  stat.ContentType,
+		LastModified: stat.LastModified,
+		ETag:         stat.ETag,
+		Metadata:     stat.UserMetadata,
+	}
+}
+
+// minioError maps S3 error responses to the shared storage errors. 4xx
+// responses other than timeouts and throttling are the request's fault and
+// are marked permanent, so they aren't retried or held against the backend.
+func minioError(err error) error {
+	if err == nil {
+		return nil
+	}
+	response := minio.ToErrorResponse(err)
+	if response.Code == "NoSuchKey" {
+		return ErrObjectNotFound
+	}
+	if response.StatusCode >= 400 && response.StatusCode < 500 &&
+		response.StatusCode != http.StatusRequestTimeout && response.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+	return err
+}
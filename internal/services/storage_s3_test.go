@@ -0,0 +1,45 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestMinIOError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		want      error
+		permanent bool
+	}{
+		{name: "nil", err: nil, want: nil},
+		{name: "missing key", err: minio.ErrorResponse{StatusCode: http.StatusNotFound, Code: "NoSuchKey"}, want: ErrObjectNotFound},
+		{name: "access denied", err: minio.ErrorResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, permanent: true},
+		{name: "bad request", err: minio.ErrorResponse{StatusCode: http.StatusBadRequest, Code: "InvalidArgument"}, permanent: true},
+		{name: "request timeout", err: minio.ErrorResponse{StatusCode: http.StatusRequestTimeout, Code: "RequestTimeout"}},
+		{name: "throttled", err: minio.ErrorResponse{StatusCode: http.StatusTooManyRequests, Code: "SlowDown"}},
+		{name: "server error", err: minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable, Code: "ServiceUnavailable"}},
+		{name: "network error", err: errors.New("dial tcp: connection refused")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := minioError(tt.err)
+			if tt.want != nil && !errors.Is(got, tt.want) {
+				t.Fatalf("minioError() = %v, want %v", got, tt.want)
+			}
+			if tt.err == nil && got != nil {
+				t.Fatalf("minioError(nil) = %v", got)
+			}
+			if errors.Is(got, ErrPermanent) != tt.permanent {
+				t.Fatalf("minioError() = %v, permanent %v", got, !tt.permanent)
+			}
+			if transient(got) != (tt.err != nil && tt.want == nil && !tt.permanent) {
+				t.Fatalf("transient(%v) = %v", got, transient(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownToggle is returned when setting a toggle that isn't registered
+var ErrUnknownToggle = errors.New("unknown toggle")
+
+// Toggle is a switch that can be flipped at runtime
+type Toggle struct {
+	name        string
+	description string
+	enabled     atomic.Bool
+}
+
+func (t *Toggle) Enabled() bool {
+	return t.enabled.Load()
+}
+
+// ToggleState describes a toggle for the ops API
+type ToggleState struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// Toggles holds the runtime switches exposed on the ops listener
+type Toggles struct {
+	mu      sync.RWMutex
+	toggles map[string]*Toggle
+}
+
+func NewToggles() *Toggles {
+	return &Toggles{toggles: make(map[string]*Toggle)}
+}
+
+// Register adds a toggle with its initial state
+func (t *Toggles) Register(name, description string, enabled bool) *Toggle {
+	toggle := &Toggle{name: name, description: description}
+	toggle.enabled.Store(enabled)
+
+	t.mu.Lock()
+	t.toggles[name] = toggle
+	t.mu.Unlock()
+	return toggle
+}
+
+// Set flips a toggle by name
+func (t *Toggles) Set(name string, enabled bool) (ToggleState, error) {
+	t.mu.RLock()
+	toggle, ok := t.toggles[name]
+	t.mu.RUnlock()
+	if !ok {
+		return ToggleState{}, ErrUnknownToggle
+	}
+
+	if toggle.enabled.Swap(enabled) != enabled {
+		log.Printf("Toggle %s set to %t", name, enabled)
+	}
+	return ToggleState{Name: name, Description: toggle.description, Enabled: enabled}, nil
+}
+
+// List returns all toggles ordered by name
+func (t *Toggles) List() []ToggleState {
+	t.mu.RLock()
+	states := make([]ToggleState, 0, len(t.toggles))
+	for name, toggle := range t.toggles {
+		states = append(states, ToggleState{Name: name, Description: toggle.description, Enabled: toggle.Enabled()})
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
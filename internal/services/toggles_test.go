@@ -0,0 +1,57 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestToggles(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     string
+		enabled bool
+		err     error
+		want    []ToggleState
+	}{
+		{
+			name: "enable", set: "maintenance", enabled: true,
+			want: []ToggleState{{Name: "maintenance", Description: "Drain", Enabled: true}, {Name: "rate_limits", Description: "Limit", Enabled: true}},
+		},
+		{
+			name: "disable", set: "rate_limits", enabled: false,
+			want: []ToggleState{{Name: "maintenance", Description: "Drain"}, {Name: "rate_limits", Description: "Limit"}},
+		},
+		{
+			name: "unknown", set: "debug", enabled: true, err: ErrUnknownToggle,
+			want: []ToggleState{{Name: "maintenance", Description: "Drain"}, {Name: "rate_limits", Description: "Limit", Enabled: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toggles := NewToggles()
+			registered := map[string]*Toggle{
+				"rate_limits": toggles.Register("rate_limits", "Limit", true),
+				"maintenance": toggles.Register("maintenance", "Drain", false),
+			}
+
+			state, err := toggles.Set(tt.set, tt.enabled)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Set() = %v, want %v", err, tt.err)
+			}
+			if err == nil && (state.Name != tt.set || state.Enabled != tt.enabled || registered[tt.set].Enabled() != tt.enabled) {
+				t.Fatalf("Set() = %+v, toggle enabled = %v", state, registered[tt.set].Enabled())
+			}
+
+			list := toggles.List()
+			if len(list) != len(tt.want) {
+				t.Fatalf("List() = %+v, want %+v", list, tt.want)
+			}
+			for i := range list {
+				if list[i] != tt.want[i] {
+					t.Fatalf("List() = %+v, want %+v", list, tt.want)
+				}
+			}
+		})
+	}
+}
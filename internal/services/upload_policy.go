@@ -0,0 +1,380 @@
+package services
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload validation errors, mapped to HTTP status codes by the handlers
+var (
+	ErrUploadTooLarge       = errors.New("file exceeds maximum upload size")
+	ErrUnsupportedMediaType = errors.New("file type is not allowed")
+	ErrMediaTypeMismatch    = errors.New("declared file type does not match content")
+	ErrUploadQuotaExceeded  = errors.New("upload quota exceeded for device")
+)
+
+// sniffLength is how much of a file http.DetectContentType considers
+const sniffLength = 512
+
+// UploadPolicy restricts what a single source may upload
+type UploadPolicy struct {
+	AllowedTypes    []string // MIME types, "image/*" style wildcards allowed
+	MaxSize         int64    // Bytes per file, 0 for unlimited
+	MaxFilesPerHour int      // Files per device per hour, 0 for unlimited
+}
+
+type uploadWindow struct {
+	start time.Time
+	count int
+}
+
+// UploadValidator enforces per-source upload policies. Sources without a
+// policy fall back to the "default" policy, or are unrestricted if none exists.
+type UploadValidator struct {
+	policies map[string]UploadPolicy
+	mu       sync.Mutex
+	windows  map[string]*uploadWindow
+}
+
+func NewUploadValidator(policies map[string]UploadPolicy) *UploadValidator {
+	normalized := make(map[string]UploadPolicy, len(policies))
+	for source, policy := range policies {
+		normalized[strings.ToLower(source)] = policy
+	}
+	return &UploadValidator{
+		policies: normalized,
+		windows:  make(map[string]*uploadWindow),
+	}
+}
+
+// Policy returns the effective policy for a source
+func (v *UploadValidator) Policy(source string) (UploadPolicy, bool) {
+	if policy, ok := v.policies[strings.ToLower(source)]; ok {
+		return policy, true
+	}
+	policy, ok := v.policies["default"]
+	return policy, ok
+}
+
+// CheckSize rejects files larger than the source's limit. Handlers call it
+// before reading the file so oversized uploads are not buffered.
+func (v *UploadValidator) CheckSize(source string, size int64) error {
+	policy, ok := v.Policy(source)
+	if ok && policy.MaxSize > 0 && size > policy.MaxSize {
+		return ErrUploadTooLarge
+	}
+	return nil
+}
+
+// Validate checks a file against the source's policy and returns the content
+// type detected from its magic bytes. The declared content type and the
+// filename extension must agree with the detected type. It checks that the
+// device has quota left but doesn't use it; handlers Reserve it before
+// storing the file.
+func (v *UploadValidator) Validate(source, deviceID, filename, declaredType string, data []byte) (string, error) {
+	return v.ValidateHead(source, deviceID, filename, declaredType, data, int64(len(data)))
+}
+
+// ValidateHead is Validate for a file that is streamed rather than held in
+// memory: head is its start, at least the 512 bytes the type is sniffed
+// from if the file is that long, and size its full length.
+func (v *UploadValidator) ValidateHead(source, deviceID, filename, declaredType string, head []byte, size int64) (string, error) {
+	if err := v.CheckSize(source, size); err != nil {
+		return "", err
+	}
+
+	policy, ok := v.Policy(source)
+	contentType, err := detectContentType(filename, declaredType, head, policy.AllowedTypes)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return contentType, nil
+	}
+
+	if len(policy.AllowedTypes) > 0 && !typeAllowed(policy.AllowedTypes, contentType) {
+		return "", ErrUnsupportedMediaType
+	}
+
+	if err := v.CheckQuota(source, deviceID, 1); err != nil {
+		return "", err
+	}
+
+	return contentType, nil
+}
+
+// ValidateSession checks a chunked upload when its session is opened, before
+// any content exists. The type comes from the declared content type or the
+// filename and is checked against the content by CheckContent later. The
+// session counts as one file against the hourly quota once it is completed.
+func (v *UploadValidator) ValidateSession(source, deviceID, filename, declaredType string) (string, error) {
+	contentType := baseMediaType(declaredType)
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = baseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	policy, ok := v.Policy(source)
+	if !ok {
+		return contentType, nil
+	}
+
+	if len(policy.AllowedTypes) > 0 && !typeAllowed(policy.AllowedTypes, contentType) {
+		return "", ErrUnsupportedMediaType
+	}
+
+	if err := v.CheckQuota(source, deviceID, 1); err != nil {
+		return "", err
+	}
+
+	return contentType, nil
+}
+
+// CheckContent verifies that the start of a file matches the content type
+// accepted by ValidateSession
+func (v *UploadValidator) CheckContent(source, filename, contentType string, data []byte) error {
+	policy, _ := v.Policy(source)
+	detected, err := detectContentType(filename, contentType, data, policy.AllowedTypes)
+	if err == nil && detected != contentType {
+		err = ErrMediaTypeMismatch
+	}
+	return err
+}
+
+// Defined reports whether a source has its own policy rather than the
+// "default" one
+func (v *UploadValidator) Defined(source string) bool {
+	_, ok := v.policies[strings.ToLower(source)]
+	return ok
+}
+
+// CheckQuota reports whether the device can still upload files to the source
+// this hour, without counting them
+func (v *UploadValidator) CheckQuota(source, deviceID string, files int) error {
+	policy, ok := v.Policy(source)
+	if !ok || policy.MaxFilesPerHour <= 0 {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.window(source, deviceID).count+files > policy.MaxFilesPerHour {
+		return ErrUploadQuotaExceeded
+	}
+	return nil
+}
+
+// Reserve counts files against the device's hourly quota, all or none.
+// Handlers reserve before storing and Release the files again if storing
+// fails, so failed uploads don't use up the quota.
+func (v *UploadValidator) Reserve(source, deviceID string, files int) error {
+	policy, ok := v.Policy(source)
+	if !ok || policy.MaxFilesPerHour <= 0 {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	window := v.window(source, deviceID)
+	if window.count+files > policy.MaxFilesPerHour {
+		return ErrUploadQuotaExceeded
+	}
+	window.count += files
+	return nil
+}
+
+// Release returns files taken by Reserve to the device's quota
+func (v *UploadValidator) Release(source, deviceID string, files int) {
+	policy, ok := v.Policy(source)
+	if !ok || policy.MaxFilesPerHour <= 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	window := v.window(source, deviceID)
+	window.count = max(window.count-files, 0)
+}
+
+// window returns the device's current hourly window. The caller holds v.mu.
+func (v *UploadValidator) window(source, deviceID string) *uploadWindow {
+	now := time.Now()
+	key := strings.ToLower(source) + "/" + deviceID
+	window, ok := v.windows[key]
+	if !ok || now.Sub(window.start) >= time.Hour {
+		// Drop expired windows occasionally so idle devices don't accumulate
+		if !ok && len(v.windows) > 10000 {
+			for k, w := range v.windows {
+				if now.Sub(w.start) >= time.Hour {
+					delete(v.windows, k)
+				}
+			}
+		}
+		window = &uploadWindow{start: now}
+		v.windows[key] = window
+	}
+	return window
+}
+
+// containerFamilies groups the types of container formats that hold audio
+// or video alike
+var containerFamilies = map[string]string{
+	"audio/mp4":       "mp4",
+	"video/mp4":       "mp4",
+	"audio/webm":      "webm",
+	"video/webm":      "webm",
+	"audio/ogg":       "ogg",
+	"video/ogg":       "ogg",
+	"application/ogg": "ogg",
+}
+
+// sameContainer reports whether two types are equal or name the same
+// container format
+func sameContainer(a, b string) bool {
+	return a == b || (containerFamilies[a] != "" && containerFamilies[a] == containerFamilies[b])
+}
+
+// detectContentType sniffs the content type from magic bytes. The declared
+// content type and the filename extension must agree with what was sniffed.
+// When the sniffer finds no signature (plain text or unknown binary), types it
+// would have recognized are rejected, and other types are taken from the
+// request only if allowed names them exactly. Without an allowlist the
+// generic sniffed type is kept.
+func detectContentType(filename, declaredType string, data []byte, allowed []string) (string, error) {
+	detected := baseMediaType(http.DetectContentType(data))
+	declared := baseMediaType(declaredType)
+	if declared == "application/octet-stream" {
+		declared = ""
+	}
+	byExtension := baseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))))
+
+	if detected != "application/octet-stream" && detected != "text/plain" {
+		if declared != "" && !sameContainer(declared, detected) {
+			return "", ErrMediaTypeMismatch
+		}
+		if byExtension != "" && !sameContainer(byExtension, detected) {
+			return "", ErrMediaTypeMismatch
+		}
+		// The sniffer reports every MP4, WebM and Ogg file as one type, so
+		// the request's type tells audio from video
+		if declared != "" {
+			return declared, nil
+		}
+		if byExtension != "" {
+			return byExtension, nil
+		}
+		return detected, nil
+	}
+
+	claimed := declared
+	if claimed == "" {
+		claimed = byExtension
+	}
+	if claimed == "" || claimed == detected {
+		return detected, nil
+	}
+	if byExtension != "" && byExtension != claimed {
+		return "", ErrMediaTypeMismatch
+	}
+	// A binary format with a signature, or text that isn't text
+	if sniffedTypes[claimed] || (strings.HasPrefix(claimed, "text/") && detected != "text/plain") {
+		return "", ErrMediaTypeMismatch
+	}
+	if len(allowed) == 0 {
+		return detected, nil
+	}
+	if !typeListed(allowed, claimed) {
+		return "", ErrUnsupportedMediaType
+	}
+	return claimed, nil
+}
+
+// sniffedTypes are the binary types http.DetectContentType recognizes by
+// signature, so content claiming one of them must carry it
+var sniffedTypes = map[string]bool{
+	"image/gif":                     true,
+	"image/png":                     true,
+	"image/jpeg":                    true,
+	"image/bmp":                     true,
+	"image/webp":                    true,
+	"image/x-icon":                  true,
+	"audio/wave":                    true,
+	"audio/aiff":                    true,
+	"audio/basic":                   true,
+	"audio/midi":                    true,
+	"audio/mpeg":                    true,
+	"application/ogg":               true,
+	"video/avi":                     true,
+	"video/mp4":                     true,
+	"video/webm":                    true,
+	"application/pdf":               true,
+	"application/postscript":        true,
+	"application/zip":               true,
+	"application/x-gzip":            true,
+	"application/x-rar-compressed":  true,
+	"application/wasm":              true,
+	"application/vnd.ms-fontobject": true,
+	"font/ttf":                      true,
+	"font/otf":                      true,
+	"font/collection":               true,
+	"font/woff":                     true,
+	"font/woff2":                    true,
+}
+
+// mediaTypeAliases maps common alternative spellings to the names returned by
+// http.DetectContentType
+var mediaTypeAliases = map[string]string{
+	"image/jpg":       "image/jpeg",
+	"image/pjpeg":     "image/jpeg",
+	"audio/wav":       "audio/wave",
+	"audio/x-wav":     "audio/wave",
+	"audio/vnd.wave":  "audio/wave",
+	"audio/mp3":       "audio/mpeg",
+	"audio/x-aiff":    "audio/aiff",
+	"video/x-msvideo": "video/avi",
+}
+
+func baseMediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// typeListed reports whether allowed names the type itself, not through a
+// wildcard
+func typeListed(allowed []string, contentType string) bool {
+	for _, pattern := range allowed {
+		if baseMediaType(pattern) == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func typeAllowed(allowed []string, contentType string) bool {
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
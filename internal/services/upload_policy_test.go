@@ -0,0 +1,143 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUploadQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		reserve []int // Files reserved in turn
+		release int   // Files released after the reservations
+		check   int
+		want    error
+	}{
+		{name: "within limit", reserve: []int{1, 1}, check: 1},
+		{name: "at limit", reserve: []int{3}, check: 1, want: ErrUploadQuotaExceeded},
+		{name: "batch over limit", check: 4, want: ErrUploadQuotaExceeded},
+		{name: "released files count again", reserve: []int{3}, release: 3, check: 3},
+		{name: "release never goes below zero", reserve: []int{1}, release: 5, check: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewUploadValidator(map[string]UploadPolicy{"browser": {MaxFilesPerHour: 3}})
+			for _, files := range tt.reserve {
+				if err := validator.Reserve("browser", "device-1", files); err != nil {
+					t.Fatalf("Reserve(%d) = %v", files, err)
+				}
+			}
+			validator.Release("browser", "device-1", tt.release)
+
+			if err := validator.CheckQuota("browser", "device-1", tt.check); !errors.Is(err, tt.want) {
+				t.Fatalf("CheckQuota(%d) = %v, want %v", tt.check, err, tt.want)
+			}
+			// Reserve agrees with CheckQuota and takes nothing when it fails
+			if err := validator.Reserve("browser", "device-1", tt.check); !errors.Is(err, tt.want) {
+				t.Fatalf("Reserve(%d) = %v, want %v", tt.check, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadValidateDoesNotUseQuota(t *testing.T) {
+	validator := NewUploadValidator(map[string]UploadPolicy{"upload": {MaxFilesPerHour: 1}})
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+	for i := 0; i < 3; i++ {
+		if _, err := validator.Validate("upload", "device-1", "a.png", "image/png", png); err != nil {
+			t.Fatalf("Validate #%d = %v", i, err)
+		}
+	}
+	if err := validator.Reserve("upload", "device-1", 1); err != nil {
+		t.Fatalf("Reserve after Validate = %v", err)
+	}
+	if _, err := validator.Validate("upload", "device-1", "a.png", "image/png", png); !errors.Is(err, ErrUploadQuotaExceeded) {
+		t.Fatalf("Validate after Reserve = %v, want %v", err, ErrUploadQuotaExceeded)
+	}
+	// Other devices have their own quota
+	if err := validator.Reserve("upload", "device-2", 1); err != nil {
+		t.Fatalf("Reserve for another device = %v", err)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	text := []byte("id,name\n1,alice\n")
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe}
+	m4a := []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00M4A mp42isom\x00\x00\x00\x00")
+	webm := []byte("\x1a\x45\xdf\xa3\x01\x00\x00\x00")
+	ogg := []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name     string
+		filename string
+		declared string
+		data     []byte
+		allowed  []string
+		want     string
+		err      error
+	}{
+		{name: "sniffed", filename: "a.png", declared: "image/png", data: png, want: "image/png"},
+		{name: "sniffed without declared type", filename: "a", data: jpeg, want: "image/jpeg"},
+		{name: "alias", filename: "a.jpg", declared: "image/jpg", data: jpeg, want: "image/jpeg"},
+		{name: "declared differs from sniffed", filename: "a.png", declared: "image/jpeg", data: png, err: ErrMediaTypeMismatch},
+		{name: "extension differs from sniffed", filename: "a.jpg", data: png, err: ErrMediaTypeMismatch},
+		{name: "binary claiming png", filename: "a.png", declared: "image/png", data: binary, allowed: []string{"image/png"}, err: ErrMediaTypeMismatch},
+		{name: "text claiming pdf", filename: "a.pdf", data: text, allowed: []string{"application/pdf"}, err: ErrMediaTypeMismatch},
+		{name: "unsniffable listed", filename: "a.csv", declared: "text/csv", data: text, allowed: []string{"text/csv"}, want: "text/csv"},
+		{name: "unsniffable by wildcard only", filename: "a.csv", declared: "text/csv", data: text, allowed: []string{"text/*"}, err: ErrUnsupportedMediaType},
+		{name: "unsniffable without policy keeps sniffed type", filename: "a.csv", declared: "text/csv", data: text, want: "text/plain"},
+		{name: "binary claiming text", filename: "a.csv", declared: "text/csv", data: binary, allowed: []string{"text/csv"}, err: ErrMediaTypeMismatch},
+		{name: "declared differs from extension", filename: "a.json", declared: "text/csv", data: text, allowed: []string{"text/csv"}, err: ErrMediaTypeMismatch},
+		{name: "mp4 audio", filename: "a.m4a", declared: "audio/mp4", data: m4a, allowed: []string{"audio/*"}, want: "audio/mp4"},
+		{name: "mp4 audio by extension", filename: "a.m4a", data: m4a, want: "audio/mp4"},
+		{name: "mp4 video", filename: "a.mp4", declared: "video/mp4", data: m4a, want: "video/mp4"},
+		{name: "webm audio", filename: "a.weba", declared: "audio/webm", data: webm, want: "audio/webm"},
+		{name: "ogg audio", filename: "a.ogg", data: ogg, want: "audio/ogg"},
+		{name: "ogg without a claim", filename: "a", data: ogg, want: "application/ogg"},
+		{name: "other container", filename: "a.m4a", declared: "audio/mp4", data: webm, err: ErrMediaTypeMismatch},
+		{name: "audio claiming an image", filename: "a.png", declared: "image/png", data: m4a, err: ErrMediaTypeMismatch},
+		{name: "unknown binary", filename: "a", data: binary, want: "application/octet-stream"},
+		{name: "plain text", filename: "a.txt", data: text, allowed: []string{"text/plain"}, want: "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectContentType(tt.filename, tt.declared, tt.data, tt.allowed)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("detectContentType() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Fatalf("detectContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckContent(t *testing.T) {
+	validator := NewUploadValidator(map[string]UploadPolicy{"recording": {AllowedTypes: []string{"video/*"}}})
+	mp4 := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		err         error
+	}{
+		{name: "matches session type", contentType: "video/mp4", data: mp4},
+		{name: "png in a video session", contentType: "video/mp4", data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), err: ErrMediaTypeMismatch},
+		{name: "unknown binary in a video session", contentType: "video/mp4", data: []byte{0x00, 0x01, 0x02}, err: ErrMediaTypeMismatch},
+		{name: "generic session type with sniffable content", contentType: "application/octet-stream", data: mp4, err: ErrMediaTypeMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validator.CheckContent("recording", "", tt.contentType, tt.data); !errors.Is(err, tt.err) {
+				t.Fatalf("CheckContent() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,520 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload session errors, mapped to HTTP status codes by the handlers
+var (
+	ErrSessionNotFound  = errors.New("upload session not found")
+	ErrSessionExpired   = errors.New("upload session expired")
+	ErrSessionCompleted = errors.New("upload session already completed")
+	ErrChunkOutOfRange  = errors.New("chunk index out of range")
+	ErrChunkTooLarge    = errors.New("chunk exceeds maximum chunk size")
+)
+
+// MissingChunksError is returned when a session is completed before all of
+// its chunks were received
+type MissingChunksError struct {
+	Missing []int
+}
+
+func (e *MissingChunksError) Error() string {
+	return fmt.Sprintf("%d chunks missing", len(e.Missing))
+}
+
+const (
+	// Sessions live outside the userID/deviceID/ namespace, so chunks and
+	// manifests can't be reached through the media endpoints
+	sessionPrefix   = ".sessions/"
+	sessionManifest = "session.json"
+	// Where the chunks of image uploads are composed before the privacy
+	// pipeline writes the result to its object key
+	sessionAssembled = "assembled"
+)
+
+// UploadSessionConfig limits chunked upload sessions
+type UploadSessionConfig struct {
+	TTL          time.Duration // Sessions not completed within this are discarded
+	MaxChunks    int
+	MaxChunkSize int64
+}
+
+// UploadSession is a chunked upload in progress. Its manifest and chunks are
+// kept in storage under .sessions/ID/, so any gateway instance can serve the
+// session. The manifest records the owning user and device.
+type UploadSession struct {
+	ID          string            `json:"id"`
+	UserID      string            `json:"user_id"`
+	DeviceID    string            `json:"device_id"`
+	Source      string            `json:"source"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	// Set when the session is completed
+	CompletedAt  *time.Time        `json:"completed_at,omitempty"`
+	ObjectKey    string            `json:"object_key,omitempty"`
+	ThumbnailKey string            `json:"thumbnail_key,omitempty"`
+	EXIF         map[string]string `json:"exif,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	Chunks       int               `json:"chunks,omitempty"`
+	Staged       bool              `json:"staged,omitempty"`
+}
+
+func (s *UploadSession) prefix() string {
+	return sessionPrefix + s.ID + "/"
+}
+
+func (s *UploadSession) chunkKey(index int) string {
+	return s.prefix() + fmt.Sprintf("%06d", index)
+}
+
+// UploadSessions manages chunked uploads. Chunks may arrive in any order and
+// be retried; on completion they are composed into one object.
+type UploadSessions struct {
+	media     *MediaStore
+	storage   Storage
+	validator *UploadValidator
+	config    UploadSessionConfig
+
+	mu    sync.Mutex
+	locks map[string]*sessionLock
+}
+
+// sessionLock lets the chunks of a session be stored in parallel while
+// keeping them out of a completion in progress
+type sessionLock struct {
+	sync.RWMutex
+	users int
+}
+
+// NewUploadSessions keeps sessions in the media store's backend and runs
+// completed image uploads through its privacy pipeline. The validator's
+// policies limit the size and content of the assembled file; it may be nil.
+func NewUploadSessions(media *MediaStore, validator *UploadValidator, config UploadSessionConfig) *UploadSessions {
+	if config.TTL <= 0 {
+		config.TTL = 24 * time.Hour
+	}
+	if config.MaxChunks <= 0 {
+		config.MaxChunks = 10000
+	}
+
+	sessions := &UploadSessions{
+		media:     media,
+		storage:   media.Storage(),
+		validator: validator,
+		config:    config,
+		locks:     make(map[string]*sessionLock),
+	}
+	go sessions.expire()
+	return sessions
+}
+
+// Open starts a session for the given file and stores its manifest
+func (m *UploadSessions) Open(ctx context.Context, session *UploadSession) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	session.ID = hex.EncodeToString(id)
+	session.CreatedAt = time.Now()
+	session.ExpiresAt = session.CreatedAt.Add(m.config.TTL)
+
+	if err := m.save(ctx, session); err != nil && !errors.Is(err, ErrStaged) {
+		return err
+	}
+	return nil
+}
+
+// Get loads a session owned by the user and device
+func (m *UploadSessions) Get(ctx context.Context, userID, deviceID, id string) (*UploadSession, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, ErrSessionNotFound
+	}
+	session, err := m.load(ctx, sessionPrefix+id+"/"+sessionManifest)
+	if err != nil {
+		return nil, err
+	}
+	// Other callers' sessions don't exist as far as this one is concerned
+	if session.UserID != userID || session.DeviceID != deviceID {
+		return nil, ErrSessionNotFound
+	}
+	if session.CompletedAt == nil && time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+func (m *UploadSessions) load(ctx context.Context, key string) (*UploadSession, error) {
+	object, _, err := m.storage.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	defer object.Close()
+
+	var session UploadSession
+	if err := json.NewDecoder(object).Decode(&session); err != nil {
+		return nil, fmt.Errorf("error reading session manifest: %w", err)
+	}
+	return &session, nil
+}
+
+// PutChunk stores a chunk. Sending the same index again replaces it, so
+// clients can safely retry. Chunks that would take the session past the
+// source's size limit are rejected. It returns ErrStaged if the chunk was
+// staged.
+func (m *UploadSessions) PutChunk(ctx context.Context, session *UploadSession, index int, data []byte) error {
+	if index < 0 || index >= m.config.MaxChunks {
+		return ErrChunkOutOfRange
+	}
+	if m.config.MaxChunkSize > 0 && int64(len(data)) > m.config.MaxChunkSize {
+		return ErrChunkTooLarge
+	}
+
+	unlock := m.lock(session.ID, false)
+	defer unlock()
+	if err := m.open(ctx, session); err != nil {
+		return err
+	}
+
+	if m.validator != nil {
+		objects, err := m.storage.List(ctx, session.prefix())
+		if err != nil {
+			return err
+		}
+		// The running total of the chunks received, counting this one in
+		// place of an earlier copy
+		total := int64(len(data))
+		for _, object := range objects {
+			if object.Key != session.chunkKey(index) && object.Key != session.prefix()+sessionManifest {
+				total += object.Size
+			}
+		}
+		if err := m.validator.CheckSize(session.Source, total); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.storage.Put(ctx, session.chunkKey(index), bytes.NewReader(data), int64(len(data)), PutOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Chunks returns the indexes received so far and their total size
+func (m *UploadSessions) Chunks(ctx context.Context, session *UploadSession) ([]int, int64, error) {
+	objects, err := m.storage.List(ctx, session.prefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		indexes []int
+		size    int64
+	)
+	for _, object := range objects {
+		index, err := strconv.Atoi(path.Base(object.Key))
+		if err != nil {
+			continue // The manifest
+		}
+		indexes = append(indexes, index)
+		size += object.Size
+	}
+	sort.Ints(indexes)
+	return indexes, size, nil
+}
+
+// Complete composes chunks 0 to totalChunks-1 into objectKey, removes the
+// chunks and records the result in the manifest. Completing a completed
+// session returns it unchanged. Completions of a session are serialized, and
+// one that finds the session completed while it waited returns
+// ErrSessionCompleted, so only one caller assembles and announces the file.
+func (m *UploadSessions) Complete(ctx context.Context, session *UploadSession, totalChunks int, objectKey string) (*UploadSession, error) {
+	if session.CompletedAt != nil {
+		return session, nil
+	}
+	if totalChunks <= 0 || totalChunks > m.config.MaxChunks {
+		return nil, ErrChunkOutOfRange
+	}
+
+	unlock := m.lock(session.ID, true)
+	defer unlock()
+	if err := m.open(ctx, session); err != nil {
+		return nil, err
+	}
+
+	received, size, err := m.Chunks(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[int]bool, len(received))
+	for _, index := range received {
+		have[index] = true
+	}
+	var missing []int
+	sources := make([]string, totalChunks)
+	for index := 0; index < totalChunks; index++ {
+		if !have[index] {
+			missing = append(missing, index)
+		}
+		sources[index] = session.chunkKey(index)
+	}
+	if len(missing) > 0 {
+		return nil, &MissingChunksError{Missing: missing}
+	}
+	if err := m.check(ctx, session, sources, size); err != nil {
+		return nil, err
+	}
+
+	completed := *session
+	completed.Size = size
+	if err := m.assemble(ctx, &completed, sources, objectKey); err != nil {
+		return nil, err
+	}
+	completedAt := time.Now()
+	completed.CompletedAt = &completedAt
+	completed.ObjectKey = objectKey
+	completed.Chunks = totalChunks
+	// Keep the manifest until the session expires so retried completions
+	// get the same answer
+	if err := m.save(ctx, &completed); err != nil && !errors.Is(err, ErrStaged) {
+		log.Printf("[STORAGE] Failed to update manifest of session %s: %v", session.ID, err)
+	}
+
+	for _, index := range received {
+		m.storage.Delete(context.Background(), session.chunkKey(index))
+	}
+	return &completed, nil
+}
+
+// check validates the chunks against the source's policy as one file: its
+// total size, and its type sniffed from the start of the first chunks, which
+// may be shorter than the sniffer reads
+func (m *UploadSessions) check(ctx context.Context, session *UploadSession, sources []string, size int64) error {
+	if m.validator == nil {
+		return nil
+	}
+	if err := m.validator.CheckSize(session.Source, size); err != nil {
+		return err
+	}
+
+	var head []byte
+	for _, key := range sources {
+		if len(head) >= sniffLength {
+			break
+		}
+		object, _, err := m.storage.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(object, int64(sniffLength-len(head))))
+		object.Close()
+		if err != nil {
+			return err
+		}
+		head = append(head, data...)
+	}
+	return m.validator.CheckContent(session.Source, session.Filename, session.ContentType, head)
+}
+
+// open reports whether the session can still take chunks or be completed,
+// going by its manifest rather than the caller's copy, which may be stale.
+// The caller holds the session's lock.
+func (m *UploadSessions) open(ctx context.Context, session *UploadSession) error {
+	if session.CompletedAt != nil {
+		return ErrSessionCompleted
+	}
+	current, err := m.load(ctx, session.prefix()+sessionManifest)
+	if err != nil {
+		return err
+	}
+	if current.CompletedAt != nil {
+		return ErrSessionCompleted
+	}
+	return nil
+}
+
+// lock takes the session's lock, shared or exclusive, and returns the
+// function that releases it. Locks only exist while they are held or
+// waited for.
+func (m *UploadSessions) lock(id string, exclusive bool) func() {
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sessionLock{}
+		m.locks[id] = l
+	}
+	l.users++
+	m.mu.Unlock()
+
+	if exclusive {
+		l.Lock()
+	} else {
+		l.RLock()
+	}
+	return func() {
+		if exclusive {
+			l.Unlock()
+		} else {
+			l.RUnlock()
+		}
+		m.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(m.locks, id)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// assemble composes the chunks into objectKey. Images the source's privacy
+// pipeline applies to are composed inside the session first and stored
+// through the pipeline, so the original never appears under objectKey.
+func (m *UploadSessions) assemble(ctx context.Context, session *UploadSession, sources []string, objectKey string) error {
+	opts := PutOptions{ContentType: session.ContentType, Metadata: map[string]string{MetaSource: session.Source}}
+	if !m.media.Processes(session.Source, session.ContentType) {
+		info, err := m.storage.Compose(ctx, objectKey, sources, opts)
+		session.Staged = errors.Is(err, ErrStaged)
+		if err != nil && !session.Staged {
+			return err
+		}
+		if info != nil {
+			session.Size = info.Size
+		}
+		return nil
+	}
+
+	assembledKey := session.prefix() + sessionAssembled
+	if _, err := m.storage.Compose(ctx, assembledKey, sources, opts); err != nil && !errors.Is(err, ErrStaged) {
+		return err
+	}
+	defer m.storage.Delete(context.Background(), assembledKey)
+
+	object, _, err := m.storage.Get(ctx, assembledKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return err
+	}
+
+	upload, err := m.media.UploadMedia(ctx, session.Source, objectKey, data, session.ContentType)
+	if err != nil {
+		return err
+	}
+	session.Size = upload.Size
+	session.ThumbnailKey = upload.ThumbnailKey
+	session.EXIF = upload.EXIF
+	session.Staged = upload.Staged
+	return nil
+}
+
+// Abort discards a session and its chunks
+func (m *UploadSessions) Abort(ctx context.Context, session *UploadSession) error {
+	return m.remove(ctx, session.prefix())
+}
+
+func (m *UploadSessions) save(ctx context.Context, session *UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = m.storage.Put(ctx, session.prefix()+sessionManifest, bytes.NewReader(data), int64(len(data)), PutOptions{ContentType: "application/json"})
+	return err
+}
+
+func (m *UploadSessions) remove(ctx context.Context, prefix string) error {
+	objects, err := m.storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := m.storage.Delete(ctx, object.Key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire periodically sweeps the sessions in storage, so sessions opened
+// on any instance are discarded once their TTL has passed, completed or not
+func (m *UploadSessions) expire() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := m.sweep(context.Background(), time.Now())
+		if err != nil {
+			log.Printf("[STORAGE] Failed to sweep upload sessions: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("[STORAGE] Removed %d expired upload sessions", removed)
+		}
+	}
+}
+
+// sweep removes the sessions that expired before now. Chunks left without a
+// manifest are removed once they are older than the TTL.
+func (m *UploadSessions) sweep(ctx context.Context, now time.Time) (int, error) {
+	objects, err := m.storage.List(ctx, sessionPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// Group the objects by session, noting the newest of each
+	manifests := make(map[string]bool)
+	newest := make(map[string]time.Time)
+	for _, object := range objects {
+		id := strings.SplitN(strings.TrimPrefix(object.Key, sessionPrefix), "/", 2)[0]
+		if path.Base(object.Key) == sessionManifest {
+			manifests[id] = true
+		}
+		if object.LastModified.After(newest[id]) {
+			newest[id] = object.LastModified
+		}
+	}
+
+	removed := 0
+	for id, modified := range newest {
+		prefix := sessionPrefix + id + "/"
+		expired := now.Sub(modified) > m.config.TTL
+		if manifests[id] {
+			session, err := m.load(ctx, prefix+sessionManifest)
+			if err != nil && !errors.Is(err, ErrSessionNotFound) {
+				log.Printf("[STORAGE] Failed to read upload session %s: %v", id, err)
+				continue
+			}
+			if session != nil {
+				expired = now.After(session.ExpiresAt)
+			}
+		}
+		if !expired {
+			continue
+		}
+		if err := m.remove(ctx, prefix); err != nil {
+			log.Printf("[STORAGE] Failed to remove expired upload session %s: %v", id, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSessions(t *testing.T, images map[string]ImageProcessingConfig) (*UploadSessions, Storage) {
+	t.Helper()
+	storage := NewMemoryStorage(nil)
+	media := NewMediaStore(storage, nil, images, 0)
+	return NewUploadSessions(media, nil, UploadSessionConfig{TTL: time.Hour}), storage
+}
+
+func openSession(t *testing.T, sessions *UploadSessions, contentType string, chunks ...[]byte) *UploadSession {
+	t.Helper()
+	ctx := context.Background()
+	session := &UploadSession{UserID: "user-1", DeviceID: "device-1", Source: "upload", Filename: "file", ContentType: contentType}
+	if err := sessions.Open(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	for i, chunk := range chunks {
+		if err := sessions.PutChunk(ctx, session, i, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return session
+}
+
+func TestUploadSessionOwnership(t *testing.T) {
+	sessions, storage := newTestSessions(t, nil)
+	session := openSession(t, sessions, "video/mp4", []byte("chunk"))
+
+	// Nothing is stored in the user's media namespace
+	objects, err := storage.List(context.Background(), "user-1/")
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("objects under user-1/ = %v, %v; want none", objects, err)
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		deviceID string
+		id       string
+		err      error
+	}{
+		{name: "owner", userID: "user-1", deviceID: "device-1", id: session.ID},
+		{name: "other device", userID: "user-1", deviceID: "device-2", id: session.ID, err: ErrSessionNotFound},
+		{name: "other user", userID: "user-2", deviceID: "device-1", id: session.ID, err: ErrSessionNotFound},
+		{name: "unknown id", userID: "user-1", deviceID: "device-1", id: "0123456789abcdef", err: ErrSessionNotFound},
+		{name: "path in id", userID: "user-1", deviceID: "device-1", id: "../" + session.ID, err: ErrSessionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sessions.Get(context.Background(), tt.userID, tt.deviceID, tt.id)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Get() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && got.ID != session.ID {
+				t.Fatalf("Get() = %s, want %s", got.ID, session.ID)
+			}
+		})
+	}
+}
+
+func TestUploadSessionSweep(t *testing.T) {
+	ctx := context.Background()
+	sessions, storage := newTestSessions(t, nil)
+
+	live := openSession(t, sessions, "video/mp4", []byte("a"))
+	expired := openSession(t, sessions, "video/mp4", []byte("b"))
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := sessions.save(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	completed := openSession(t, sessions, "video/mp4", []byte("c"))
+	if _, err := sessions.Complete(ctx, completed, 1, "user-1/device-1/c.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	// Chunks of a session whose manifest was never written
+	orphan := sessionPrefix + "deadbeef/000000"
+	if _, err := storage.Put(ctx, orphan, strings.NewReader("d"), 1, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		removed int
+		remain  []string // Session IDs still in storage afterwards
+	}{
+		{name: "expired manifest", now: time.Now(), removed: 1, remain: []string{live.ID, completed.ID, "deadbeef"}},
+		{name: "everything past the TTL", now: time.Now().Add(2 * time.Hour), removed: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed, err := sessions.sweep(ctx, tt.now)
+			if err != nil || removed != tt.removed {
+				t.Fatalf("sweep() = %d, %v; want %d", removed, err, tt.removed)
+			}
+			objects, _ := storage.List(ctx, sessionPrefix)
+			remaining := make(map[string]bool)
+			for _, object := range objects {
+				remaining[strings.SplitN(strings.TrimPrefix(object.Key, sessionPrefix), "/", 2)[0]] = true
+			}
+			if len(remaining) != len(tt.remain) {
+				t.Fatalf("sessions left = %v, want %v", remaining, tt.remain)
+			}
+			for _, id := range tt.remain {
+				if !remaining[id] {
+					t.Fatalf("session %s was removed, left = %v", id, remaining)
+				}
+			}
+		})
+	}
+	// The completed upload itself is not a session object
+	if _, err := storage.Stat(ctx, "user-1/device-1/c.mp4"); err != nil {
+		t.Fatalf("assembled object removed: %v", err)
+	}
+}
+
+func TestUploadSessionCompleteRunsImagePipeline(t *testing.T) {
+	ctx := context.Background()
+	data, err := os.ReadFile("testdata/exif-gps.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, storage := newTestSessions(t, map[string]ImageProcessingConfig{
+		"default": {StripMetadata: true, ExtractEXIF: []string{"Make"}, Thumbnail: true},
+	})
+	session := openSession(t, sessions, "image/jpeg", data[:300], data[300:])
+
+	completed, err := sessions.Complete(ctx, session, 2, "user-1/device-1/photo.jpg")
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if completed.ThumbnailKey != "user-1/device-1/photo.jpg.thumb.jpg" || completed.EXIF["Make"] != "Chronos" {
+		t.Fatalf("Complete() = thumbnail %q, EXIF %v", completed.ThumbnailKey, completed.EXIF)
+	}
+
+	object, info, err := storage.Get(ctx, "user-1/device-1/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(object)
+	object.Close()
+	if findEXIF("image/jpeg", stored) != nil {
+		t.Fatal("assembled image still carries Exif data")
+	}
+	if info.Metadata[MetaSource] != "upload" || completed.Size != int64(len(stored)) {
+		t.Fatalf("stored %d bytes with metadata %v, session reports %d", len(stored), info.Metadata, completed.Size)
+	}
+	if _, err := storage.Stat(ctx, completed.ThumbnailKey); err != nil {
+		t.Fatalf("thumbnail: %v", err)
+	}
+	if _, err := storage.Stat(ctx, session.prefix()+sessionAssembled); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("intermediate object left behind: %v", err)
+	}
+}
+
+func TestUploadSessionSizeLimit(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage(nil)
+	validator := NewUploadValidator(map[string]UploadPolicy{"default": {MaxSize: 10}})
+	sessions := NewUploadSessions(NewMediaStore(storage, nil, nil, 0), validator, UploadSessionConfig{TTL: time.Hour})
+	session := openSession(t, sessions, "text/plain", []byte("aaaa"), []byte("bbbb"))
+
+	// Resending a chunk replaces it rather than adding to the total
+	if err := sessions.PutChunk(ctx, session, 1, []byte("cccccc")); err != nil {
+		t.Fatalf("PutChunk() replacing a chunk error = %v", err)
+	}
+	if err := sessions.PutChunk(ctx, session, 2, []byte("d")); !errors.Is(err, ErrUploadTooLarge) {
+		t.Fatalf("PutChunk() past the limit error = %v, want %v", err, ErrUploadTooLarge)
+	}
+	if _, size, _ := sessions.Chunks(ctx, session); size != 10 {
+		t.Fatalf("chunks hold %d bytes, want 10", size)
+	}
+}
+
+func TestUploadSessionCompleteChecksContent(t *testing.T) {
+	storage := NewMemoryStorage(nil)
+	validator := NewUploadValidator(map[string]UploadPolicy{"default": {AllowedTypes: []string{"image/*"}}})
+	sessions := NewUploadSessions(NewMediaStore(storage, nil, nil, 0), validator, UploadSessionConfig{TTL: time.Hour})
+	// The first chunk is too short to tell what the file is
+	session := openSession(t, sessions, "image/png", []byte("\x89PN"), []byte("<html><script></script></html>"))
+
+	if _, err := sessions.Complete(context.Background(), session, 2, "user-1/device-1/a.png"); !errors.Is(err, ErrMediaTypeMismatch) {
+		t.Fatalf("Complete() error = %v, want %v", err, ErrMediaTypeMismatch)
+	}
+	if _, err := storage.Stat(context.Background(), "user-1/device-1/a.png"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Stat() error = %v, want %v", err, ErrObjectNotFound)
+	}
+}
+
+func TestUploadSessionCompleteOnce(t *testing.T) {
+	ctx := context.Background()
+	sessions, _ := newTestSessions(t, nil)
+	session := openSession(t, sessions, "video/mp4", []byte("a"), []byte("b"))
+
+	// Every caller holds a copy of the session loaded before completion
+	const callers = 8
+	var (
+		wg        sync.WaitGroup
+		completed atomic.Int32
+		conflicts atomic.Int32
+	)
+	for i := 0; i < callers; i++ {
+		stale := *session
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sessions.Complete(ctx, &stale, 2, "user-1/device-1/a.mp4")
+			switch {
+			case err == nil:
+				completed.Add(1)
+			case errors.Is(err, ErrSessionCompleted):
+				conflicts.Add(1)
+			default:
+				t.Errorf("Complete() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if completed.Load() != 1 || conflicts.Load() != callers-1 {
+		t.Fatalf("%d completions and %d conflicts, want 1 and %d", completed.Load(), conflicts.Load(), callers-1)
+	}
+	if err := sessions.PutChunk(ctx, session, 0, []byte("a")); !errors.Is(err, ErrSessionCompleted) {
+		t.Fatalf("PutChunk() after completion error = %v, want %v", err, ErrSessionCompleted)
+	}
+	if len(sessions.locks) != 0 {
+		t.Fatalf("%d session locks left", len(sessions.locks))
+	}
+}
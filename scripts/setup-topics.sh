@@ -23,9 +23,11 @@ while [ $ATTEMPT -lt $MAX_ATTEMPTS ]; do
   echo "Attempt $((ATTEMPT+1))/$MAX_ATTEMPTS: Checking if Kafka is ready..."
   
   if check_kafka; then
-    # Create the topic
+    # Create the topics
     echo "Creating topic: location-events"
     kafka-topics.sh --bootstrap-server kafka:9092 --create --if-not-exists --topic location-events --partitions 3 --replication-factor 1
+    echo "Creating topic: media-events"
+    kafka-topics.sh --bootstrap-server kafka:9092 --create --if-not-exists --topic media-events --partitions 3 --replication-factor 1
     
     # Verify the topic was created
     echo "Verifying topic creation:"